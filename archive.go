@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/loggerutils"
+	"github.com/docker/docker/pkg/urlutil"
+)
+
+const (
+	archiveS3BucketKey          = "archive-s3-bucket"
+	archiveS3EndpointKey        = "archive-s3-endpoint"
+	archiveS3RegionKey          = "archive-s3-region"
+	archiveS3PrefixKey          = "archive-s3-prefix"
+	archiveS3PathStyleKey       = "archive-s3-path-style"
+	archiveS3AccessKeyIDKey     = "archive-s3-access-key-id"
+	archiveS3SecretAccessKeyKey = "archive-s3-secret-access-key"
+	archiveMaxSizeKey           = "archive-max-size"
+	archiveMaxAgeKey            = "archive-max-age"
+)
+
+// Plugin-wide credentials of the archive, used when the container does not
+// set them, so they are not visible in docker inspect
+const (
+	envVarAWSAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	envVarAWSSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	envVarAWSSessionToken    = "AWS_SESSION_TOKEN"
+)
+
+const (
+	defaultArchiveRegion = "us-east-1"
+	// Compressed size of an object when it is rolled
+	defaultArchiveMaxSize = 64 << 20
+	// Age of an object when it is rolled, counted from its first message
+	defaultArchiveMaxAge = 15 * time.Minute
+	// How often age of the current object is checked
+	archiveRollCheckFrequency = 10 * time.Second
+	// Timeout of one S3 request, parts are up to a few MiB
+	archiveRequestTimeout = time.Minute
+	// Number of parts waiting for the uploader, Log blocks when it is full
+	archiveUploadQueue = 1
+
+	archiveContentType = "application/gzip"
+	archiveObjectTime  = "20060102T150405.000000000Z"
+)
+
+// archiveOptions are parsed archive-* options
+type archiveOptions struct {
+	endpoint    *url.URL
+	bucket      string
+	region      string
+	pathStyle   bool
+	credentials s3Credentials
+	maxSize     int64
+	maxAge      time.Duration
+}
+
+// archiveRecord is one line of archived objects
+type archiveRecord struct {
+	Time          string            `json:"time"`
+	Stream        string            `json:"stream,omitempty"`
+	Line          string            `json:"line"`
+	Partial       bool              `json:"partial,omitempty"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	ImageName     string            `json:"image_name,omitempty"`
+	Host          string            `json:"host,omitempty"`
+	Tag           string            `json:"tag,omitempty"`
+	Attrs         map[string]string `json:"attrs,omitempty"`
+}
+
+// archiveObject is the object being written. Compressed data is uploaded as
+// parts of multipart upload when it reaches the minimal part size, objects
+// smaller than that are uploaded with one request when they are rolled. Every
+// part is a separate gzip member, so the object stays readable without a part
+// which failed to upload.
+type archiveObject struct {
+	key     string
+	date    string
+	started time.Time
+	// Size of parts handed to the uploader
+	size int64
+	// Number of messages in the buffer
+	messages int
+
+	buffer *bytes.Buffer
+	gzip   *gzip.Writer
+
+	// Fields of the multipart upload are used only by the uploader
+	uploadID string
+	etags    []string
+	// Number of messages in uploaded parts
+	uploaded int
+}
+
+// archivePart is compressed data of an object handed to the uploader, the
+// last part finishes the object
+type archivePart struct {
+	object   *archiveObject
+	data     []byte
+	messages int
+	last     bool
+}
+
+// archiveLogger writes messages of one container as gzip compressed NDJSON
+// objects to S3-compatible storage. Objects are partitioned by date and
+// container, and rolled by size, age and when the date changes.
+type archiveLogger struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	client *s3Client
+
+	prefix  string
+	maxSize int64
+	maxAge  time.Duration
+	record  archiveRecord
+
+	mu       sync.Mutex
+	object   *archiveObject
+	sequence int
+	closed   bool
+	done     chan struct{}
+
+	// Parts are uploaded in order by the uploader, so requests to the storage
+	// and their retries do not hold mu
+	parts    chan archivePart
+	uploaded chan struct{}
+	// Last error of the uploader, read after uploaded is closed
+	err error
+
+	deadLetters *deadLetterFile
+	// Number of messages which could not be archived, updated atomically
+	lost int64
+}
+
+// parseArchiveOptions returns nil if archive-s3-bucket is not set
+func parseArchiveOptions(cfg map[string]string) (*archiveOptions, error) {
+	bucket, ok := cfg[archiveS3BucketKey]
+	if !ok {
+		for key := range cfg {
+			if strings.HasPrefix(key, "archive-") {
+				return nil, fmt.Errorf("%s: %s is expected with %s", driverName, archiveS3BucketKey, key)
+			}
+		}
+		return nil, nil
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("%s: %s cannot be empty", driverName, archiveS3BucketKey)
+	}
+	options := &archiveOptions{
+		bucket:  bucket,
+		region:  defaultArchiveRegion,
+		maxSize: defaultArchiveMaxSize,
+		maxAge:  defaultArchiveMaxAge,
+		credentials: s3Credentials{
+			accessKeyID:     os.Getenv(envVarAWSAccessKeyID),
+			secretAccessKey: os.Getenv(envVarAWSSecretAccessKey),
+			sessionToken:    os.Getenv(envVarAWSSessionToken),
+		},
+	}
+	if region, ok := cfg[archiveS3RegionKey]; ok && region != "" {
+		options.region = region
+	}
+
+	endpoint, ok := cfg[archiveS3EndpointKey]
+	if !ok {
+		endpoint = "https://s3." + options.region + ".amazonaws.com"
+	}
+	var err error
+	options.endpoint, err = url.Parse(endpoint)
+	if err != nil || !urlutil.IsURL(endpoint) || !options.endpoint.IsAbs() {
+		return nil, fmt.Errorf("%s: expected format scheme://dns_name_or_ip:port for %s", driverName, archiveS3EndpointKey)
+	}
+	if pathStyle, ok := cfg[archiveS3PathStyleKey]; ok {
+		options.pathStyle, err = strconv.ParseBool(pathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to parse %s - %v", driverName, archiveS3PathStyleKey, err)
+		}
+	}
+
+	if accessKeyID, ok := cfg[archiveS3AccessKeyIDKey]; ok {
+		options.credentials = s3Credentials{
+			accessKeyID:     accessKeyID,
+			secretAccessKey: cfg[archiveS3SecretAccessKeyKey],
+		}
+	} else if _, ok := cfg[archiveS3SecretAccessKeyKey]; ok {
+		return nil, fmt.Errorf("%s: %s is expected with %s", driverName, archiveS3AccessKeyIDKey, archiveS3SecretAccessKeyKey)
+	}
+	if options.credentials.accessKeyID == "" || options.credentials.secretAccessKey == "" {
+		return nil, fmt.Errorf("%s: archive needs credentials, set %s and %s or %s and %s of the plugin", driverName,
+			archiveS3AccessKeyIDKey, archiveS3SecretAccessKeyKey, envVarAWSAccessKeyID, envVarAWSSecretAccessKey)
+	}
+
+	if maxSize, ok := cfg[archiveMaxSizeKey]; ok {
+		options.maxSize, err = parseByteSize(maxSize)
+		if err != nil || options.maxSize <= 0 {
+			return nil, fmt.Errorf("%s: failed to parse %s '%s', expected size like 64m", driverName, archiveMaxSizeKey, maxSize)
+		}
+	}
+	if maxAge, ok := cfg[archiveMaxAgeKey]; ok {
+		options.maxAge, err = time.ParseDuration(maxAge)
+		if err != nil || options.maxAge <= 0 {
+			return nil, fmt.Errorf("%s: failed to parse %s '%s', expected duration like 15m", driverName, archiveMaxAgeKey, maxAge)
+		}
+	}
+	return options, nil
+}
+
+// parseByteSize parses size in bytes with optional k, m or g suffix of
+// binary units
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToLower(strings.TrimSpace(value))
+	number = strings.TrimSuffix(number, "b")
+	switch {
+	case strings.HasSuffix(number, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * multiplier, nil
+}
+
+// newArchiveLogger creates archive logger, or returns nil if the container
+// is not archived
+func newArchiveLogger(info logger.Info) (*archiveLogger, error) {
+	options, err := parseArchiveOptions(info.Config)
+	if err != nil || options == nil {
+		return nil, err
+	}
+	orchestrator, err := detectOrchestrator(info)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := renderOptionTemplate(info, archiveS3PrefixKey, &templateData{&info, orchestrator})
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	hostname, err := renderOptionTemplate(info, splunkHostKey, &templateData{&info, orchestrator})
+	if err != nil {
+		return nil, err
+	}
+	if hostname == "" {
+		hostname, err = info.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("%s: cannot access hostname to set host field", driverName)
+		}
+	}
+	tag := ""
+	if tagTemplate, ok := info.Config[tagKey]; !ok || tagTemplate != "" {
+		tag, err = loggerutils.ParseLogTag(info, loggerutils.DefaultTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	attrs, err := info.ExtraAttributes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &archiveLogger{
+		ctx:    ctx,
+		cancel: cancel,
+		client: &s3Client{
+			client:       &http.Client{Timeout: archiveRequestTimeout},
+			endpoint:     options.endpoint,
+			bucket:       options.bucket,
+			region:       options.region,
+			pathStyle:    options.pathStyle,
+			credentials:  options.credentials,
+			retryBackoff: defaultS3RetryBackoff,
+			now:          time.Now,
+		},
+		prefix:  prefix,
+		maxSize: options.maxSize,
+		maxAge:  options.maxAge,
+		record: archiveRecord{
+			ContainerID:   info.ContainerID,
+			ContainerName: info.Name(),
+			ImageName:     info.ContainerImageName,
+			Host:          hostname,
+			Tag:           tag,
+			Attrs:         attrs,
+		},
+		done:        make(chan struct{}),
+		parts:       make(chan archivePart, archiveUploadQueue),
+		uploaded:    make(chan struct{}),
+		deadLetters: acquireDeadLetterFile(info.ContainerID),
+	}
+	go l.roller()
+	go l.uploader()
+	return l, nil
+}
+
+// roller rolls the current object when it gets too old, so messages of quiet
+// containers are archived too
+func (l *archiveLogger) roller() {
+	frequency := archiveRollCheckFrequency
+	if l.maxAge < frequency {
+		frequency = l.maxAge
+	}
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.object != nil && time.Since(l.object.started) >= l.maxAge {
+				l.roll()
+			}
+			l.mu.Unlock()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *archiveLogger) Log(msg *logger.Message) error {
+	record := l.record
+	record.Time = msg.Timestamp.UTC().Format(time.RFC3339Nano)
+	record.Stream = msg.Source
+	record.Line = string(msg.Line)
+	record.Partial = isPartial(msg)
+	date := msg.Timestamp.UTC().Format("2006/01/02")
+	logger.PutMessage(msg)
+
+	line, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return fmt.Errorf("%s: archive logger is closed", driverName)
+	}
+	// Objects are partitioned by the date of their messages
+	if l.object != nil && l.object.date != date {
+		l.roll()
+	}
+	if l.object == nil {
+		l.object = l.newObject(date, msg.Timestamp)
+	}
+	object := l.object
+	object.gzip.Write(line)
+	object.gzip.Write([]byte{'\n'})
+	object.messages++
+
+	if int64(object.buffer.Len())+object.size >= l.maxSize {
+		l.roll()
+	} else if object.buffer.Len() >= s3MinPartSize {
+		l.flushPart(false)
+	}
+	return nil
+}
+
+func (l *archiveLogger) newObject(date string, timestamp time.Time) *archiveObject {
+	l.sequence++
+	object := &archiveObject{
+		key:     fmt.Sprintf("%s%s/%s/%s-%d.ndjson.gz", l.prefix, date, l.record.ContainerID, timestamp.UTC().Format(archiveObjectTime), l.sequence),
+		date:    date,
+		started: time.Now(),
+		buffer:  new(bytes.Buffer),
+	}
+	object.gzip = gzip.NewWriter(object.buffer)
+	return object
+}
+
+// flushPart hands buffered data of the current object to the uploader as the
+// next part. It is called with mu locked.
+func (l *archiveLogger) flushPart(last bool) {
+	object := l.object
+	// Writes to the buffer never fail, so closing the gzip member does not
+	// fail either
+	object.gzip.Close()
+	part := archivePart{object: object, data: object.buffer.Bytes(), messages: object.messages, last: last}
+	object.size += int64(object.buffer.Len())
+	object.messages = 0
+	if last {
+		l.object = nil
+	} else {
+		object.buffer = new(bytes.Buffer)
+		object.gzip.Reset(object.buffer)
+	}
+	l.parts <- part
+}
+
+// roll finishes the current object, the next message starts a new one
+func (l *archiveLogger) roll() {
+	if l.object != nil {
+		l.flushPart(true)
+	}
+}
+
+// uploader uploads parts in the order they were written until the logger is
+// closed
+func (l *archiveLogger) uploader() {
+	defer close(l.uploaded)
+	for part := range l.parts {
+		if err := l.upload(part); err != nil {
+			logrus.WithField("id", l.record.ContainerID).Error(err)
+			l.err = err
+		}
+	}
+}
+
+// upload uploads the part. Objects which are written as one part are uploaded
+// with one request, others with multipart upload, which is completed with the
+// parts uploaded successfully.
+func (l *archiveLogger) upload(part archivePart) error {
+	object := part.object
+	if part.last && object.uploadID == "" {
+		if part.messages == 0 {
+			return nil
+		}
+		if err := l.client.putObject(l.ctx, object.key, archiveContentType, part.data); err != nil {
+			return l.drop(part, err)
+		}
+		object.uploaded += part.messages
+		l.archived(object)
+		return nil
+	}
+
+	var err error
+	if !part.last || part.messages > 0 {
+		err = l.uploadPart(part)
+	}
+	if !part.last {
+		return err
+	}
+	if len(object.etags) == 0 {
+		l.abortUpload(object)
+		return err
+	}
+	if completeErr := l.client.completeMultipartUpload(l.ctx, object.key, object.uploadID, object.etags); completeErr != nil {
+		// Uploaded parts are not kept, so they cannot be written to the
+		// dead-letter file
+		atomic.AddInt64(&l.lost, int64(object.uploaded))
+		l.abortUpload(object)
+		return fmt.Errorf("%s: failed to archive %d messages to %s - %v", driverName, object.uploaded, object.key, completeErr)
+	}
+	l.archived(object)
+	return err
+}
+
+// uploadPart uploads the part of multipart upload, the upload is created with
+// the first part
+func (l *archiveLogger) uploadPart(part archivePart) error {
+	object := part.object
+	if object.uploadID == "" {
+		uploadID, err := l.client.createMultipartUpload(l.ctx, object.key, archiveContentType)
+		if err != nil {
+			return l.drop(part, err)
+		}
+		object.uploadID = uploadID
+	}
+	etag, err := l.client.uploadPart(l.ctx, object.key, object.uploadID, len(object.etags)+1, part.data)
+	if err != nil {
+		return l.drop(part, err)
+	}
+	object.etags = append(object.etags, etag)
+	object.uploaded += part.messages
+	return nil
+}
+
+// abortUpload aborts multipart upload of the object, parts of uploads which
+// could not be aborted are left for lifecycle rules of the bucket
+func (l *archiveLogger) abortUpload(object *archiveObject) {
+	if object.uploadID == "" {
+		return
+	}
+	if err := l.client.abortMultipartUpload(l.ctx, object.key, object.uploadID); err != nil {
+		logrus.WithField("id", l.record.ContainerID).WithError(err).Error("Failed to abort multipart upload")
+	}
+}
+
+func (l *archiveLogger) archived(object *archiveObject) {
+	logrus.WithField("id", l.record.ContainerID).WithField("key", object.key).WithField("messages", object.uploaded).Debug("Archived object")
+}
+
+// drop counts messages of the part which failed to upload and writes them to
+// the dead-letter file, the rest of the object is still uploaded
+func (l *archiveLogger) drop(part archivePart, err error) error {
+	atomic.AddInt64(&l.lost, int64(part.messages))
+	if l.deadLetters != nil {
+		if writeErr := l.writeDeadLetters(part, err); writeErr != nil {
+			logrus.WithField("id", l.record.ContainerID).WithError(writeErr).Error("Failed to write dropped messages to dead-letter file")
+		}
+	}
+	return fmt.Errorf("%s: failed to archive %d messages to %s - %v", driverName, part.messages, part.object.key, err)
+}
+
+// writeDeadLetters writes records of the part to the dead-letter file, the
+// event of every message is the archive record
+func (l *archiveLogger) writeDeadLetters(part archivePart, err error) error {
+	reader, gzipErr := gzip.NewReader(bytes.NewReader(part.data))
+	if gzipErr != nil {
+		return gzipErr
+	}
+	data, readErr := ioutil.ReadAll(reader)
+	if readErr != nil {
+		return readErr
+	}
+	var messages []*splunkMessage
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\n'}) {
+		record := json.RawMessage(line)
+		messages = append(messages, &splunkMessage{Event: &record})
+	}
+	status := 0
+	if s3Err, ok := err.(*s3Error); ok {
+		status = s3Err.statusCode
+	}
+	return l.deadLetters.write(messages, deadLetterRecord{
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Reason:      err.Error(),
+		Status:      status,
+		Output:      l.Name(),
+		URL:         l.client.objectURL(part.object.key, nil).String(),
+		ContainerID: l.record.ContainerID,
+	})
+}
+
+// Close finishes the current object and waits until all parts are uploaded
+func (l *archiveLogger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	l.roll()
+	close(l.parts)
+	l.mu.Unlock()
+
+	<-l.uploaded
+	if l.deadLetters != nil {
+		l.deadLetters.release()
+	}
+	return l.err
+}
+
+// abort cancels uploads in flight, so Close does not wait for retries
+func (l *archiveLogger) abort() {
+	l.cancel()
+}
+
+func (l *archiveLogger) Name() string {
+	return "archive"
+}
+
+// validateArchiveLogOpt validates archive-* options
+func validateArchiveLogOpt(cfg map[string]string) error {
+	_, err := parseArchiveOptions(cfg)
+	return err
+}
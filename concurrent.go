@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// batchResult is reported back to the worker when a batch is sent or failed
+type batchResult struct {
+	messages []*splunkMessage
+	sent     int
+	err      error
+}
+
+// concurrentWorker is used instead of worker when more than one request is
+// allowed to be in flight. Batches can be delivered out of order, failed
+// batches are retried before buffered messages. Messages in flight count
+// against bufferMaximum together with buffered messages, so when several
+// batches fail at once each of them is dropped only if buffer is full. When
+// buffer is full worker stops reading the stream until some batches are done.
+// Loggers with strict ordering use worker, which sends one batch at a time.
+func (l *splunkLogger) concurrentWorker() {
+	timer := time.NewTicker(l.postMessagesFrequency)
+	defer timer.Stop()
+
+	results := make(chan batchResult, l.concurrentRequests)
+	stream := l.stream
+	var messages []*splunkMessage
+	inFlight := 0
+	inFlightMessages := 0
+	// After a failure we retry only on timer, not on every new message
+	failed := false
+	closing := false
+
+	send := func(flush bool) {
+		for inFlight < l.concurrentRequests && len(messages) > 0 {
+			size := l.postMessagesBatchSize
+			if len(messages) < size {
+				if !flush {
+					return
+				}
+				size = len(messages)
+			}
+			// Limit capacity so appending to buffer never overwrites a batch in flight
+			batch := messages[:size:size]
+			messages = messages[size:]
+			inFlight++
+			inFlightMessages += len(batch)
+			go func() {
+				sent, err := l.tryPostMessages(batch)
+				results <- batchResult{batch, sent, err}
+			}()
+		}
+	}
+
+	for {
+		input := stream
+		if len(messages)+inFlightMessages >= l.bufferMaximum {
+			// Buffer is full, stop reading new messages until batches in flight
+			// are sent or dropped. After a failure retry on timer as well, so
+			// unavailable HEC is not retried in a loop.
+			if !failed {
+				send(true)
+			}
+			input = nil
+		}
+
+		select {
+		case message, open := <-input:
+			if !open {
+				stream = nil
+				closing = true
+				break
+			}
+			messages = append(messages, message)
+			if !failed {
+				send(false)
+			}
+		case <-timer.C:
+			failed = false
+			send(true)
+		case result := <-results:
+			inFlight--
+			inFlightMessages -= len(result.messages)
+			if result.err != nil {
+				logrus.Error(result.err)
+				// Only messages not sent before error are retried
+				unsent := result.messages[result.sent:]
+				l.stats.addFailed(len(unsent))
+				failed = true
+				if closing || len(messages)+inFlightMessages+len(unsent) >= l.bufferMaximum {
+					// Buffer has got to its maximum or this is last chance
+					l.dropMessages(unsent, result.err)
+				} else {
+					messages = append(append(make([]*splunkMessage, 0, len(unsent)+len(messages)), unsent...), messages...)
+				}
+			}
+		}
+
+		if closing {
+			send(true)
+			if inFlight == 0 && len(messages) == 0 {
+				l.markClosed()
+				return
+			}
+		}
+	}
+}
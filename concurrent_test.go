@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify that several batches are sent at the same time
+func TestConcurrentRequests(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesBatchSize, "10"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarConcurrentRequests, "4"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarConcurrentRequests)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.responseDelay = 50 * time.Millisecond
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:   hec.URL(),
+			splunkTokenKey: hec.token,
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 100 {
+		t.Fatalf("Expected # of messages %d, got %d", 100, len(hec.messages))
+	}
+
+	// Batches can be reordered, but every message should be delivered once
+	var lines []int
+	for _, message := range hec.messages {
+		if event, err := message.EventAsMap(); err != nil {
+			t.Fatal(err)
+		} else {
+			line, err := strconv.Atoi(event["line"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+		}
+	}
+	sort.Ints(lines)
+	for i, line := range lines {
+		if line != i {
+			t.Fatalf("Unexpected message %d at %d", line, i)
+		}
+	}
+
+	if hec.maxInFlight < 2 || hec.maxInFlight > 4 {
+		t.Fatalf("Unexpected number of requests in flight %d", hec.maxInFlight)
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that when several batches fail at once buffer does not grow above maximum
+func TestConcurrentRequestsBufferMaximum(t *testing.T) {
+	// Failed batches are retried on timer
+	if err := os.Setenv(envVarPostMessagesFrequency, "10ms"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	if err := os.Setenv(envVarPostMessagesBatchSize, "2"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarBufferMaximum, "6"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarBufferMaximum)
+
+	if err := os.Setenv(envVarStreamChannelSize, "0"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarStreamChannelSize)
+
+	if err := os.Setenv(envVarConcurrentRequests, "3"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarConcurrentRequests)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.simulateServerError = true
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Let all batches in flight fail
+	time.Sleep(100 * time.Millisecond)
+
+	hec.lock.Lock()
+	hec.simulateServerError = false
+	hec.lock.Unlock()
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) > 6 {
+		t.Fatalf("Expected at most %d messages, got %d", 6, len(hec.messages))
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that when buffer is full and HEC fails batches are retried on timer
+// and not right away
+func TestConcurrentRequestsBufferFullBackoff(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "500ms"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	if err := os.Setenv(envVarPostMessagesBatchSize, "2"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarBufferMaximum, "8"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarBufferMaximum)
+
+	if err := os.Setenv(envVarStreamChannelSize, "0"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarStreamChannelSize)
+
+	if err := os.Setenv(envVarConcurrentRequests, "3"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarConcurrentRequests)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.simulateServerError = true
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 30; i++ {
+			if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// First batches fail, next ones wait for the timer
+	time.Sleep(200 * time.Millisecond)
+
+	hec.lock.Lock()
+	requests := hec.numOfRequests
+	hec.simulateServerError = false
+	hec.lock.Unlock()
+
+	if requests != 3 {
+		t.Fatalf("Expected %d requests before timer, got %d", 3, requests)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that strict ordering sends one batch at a time
+func TestConcurrentRequestsStrictOrdering(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesBatchSize, "10"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarConcurrentRequests, "4"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarConcurrentRequests)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.responseDelay = 10 * time.Millisecond
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:            hec.URL(),
+			splunkTokenKey:          hec.token,
+			splunkStrictOrderingKey: "true",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 100 {
+		t.Fatalf("Expected # of messages %d, got %d", 100, len(hec.messages))
+	}
+
+	for i, message := range hec.messages {
+		if event, err := message.EventAsMap(); err != nil {
+			t.Fatal(err)
+		} else if event["line"] != fmt.Sprintf("%d", i) {
+			t.Fatalf("Unexpected message %v at %d", event["line"], i)
+		}
+	}
+
+	if hec.maxInFlight != 1 {
+		t.Fatalf("Unexpected number of requests in flight %d", hec.maxInFlight)
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
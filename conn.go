@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	// How long dialing or one exchange with the server can take
+	outputConnTimeout = 10 * time.Second
+)
+
+// outputConn is connection of a stream or datagram output. It is dialed on
+// first use and dialed again after errors. It is not safe for concurrent use.
+type outputConn struct {
+	ctx       context.Context
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	// Called for every new connection before it is used, for example to
+	// authenticate
+	onConnect func(conn net.Conn) error
+
+	conn   net.Conn
+	closed chan struct{}
+}
+
+// do calls exchange with the connection. When exchange fails on an existing
+// connection, server may have closed it, so exchange is called once more with
+// a new connection.
+func (c *outputConn) do(exchange func(conn net.Conn) error) error {
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		reused := c.conn != nil
+		if !reused {
+			if err := c.dial(); err != nil {
+				return err
+			}
+		}
+		c.conn.SetDeadline(time.Now().Add(outputConnTimeout))
+		err := exchange(c.conn)
+		if err == nil {
+			return nil
+		}
+		c.disconnect()
+		if !reused {
+			return err
+		}
+	}
+}
+
+func (c *outputConn) dial() error {
+	dialer := &net.Dialer{Timeout: outputConnTimeout}
+	conn, err := dialer.DialContext(c.ctx, c.network, c.address)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(outputConnTimeout))
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	if c.onConnect != nil {
+		if err := c.onConnect(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	// Close connection when sending is aborted, so exchange does not block
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+	c.conn = conn
+	c.closed = closed
+	return nil
+}
+
+func (c *outputConn) disconnect() {
+	if c.conn == nil {
+		return
+	}
+	c.conn.Close()
+	close(c.closed)
+	c.conn = nil
+}
+
+// outputTLSConfig returns TLS settings of the output from the same options
+// as HEC uses. Server name is the host of the address unless splunk-caname
+// is set.
+func outputTLSConfig(info logger.Info, address string) (*tls.Config, error) {
+	tlsConfig, err := parseTLSConfig(info)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConfig.ServerName = host
+	}
+	return tlsConfig, nil
+}
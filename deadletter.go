@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	envVarDeadLetterDir     = "SPLUNK_LOGGING_DRIVER_DEAD_LETTER_DIR"
+	envVarDeadLetterMaxSize = "SPLUNK_LOGGING_DRIVER_DEAD_LETTER_MAX_SIZE"
+	envVarDeadLetterMaxFile = "SPLUNK_LOGGING_DRIVER_DEAD_LETTER_MAX_FILE"
+	envVarDeadLetterMaxAge  = "SPLUNK_LOGGING_DRIVER_DEAD_LETTER_MAX_AGE"
+)
+
+const (
+	defaultDeadLetterDir = "/var/log/docker/dead-letter"
+	// Value of SPLUNK_LOGGING_DRIVER_DEAD_LETTER_DIR which discards dropped
+	// messages, only their number is logged
+	deadLetterNone           = "none"
+	defaultDeadLetterMaxSize = 10 << 20
+	defaultDeadLetterMaxFile = 5
+	defaultDeadLetterMaxAge  = 7 * 24 * time.Hour
+	deadLetterFileExt        = ".ndjson"
+)
+
+// deadLetterOptions are plugin-wide, dead-letter files hold messages of
+// customers, so only the administrator of the plugin decides where they are
+// kept and for how long
+type deadLetterOptions struct {
+	dir string
+	// Size of a file before it is rotated
+	maxSize int64
+	// Number of files of a container, including the current one
+	maxFile int
+	// Files which were not modified for longer are removed
+	maxAge time.Duration
+}
+
+// deadLetterRecord is one line of a dead-letter file
+type deadLetterRecord struct {
+	Time        string `json:"time"`
+	Reason      string `json:"reason"`
+	Status      int    `json:"status,omitempty"`
+	Output      string `json:"output"`
+	URL         string `json:"url,omitempty"`
+	ContainerID string `json:"container_id"`
+	// Message as it would be sent to HEC
+	Message *splunkMessage `json:"message"`
+}
+
+// deadLetterFile appends dropped messages of one container. Destinations of
+// the container share the file, so it is opened once for all of them.
+type deadLetterFile struct {
+	path    string
+	options deadLetterOptions
+	// Number of loggers using the file, guarded by deadLetterFiles
+	refs int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// deadLetterFiles are files of running containers by path
+var deadLetterFiles = struct {
+	sync.Mutex
+	files map[string]*deadLetterFile
+}{files: make(map[string]*deadLetterFile)}
+
+// parseDeadLetterOptions returns options from plugin env, invalid values are
+// logged and defaults are used instead
+func parseDeadLetterOptions() deadLetterOptions {
+	options := deadLetterOptions{
+		dir:     defaultDeadLetterDir,
+		maxSize: defaultDeadLetterMaxSize,
+		maxFile: getAdvancedOptionInt(envVarDeadLetterMaxFile, defaultDeadLetterMaxFile),
+		maxAge:  getAdvancedOptionDuration(envVarDeadLetterMaxAge, defaultDeadLetterMaxAge),
+	}
+	if dir := os.Getenv(envVarDeadLetterDir); dir != "" {
+		options.dir = dir
+	}
+	if sizeStr := os.Getenv(envVarDeadLetterMaxSize); sizeStr != "" {
+		if size, err := parseByteSize(sizeStr); err != nil || size <= 0 {
+			logrus.Error(fmt.Sprintf("Failed to parse value of %s as size. Using default %d. %v", envVarDeadLetterMaxSize, options.maxSize, err))
+		} else {
+			options.maxSize = size
+		}
+	}
+	if options.maxFile < 1 {
+		logrus.Error(fmt.Sprintf("Value of %s must be at least 1. Using default %d.", envVarDeadLetterMaxFile, defaultDeadLetterMaxFile))
+		options.maxFile = defaultDeadLetterMaxFile
+	}
+	return options
+}
+
+// acquireDeadLetterFile returns dead-letter file of the container, or nil if
+// dead-letter files are disabled. The file is created on the first write, so
+// containers which never drop messages do not have one. Files of containers
+// which expired are removed.
+func acquireDeadLetterFile(containerID string) *deadLetterFile {
+	options := parseDeadLetterOptions()
+	if options.dir == deadLetterNone {
+		return nil
+	}
+	path := filepath.Join(options.dir, containerID+deadLetterFileExt)
+
+	deadLetterFiles.Lock()
+	defer deadLetterFiles.Unlock()
+	f, ok := deadLetterFiles.files[path]
+	if !ok {
+		f = &deadLetterFile{path: path, options: options}
+		deadLetterFiles.files[path] = f
+		removeExpiredDeadLetters(options)
+	}
+	f.refs++
+	return f
+}
+
+// release closes the file after the last logger of the container is closed
+func (f *deadLetterFile) release() {
+	deadLetterFiles.Lock()
+	defer deadLetterFiles.Unlock()
+	f.refs--
+	if f.refs > 0 {
+		return
+	}
+	delete(deadLetterFiles.files, f.path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			logrus.WithError(err).WithField("file", f.path).Error("Failed to close dead-letter file")
+		}
+		f.file = nil
+	}
+}
+
+// write appends one record for every message. All records are written at
+// once, so the file is rotated between batches and not within one.
+func (f *deadLetterFile) write(messages []*splunkMessage, record deadLetterRecord) error {
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	encoder := json.NewEncoder(buffer)
+	for _, message := range messages {
+		record.Message = message
+		if err := encoder.Encode(&record); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.size > 0 && f.size+int64(buffer.Len()) > f.options.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(buffer.Bytes())
+	f.size += int64(n)
+	return err
+}
+
+func (f *deadLetterFile) open() error {
+	// Dead letters are messages of customers, so they are readable only by
+	// the owner
+	if err := os.MkdirAll(f.options.dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+// rotate renames the current file to path.1, path.1 to path.2 and so on, the
+// oldest file is removed when the container has maxFile files
+func (f *deadLetterFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	f.size = 0
+	rotated := func(i int) string {
+		if i == 0 {
+			return f.path
+		}
+		return fmt.Sprintf("%s.%d", f.path, i)
+	}
+	if err := os.Remove(rotated(f.options.maxFile - 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := f.options.maxFile - 2; i >= 0; i-- {
+		if err := os.Rename(rotated(i), rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeExpiredDeadLetters removes files which were not modified for maxAge,
+// except current files of running containers. It is called with
+// deadLetterFiles locked.
+func removeExpiredDeadLetters(options deadLetterOptions) {
+	if options.maxAge <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(options.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("dir", options.dir).Error("Failed to read dead-letter directory")
+		}
+		return
+	}
+	expired := time.Now().Add(-options.maxAge)
+	for _, file := range files {
+		path := filepath.Join(options.dir, file.Name())
+		if !file.Mode().IsRegular() || !file.ModTime().Before(expired) {
+			continue
+		}
+		if _, ok := deadLetterFiles.files[path]; ok {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logrus.WithError(err).WithField("file", path).Error("Failed to remove expired dead-letter file")
+		}
+	}
+}
+
+// dropReason returns reason and HTTP status of the error messages are dropped
+// with, status is 0 if the error is not a response
+func dropReason(err error) (string, int) {
+	if err == nil {
+		return "", 0
+	}
+	if sendErr, ok := err.(*sendError); ok {
+		return fmt.Sprintf("%s - %s", sendErr.status, bytes.TrimSpace(sendErr.body)), sendErr.statusCode
+	}
+	return err.Error(), 0
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// TestMain keeps dead letters of all tests in a temporary directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "dead-letter")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(envVarDeadLetterDir, dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// deadLetterRecorder keeps messages outputs reject
+type deadLetterRecorder struct {
+	mu       sync.Mutex
+	messages []*splunkMessage
+	statuses []int
+}
+
+func (r *deadLetterRecorder) deadLetter(messages []*splunkMessage, reason string, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for range messages {
+		r.statuses = append(r.statuses, status)
+	}
+	r.messages = append(r.messages, messages...)
+}
+
+func readDeadLetters(t *testing.T, path string) []map[string]interface{} {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Unexpected line %s - %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// Verify that messages dropped on close are written to the dead-letter file
+// of the container with reason and status
+func TestDeadLetterDroppedMessages(t *testing.T) {
+	hec := NewHTTPEventCollectorMock(t)
+	hec.simulateServerError = true
+	go hec.Serve()
+	defer hec.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID:   "deadlettercontainer",
+		ContainerName: "/container_name",
+	}
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := loggerDriver.(*splunkLoggerInline)
+	for _, line := range []string{"first", "second"} {
+		if err := l.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := l.stats.snapshot(); stats.dropped != 2 {
+		t.Fatalf("Unexpected stats %v", l.stats.fields())
+	}
+
+	records := readDeadLetters(t, filepath.Join(os.Getenv(envVarDeadLetterDir), "deadlettercontainer.ndjson"))
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %v", records)
+	}
+	for i, line := range []string{"first", "second"} {
+		record := records[i]
+		if record["status"] != float64(500) || record["reason"] != "500 Internal Server Error - " ||
+			record["container_id"] != "deadlettercontainer" || record["output"] != outputHEC || record["url"] != l.url {
+			t.Fatalf("Unexpected dead letter %v", record)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+			t.Fatalf("Unexpected time %v", record["time"])
+		}
+		message := record["message"].(map[string]interface{})
+		if event := message["event"].(map[string]interface{}); event["line"] != line {
+			t.Fatalf("Unexpected message %v", message)
+		}
+	}
+
+	deadLetterFiles.Lock()
+	open := len(deadLetterFiles.files)
+	deadLetterFiles.Unlock()
+	if open != 0 {
+		t.Fatalf("Expected dead-letter files to be released, %d are open", open)
+	}
+}
+
+// Verify that files are rotated by size and only maxFile files are kept
+func TestDeadLetterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "containeriid.ndjson")
+	f := &deadLetterFile{path: path, options: deadLetterOptions{dir: dir, maxSize: 300, maxFile: 3}, refs: 1}
+	for i := 0; i < 10; i++ {
+		messages := []*splunkMessage{{Event: "line"}, {Event: "line"}}
+		if err := f.write(messages, deadLetterRecord{Reason: "failed", ContainerID: "containeriid"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.release()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode().Perm() != 0600 {
+			t.Fatalf("Unexpected mode %v of %s", stat.Mode(), name)
+		}
+		// Batches are not split between files
+		if records := readDeadLetters(t, name); len(records)%2 != 0 {
+			t.Fatalf("Unexpected records in %s %v", name, records)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s.3 to be removed, %v", path, err)
+	}
+}
+
+// Verify that expired files are removed, except files of running containers
+func TestDeadLetterRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	previousDir := os.Getenv(envVarDeadLetterDir)
+	if err := os.Setenv(envVarDeadLetterDir, dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv(envVarDeadLetterDir, previousDir)
+	if err := os.Setenv(envVarDeadLetterMaxAge, "1h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarDeadLetterMaxAge)
+
+	expired := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"running.ndjson", "stopped.ndjson", "stopped.ndjson.1", "recent.ndjson"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if name != "recent.ndjson" {
+			if err := os.Chtimes(path, expired, expired); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	running := acquireDeadLetterFile("running")
+	defer running.release()
+	started := acquireDeadLetterFile("started")
+	defer started.release()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if len(names) != 2 || names[0] != "recent.ndjson" || names[1] != "running.ndjson" {
+		t.Fatalf("Unexpected files %v", names)
+	}
+}
+
+func TestParseDeadLetterOptions(t *testing.T) {
+	previousDir := os.Getenv(envVarDeadLetterDir)
+	if err := os.Setenv(envVarDeadLetterDir, deadLetterNone); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv(envVarDeadLetterDir, previousDir)
+	if f := acquireDeadLetterFile("containeriid"); f != nil {
+		t.Fatalf("Expected dead-letter files to be disabled, got %v", f)
+	}
+
+	if err := os.Setenv(envVarDeadLetterMaxSize, "1m"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarDeadLetterMaxSize)
+	if err := os.Setenv(envVarDeadLetterMaxFile, "0"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarDeadLetterMaxFile)
+	if options := parseDeadLetterOptions(); options.maxSize != 1<<20 || options.maxFile != defaultDeadLetterMaxFile ||
+		options.maxAge != defaultDeadLetterMaxAge {
+		t.Fatalf("Unexpected options %v", options)
+	}
+	if err := os.Setenv(envVarDeadLetterMaxSize, "large"); err != nil {
+		t.Fatal(err)
+	}
+	if options := parseDeadLetterOptions(); options.maxSize != defaultDeadLetterMaxSize {
+		t.Fatalf("Unexpected options %v", options)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	splunkDestinationsFileKey = "splunk-destinations-file"
+)
+
+const (
+	// Name of the destination configured with options without index
+	defaultDestinationName = "splunk"
+	// Maximum number of destinations of one container
+	maxDestinations = 16
+)
+
+// containerOptionKeys are options of the container, not of a destination, so
+// they cannot be set per destination and destinations do not inherit them
+var containerOptionKeys = map[string]bool{
+	splunkLocalStoreKey:         true,
+	localMaxSizeKey:             true,
+	localMaxFileKey:             true,
+	localCompressKey:            true,
+	splunkSearchURLKey:          true,
+	splunkSearchTokenKey:        true,
+	splunkDestinationsFileKey:   true,
+	archiveS3BucketKey:          true,
+	archiveS3EndpointKey:        true,
+	archiveS3RegionKey:          true,
+	archiveS3PrefixKey:          true,
+	archiveS3PathStyleKey:       true,
+	archiveS3AccessKeyIDKey:     true,
+	archiveS3SecretAccessKeyKey: true,
+	archiveMaxSizeKey:           true,
+	archiveMaxAgeKey:            true,
+}
+
+// notInheritedKeys are options of the first destination which other
+// destinations do not inherit. Shadow traffic of the container is sent once,
+// not once for every destination, other destinations can still set it with
+// index or in splunk-destinations-file.
+var notInheritedKeys = map[string]bool{
+	splunkShadowURLKey:    true,
+	splunkShadowTokenKey:  true,
+	splunkShadowSampleKey: true,
+}
+
+// destination is one logger of the container. Every destination has its own
+// format, filter, buffer and sink, so failure of one destination does not
+// affect others.
+type destination struct {
+	name   string
+	logger logger.Logger
+	// Entries which do not match the filter are not sent, nil sends all
+	filter *messageFilter
+}
+
+// destinationConfig is the name and options of one destination
+type destinationConfig struct {
+	name   string
+	config map[string]string
+}
+
+// splitIndexedKey returns option and index of indexed options like
+// splunk-token.2
+func splitIndexedKey(key string) (string, int, bool) {
+	dot := strings.LastIndex(key, ".")
+	if dot <= 0 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(key[dot+1:])
+	if err != nil || index < 1 || strconv.Itoa(index) != key[dot+1:] {
+		return "", 0, false
+	}
+	return key[:dot], index, true
+}
+
+// destinationConfigs returns options of all destinations of the container.
+// The first destination is configured with options without index, it is
+// followed by destinations of indexed options in order of their indexes, and
+// by destinations of splunk-destinations-file. Other destinations inherit
+// options without index, except options of the container and shadow options.
+func destinationConfigs(cfg map[string]string) ([]destinationConfig, error) {
+	base := make(map[string]string, len(cfg))
+	inherited := make(map[string]string, len(cfg))
+	indexed := make(map[int]map[string]string)
+	for key, value := range cfg {
+		option, index, ok := splitIndexedKey(key)
+		if !ok {
+			base[key] = value
+			if !containerOptionKeys[key] && !notInheritedKeys[key] {
+				inherited[key] = value
+			}
+			continue
+		}
+		if containerOptionKeys[option] {
+			return nil, fmt.Errorf("%s: %s is an option of the container and cannot be set per destination", driverName, option)
+		}
+		if indexed[index] == nil {
+			indexed[index] = make(map[string]string)
+		}
+		indexed[index][option] = value
+	}
+
+	destinations := []destinationConfig{{defaultDestinationName, base}}
+	indexes := make([]int, 0, len(indexed))
+	for index := range indexed {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		destinations = append(destinations, destinationConfig{
+			name:   fmt.Sprintf("%s.%d", defaultDestinationName, index),
+			config: mergeOptions(inherited, indexed[index]),
+		})
+	}
+
+	if path, ok := cfg[splunkDestinationsFileKey]; ok {
+		entries, err := readDestinationsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			for key := range entry {
+				if containerOptionKeys[key] {
+					return nil, fmt.Errorf("%s: %s is an option of the container and cannot be set in %s", driverName, key, path)
+				}
+			}
+			destinations = append(destinations, destinationConfig{
+				name:   fmt.Sprintf("%s[%d]", path, i),
+				config: mergeOptions(inherited, entry),
+			})
+		}
+	}
+
+	if len(destinations) > maxDestinations {
+		return nil, fmt.Errorf("%s: container has %d destinations, at most %d are supported", driverName, len(destinations), maxDestinations)
+	}
+	return destinations, nil
+}
+
+// readDestinationsFile reads JSON array of destinations, every destination is
+// an object with log options as strings
+func readDestinationsFile(path string) ([]map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read %s - %v", driverName, splunkDestinationsFileKey, err)
+	}
+	var entries []map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: failed to parse %s, expected array of objects with string values - %v", driverName, path, err)
+	}
+	return entries, nil
+}
+
+// mergeOptions returns copy of base options with options overridden
+func mergeOptions(base, options map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(options))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range options {
+		merged[key] = value
+	}
+	return merged
+}
+
+// newDestinations creates loggers of all destinations of the container
+func newDestinations(info logger.Info, registry *senderRegistry) ([]*destination, error) {
+	configs, err := destinationConfigs(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	destinations := make([]*destination, 0, len(configs))
+	for _, config := range configs {
+		filter, err := parseMessageFilter(config.config)
+		if err != nil {
+			closeDestinations(destinations)
+			return nil, err
+		}
+		destinationInfo := info
+		destinationInfo.Config = config.config
+		l, err := newSplunkLogger(destinationInfo, registry)
+		if err != nil {
+			closeDestinations(destinations)
+			return nil, errors.Wrapf(err, "error creating %s logger", config.name)
+		}
+		destinations = append(destinations, &destination{
+			name:   config.name,
+			logger: l,
+			filter: filter,
+		})
+	}
+	return destinations, nil
+}
+
+// closeDestinations closes loggers of destinations which were created before
+// the container failed to start
+func closeDestinations(destinations []*destination) {
+	for _, d := range destinations {
+		if err := d.logger.Close(); err != nil {
+			logrus.WithError(err).Errorf("error closing %s logger", d.name)
+		}
+	}
+}
+
+// closeSinks closes sinks concurrently, so a slow destination does not delay
+// flushing of others
+func closeSinks(sinks []*sink) {
+	var wg sync.WaitGroup
+	for _, s := range sinks {
+		wg.Add(1)
+		go func(s *sink) {
+			defer wg.Done()
+			s.close()
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+func TestDestinationConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destinations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "destinations.json")
+	if err := ioutil.WriteFile(file, []byte(`[{"splunk-url": "https://backup:8088", "splunk-format": "raw"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	destinations, err := destinationConfigs(map[string]string{
+		splunkURLKey:               "https://primary:8088",
+		splunkTokenKey:             "primary",
+		tagKey:                     "{{.Name}}",
+		splunkLocalStoreKey:        "none",
+		splunkDestinationsFileKey:  file,
+		splunkShadowURLKey:         "https://shadow:8088",
+		splunkShadowSampleKey:      "0.1",
+		splunkTokenKey + ".10":     "second",
+		splunkShadowURLKey + ".10": "https://shadow2:8088",
+		splunkTokenKey + ".2":      "first",
+		splunkFormatKey + ".2":     "json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shadow options are not inherited, so sampled traffic is not duplicated
+	expected := []destinationConfig{
+		{"splunk", map[string]string{
+			splunkURLKey:              "https://primary:8088",
+			splunkTokenKey:            "primary",
+			tagKey:                    "{{.Name}}",
+			splunkLocalStoreKey:       "none",
+			splunkDestinationsFileKey: file,
+			splunkShadowURLKey:        "https://shadow:8088",
+			splunkShadowSampleKey:     "0.1",
+		}},
+		{"splunk.2", map[string]string{
+			splunkURLKey:    "https://primary:8088",
+			splunkTokenKey:  "first",
+			tagKey:          "{{.Name}}",
+			splunkFormatKey: "json",
+		}},
+		{"splunk.10", map[string]string{
+			splunkURLKey:       "https://primary:8088",
+			splunkTokenKey:     "second",
+			tagKey:             "{{.Name}}",
+			splunkShadowURLKey: "https://shadow2:8088",
+		}},
+		{file + "[0]", map[string]string{
+			splunkURLKey:    "https://backup:8088",
+			splunkTokenKey:  "primary",
+			tagKey:          "{{.Name}}",
+			splunkFormatKey: "raw",
+		}},
+	}
+	if !reflect.DeepEqual(destinations, expected) {
+		t.Fatalf("Unexpected destinations %v", destinations)
+	}
+
+	for _, cfg := range []map[string]string{
+		{splunkLocalStoreKey + ".1": "none"},
+		{splunkDestinationsFileKey: filepath.Join(dir, "missing.json")},
+	} {
+		if _, err := destinationConfigs(cfg); err == nil {
+			t.Fatalf("Expecting error for %v", cfg)
+		}
+	}
+
+	// Keys with dots which are not indexes belong to the first destination
+	for _, key := range []string{"a.b", "a.0", "a.01", ".1"} {
+		if _, _, ok := splitIndexedKey(key); ok {
+			t.Fatalf("Unexpected index of %s", key)
+		}
+	}
+}
+
+func TestValidateLogOptDestinations(t *testing.T) {
+	err := ValidateLogOpt(map[string]string{
+		splunkURLKey:                 "https://primary:8088",
+		splunkURLKey + ".1":          "https://secondary:8088",
+		splunkFilterStreamKey + ".1": "stderr",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ValidateLogOpt(map[string]string{
+		splunkURLKey:                  "https://primary:8088",
+		splunkFilterIncludeKey + ".3": "(",
+	})
+	if err == nil || !strings.Contains(err.Error(), "destination splunk.3") {
+		t.Fatalf("Expecting error of the destination, got %v", err)
+	}
+
+	err = ValidateLogOpt(map[string]string{
+		splunkURLKey:      "https://primary:8088",
+		"not-supported.1": "a",
+	})
+	if err == nil {
+		t.Fatal("Expecting error on unsupported indexed option")
+	}
+}
+
+func TestMessageFilter(t *testing.T) {
+	filter, err := parseMessageFilter(map[string]string{
+		splunkFilterStreamKey:  "stdout",
+		splunkFilterIncludeKey: "^GET ",
+		splunkFilterExcludeKey: "/health",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		entry logdriver.LogEntry
+		match bool
+	}{
+		{logdriver.LogEntry{Source: "stdout", Line: []byte("GET /index.html")}, true},
+		{logdriver.LogEntry{Source: "stderr", Line: []byte("GET /index.html")}, false},
+		{logdriver.LogEntry{Source: "stdout", Line: []byte("POST /index.html")}, false},
+		{logdriver.LogEntry{Source: "stdout", Line: []byte("GET /health")}, false},
+	} {
+		if match := filter.match(&test.entry); match != test.match {
+			t.Fatalf("Unexpected match %t of %s %s", match, test.entry.Source, test.entry.Line)
+		}
+	}
+
+	if filter, err := parseMessageFilter(map[string]string{}); err != nil || filter != nil {
+		t.Fatalf("Unexpected filter %v, %v", filter, err)
+	}
+	if _, err := parseMessageFilter(map[string]string{splunkFilterStreamKey: "stdin"}); err == nil {
+		t.Fatal("Expecting error for unknown stream")
+	}
+}
+
+// Verify that every destination gets entries matching its filter, and that
+// failing destination does not affect others
+func TestPipelineDestinations(t *testing.T) {
+	all := &recordingLogger{}
+	failing := &recordingLogger{fail: true}
+	errors := &recordingLogger{}
+	filter, err := parseMessageFilter(map[string]string{splunkFilterStreamKey: "stderr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	destinations := []*destination{
+		{name: "all", logger: all},
+		{name: "failing", logger: failing},
+		{name: "errors", logger: errors, filter: filter},
+	}
+	r, w := io.Pipe()
+	lf := newLogPair(nil, destinations, nil, r, logger.Info{ContainerID: "containeriid"})
+	go consumeLog(lf)
+
+	enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
+	for _, source := range []string{"stdout", "stderr", "stdout", "stderr", "stderr"} {
+		entry := logdriver.LogEntry{Line: []byte(source), Source: source, TimeNano: time.Now().UnixNano()}
+		if err := enc.WriteMsg(&entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	<-lf.done
+
+	if len(all.lines) != 5 || !reflect.DeepEqual(errors.lines, []string{"stderr", "stderr", "stderr"}) {
+		t.Fatalf("Unexpected lines %v %v", all.lines, errors.lines)
+	}
+	if lf.remotes[1].stats.failed != 5 || lf.remotes[2].stats.filtered != 2 || lf.remotes[2].stats.logged != 3 {
+		t.Fatalf("Unexpected stats %v %v", lf.remotes[1].stats.fields(), lf.remotes[2].stats.fields())
+	}
+	if !all.closed || !failing.closed || !errors.closed {
+		t.Fatal("Loggers should be closed")
+	}
+}
+
+// Verify that destinations send to their HEC with their own token and format
+func TestNewDestinations(t *testing.T) {
+	primary := NewHTTPEventCollectorMock(t)
+	go primary.Serve()
+	defer primary.Close()
+	secondary := NewHTTPEventCollectorMock(t)
+	secondary.token = "secondary"
+	go secondary.Serve()
+	defer secondary.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:                  primary.URL(),
+			splunkTokenKey:                primary.token,
+			splunkFormatKey:               splunkFormatRaw,
+			splunkURLKey + ".1":           secondary.URL(),
+			splunkTokenKey + ".1":         secondary.token,
+			splunkFormatKey + ".1":        splunkFormatJSON,
+			splunkFilterExcludeKey + ".1": "debug",
+		},
+		ContainerID:   "containeriid",
+		ContainerName: "/container_name",
+	}
+	destinations, err := newDestinations(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(destinations) != 2 || destinations[0].filter != nil || destinations[1].filter == nil {
+		t.Fatalf("Unexpected destinations %v", destinations)
+	}
+	for _, d := range destinations {
+		for _, line := range []string{"info", "debug"} {
+			entry := logdriver.LogEntry{Line: []byte(line), Source: "stdout"}
+			if d.filter != nil && !d.filter.match(&entry) {
+				continue
+			}
+			if err := d.logger.Log(newMessage(&entry)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	closeDestinations(destinations)
+
+	if len(primary.messages) != 2 || len(secondary.messages) != 1 {
+		t.Fatalf("Unexpected messages %d %d", len(primary.messages), len(secondary.messages))
+	}
+	if event, err := primary.messages[0].EventAsString(); err != nil || !strings.HasSuffix(event, "info") {
+		t.Fatalf("Unexpected raw event %s, %v", event, err)
+	}
+	if event, err := secondary.messages[0].EventAsMap(); err != nil || event["line"] != "info" {
+		t.Fatalf("Unexpected json event %v, %v", event, err)
+	}
+}
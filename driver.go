@@ -4,7 +4,6 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -15,9 +14,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,7 +26,6 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types/plugins/logdriver"
 	"github.com/docker/docker/daemon/logger"
-	"github.com/docker/docker/daemon/logger/jsonfilelog"
 	"github.com/docker/docker/daemon/logger/loggerutils"
 	"github.com/docker/docker/pkg/urlutil"
 	protoio "github.com/gogo/protobuf/io"
@@ -43,6 +41,7 @@ const (
 	splunkSourceKey               = "splunk-source"
 	splunkSourceTypeKey           = "splunk-sourcetype"
 	splunkIndexKey                = "splunk-index"
+	splunkHostKey                 = "splunk-host"
 	splunkCAPathKey               = "splunk-capath"
 	splunkCANameKey               = "splunk-caname"
 	splunkInsecureSkipVerifyKey   = "splunk-insecureskipverify"
@@ -50,6 +49,9 @@ const (
 	splunkVerifyConnectionKey     = "splunk-verify-connection"
 	splunkGzipCompressionKey      = "splunk-gzip"
 	splunkGzipCompressionLevelKey = "splunk-gzip-level"
+	splunkFormatTemplateKey       = "splunk-format-template"
+	splunkMetadataKey             = "splunk-metadata"
+	splunkOrchestratorKey         = "splunk-orchestrator"
 	envKey                        = "env"
 	envRegexKey                   = "env-regex"
 	labelsKey                     = "labels"
@@ -65,6 +67,8 @@ const (
 	defaultBufferMaximum = 10 * defaultPostMessagesBatchSize
 	// Number of messages allowed to be queued in the channel
 	defaultStreamChannelSize = 4 * defaultPostMessagesBatchSize
+	// Number of batches we send at the same time, one preserves strict ordering
+	defaultConcurrentRequests = 1
 )
 
 const (
@@ -72,29 +76,33 @@ const (
 	envVarPostMessagesBatchSize = "SPLUNK_LOGGING_DRIVER_POST_MESSAGES_BATCH_SIZE"
 	envVarBufferMaximum         = "SPLUNK_LOGGING_DRIVER_BUFFER_MAX"
 	envVarStreamChannelSize     = "SPLUNK_LOGGING_DRIVER_CHANNEL_SIZE"
+	envVarConcurrentRequests    = "SPLUNK_LOGGING_DRIVER_CONCURRENT_REQUESTS"
+	envVarStrictOrdering        = "SPLUNK_LOGGING_DRIVER_STRICT_ORDERING"
 )
 
 type splunkLoggerInterface interface {
 	logger.Logger
 	worker()
+	abort()
+	deliveryStats() *deliveryStats
+	// shadowSender returns nil if the logger does not mirror messages
+	shadowSender() *shadowSender
+	// formatMessage returns message as Log would queue it
+	formatMessage(msg *logger.Message) (*splunkMessage, error)
+	dropOverflow(messages []*splunkMessage)
 }
 
 type splunkLogger struct {
-	client    *http.Client
-	transport *http.Transport
+	*hecTarget
 
-	url         string
-	auth        string
 	nullMessage *splunkMessage
-
-	// http compression
-	gzipCompression      bool
-	gzipCompressionLevel int
+	encoder     *messageEncoder
 
 	// Advanced options
 	postMessagesFrequency time.Duration
 	postMessagesBatchSize int
 	bufferMaximum         int
+	concurrentRequests    int
 
 	// For synchronization between background worker and logger.
 	// We use channel to send messages to worker go routine.
@@ -103,6 +111,26 @@ type splunkLogger struct {
 	lock       sync.RWMutex
 	closed     bool
 	closedCond *sync.Cond
+
+	// With shared sender messages are queued to the shard instead of stream,
+	// and there is no worker for the logger
+	sender *hecSender
+	shard  *senderShard
+
+	// Set when splunk-output is not hec, batches are delivered by the output
+	// instead of HEC target
+	output messageOutput
+
+	// Mirrors a sample of messages to the shadow HEC, nil if it is not set
+	shadow *shadowSender
+
+	// Messages which are dropped are written to the dead-letter file of the
+	// container, nil if dead-letter files are disabled
+	deadLetters *deadLetterFile
+	containerID string
+	outputName  string
+
+	stats deliveryStats
 }
 
 type splunkLoggerInline struct {
@@ -127,6 +155,12 @@ type splunkLoggerRaw struct {
 	prefix []byte
 }
 
+type splunkLoggerTemplate struct {
+	*splunkLogger
+
+	eventTemplate *eventTemplate
+}
+
 type splunkMessage struct {
 	Event      interface{} `json:"event"`
 	Time       string      `json:"time"`
@@ -135,6 +169,10 @@ type splunkMessage struct {
 	SourceType string      `json:"sourcetype,omitempty"`
 	Index      string      `json:"index,omitempty"`
 	Entity     string      `json:"entity,omitempty"`
+
+	// Used by outputs other than HEC
+	timestamp time.Time
+	stream    string
 }
 
 type splunkMessageEvent struct {
@@ -142,95 +180,76 @@ type splunkMessageEvent struct {
 	Source string            `json:"source"`
 	Tag    string            `json:"tag,omitempty"`
 	Attrs  map[string]string `json:"attrs,omitempty"`
+
+	// Pre-encoded tag and attrs, see encodeEventSuffix
+	suffix []byte
 }
 
 const (
-	splunkFormatRaw    = "raw"
-	splunkFormatJSON   = "json"
-	splunkFormatInline = "inline"
-	splunkFormatNova   = "nova"
+	splunkFormatRaw      = "raw"
+	splunkFormatJSON     = "json"
+	splunkFormatInline   = "inline"
+	splunkFormatNova     = "nova"
+	splunkFormatTemplate = "template"
 )
 
 // New creates splunk logger driver using configuration passed in context
 func New(info logger.Info) (logger.Logger, error) {
-	hostname, err := info.Hostname()
-	if err != nil {
-		return nil, fmt.Errorf("%s: cannot access hostname to set source field", driverName)
-	}
+	return newSplunkLogger(info, nil)
+}
 
-	// Parse and validate Splunk URL
-	splunkURL, err := parseURL(info)
+// newSplunkLogger creates splunk logger driver. If shared sender is enabled,
+// loggers with the same HEC target share sender from registry.
+func newSplunkLogger(info logger.Info, registry *senderRegistry) (logger.Logger, error) {
+	outputName, err := parseOutput(info.Config)
 	if err != nil {
 		return nil, err
 	}
 
-	// Splunk Token is required parameter
-	splunkToken, ok := info.Config[splunkTokenKey]
-	if !ok {
-		return nil, fmt.Errorf("%s: %s is expected", driverName, splunkTokenKey)
-	}
-
-	tlsConfig := &tls.Config{}
-
-	// Splunk is using autogenerated certificates by default,
-	// allow users to trust them with skipping verification
-	if insecureSkipVerifyStr, ok := info.Config[splunkInsecureSkipVerifyKey]; ok {
-		insecureSkipVerify, err := strconv.ParseBool(insecureSkipVerifyStr)
+	var target *hecTarget
+	if outputName == outputHEC {
+		target, err = newHECTarget(info)
 		if err != nil {
 			return nil, err
 		}
-		tlsConfig.InsecureSkipVerify = insecureSkipVerify
+	} else {
+		// Other outputs do not use HTTP client, only the context to abort sending
+		ctx, cancel := context.WithCancel(context.Background())
+		target = &hecTarget{ctx: ctx, cancel: cancel}
 	}
 
-	// If path to the root certificate is provided - load it
-	if caPath, ok := info.Config[splunkCAPathKey]; ok {
-		caCert, err := ioutil.ReadFile(caPath)
-		if err != nil {
-			return nil, err
-		}
-		caPool := x509.NewCertPool()
-		caPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caPool
+	orchestrator, err := detectOrchestrator(info)
+	if err != nil {
+		return nil, err
 	}
 
-	if caName, ok := info.Config[splunkCANameKey]; ok {
-		tlsConfig.ServerName = caName
-	}
+	// Index, source, sourcetype and host can be templates like tag
+	data := &templateData{&info, orchestrator}
 
-	gzipCompression := false
-	if gzipCompressionStr, ok := info.Config[splunkGzipCompressionKey]; ok {
-		gzipCompression, err = strconv.ParseBool(gzipCompressionStr)
-		if err != nil {
-			return nil, err
-		}
+	source, err := renderOptionTemplate(info, splunkSourceKey, data)
+	if err != nil {
+		return nil, err
 	}
-
-	gzipCompressionLevel := gzip.DefaultCompression
-	if gzipCompressionLevelStr, ok := info.Config[splunkGzipCompressionLevelKey]; ok {
-		var err error
-		gzipCompressionLevel64, err := strconv.ParseInt(gzipCompressionLevelStr, 10, 32)
-		if err != nil {
-			return nil, err
-		}
-		gzipCompressionLevel = int(gzipCompressionLevel64)
-		if gzipCompressionLevel < gzip.DefaultCompression || gzipCompressionLevel > gzip.BestCompression {
-			err := fmt.Errorf("Not supported level '%s' for %s (supported values between %d and %d).",
-				gzipCompressionLevelStr, splunkGzipCompressionLevelKey, gzip.DefaultCompression, gzip.BestCompression)
-			return nil, err
-		}
+	sourceType, err := renderOptionTemplate(info, splunkSourceTypeKey, data)
+	if err != nil {
+		return nil, err
+	}
+	index, err := renderOptionTemplate(info, splunkIndexKey, data)
+	if err != nil {
+		return nil, err
 	}
 
-	transport := &http.Transport{
-		TLSClientConfig: tlsConfig,
+	hostname, err := renderOptionTemplate(info, splunkHostKey, data)
+	if err != nil {
+		return nil, err
 	}
-	client := &http.Client{
-		Transport: transport,
+	if hostname == "" {
+		hostname, err = info.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("%s: cannot access hostname to set source field", driverName)
+		}
 	}
 
-	source := info.Config[splunkSourceKey]
-	sourceType := info.Config[splunkSourceTypeKey]
-	index := info.Config[splunkIndexKey]
-
 	var nullMessage = &splunkMessage{
 		Host:       hostname,
 		Source:     source,
@@ -252,25 +271,45 @@ func New(info logger.Info) (logger.Logger, error) {
 		return nil, err
 	}
 
-	var (
-		postMessagesFrequency = getAdvancedOptionDuration(envVarPostMessagesFrequency, defaultPostMessagesFrequency)
-		postMessagesBatchSize = getAdvancedOptionInt(envVarPostMessagesBatchSize, defaultPostMessagesBatchSize)
-		bufferMaximum         = getAdvancedOptionInt(envVarBufferMaximum, defaultBufferMaximum)
-		streamChannelSize     = getAdvancedOptionInt(envVarStreamChannelSize, defaultStreamChannelSize)
-	)
+	metadata, err := containerMetadata(info)
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range []map[string]string{metadata, orchestrator.fields()} {
+		for key, value := range fields {
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			attrs[key] = value
+		}
+	}
+
+	batching, err := parseBatchingOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrentRequests := getAdvancedOptionInt(envVarConcurrentRequests, defaultConcurrentRequests)
+
+	if concurrentRequests < 1 {
+		logrus.Error(fmt.Sprintf("Value of %s should be at least 1. Using default %d.", envVarConcurrentRequests, defaultConcurrentRequests))
+		concurrentRequests = defaultConcurrentRequests
+	}
+	if batching.strictOrdering {
+		// Single lane, next batch is sent only after the previous one
+		concurrentRequests = 1
+	}
 
 	logger := &splunkLogger{
-		client:                client,
-		transport:             transport,
-		url:                   splunkURL.String(),
-		auth:                  "Splunk " + splunkToken,
+		hecTarget:             target,
 		nullMessage:           nullMessage,
-		gzipCompression:       gzipCompression,
-		gzipCompressionLevel:  gzipCompressionLevel,
-		stream:                make(chan *splunkMessage, streamChannelSize),
-		postMessagesFrequency: postMessagesFrequency,
-		postMessagesBatchSize: postMessagesBatchSize,
-		bufferMaximum:         bufferMaximum,
+		stream:                make(chan *splunkMessage, batching.streamChannelSize),
+		postMessagesFrequency: batching.postMessagesFrequency,
+		postMessagesBatchSize: batching.postMessagesBatchSize,
+		bufferMaximum:         batching.bufferMaximum,
+		concurrentRequests:    concurrentRequests,
+		containerID:           info.ContainerID,
+		outputName:            outputName,
 	}
 
 	// By default we verify connection, but we allow use to skip that
@@ -282,7 +321,19 @@ func New(info logger.Info) (logger.Logger, error) {
 			return nil, err
 		}
 	}
-	if verifyConnection {
+	if outputName != outputHEC {
+		logger.output, err = newMessageOutput(target.ctx, outputName, info, outputMetadata{
+			host:       hostname,
+			source:     source,
+			sourceType: sourceType,
+			index:      index,
+			tag:        tag,
+			attrs:      attrs,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if verifyConnection {
 		err = verifySplunkConnection(logger)
 		if err != nil {
 			return nil, err
@@ -296,8 +347,9 @@ func New(info logger.Info) (logger.Logger, error) {
 		case splunkFormatJSON:
 		case splunkFormatRaw:
 		case splunkFormatNova:
+		case splunkFormatTemplate:
 		default:
-			return nil, fmt.Errorf("Unknown format specified %s, supported formats are inline, json, raw, and nova", splunkFormat)
+			return nil, fmt.Errorf("Unknown format specified %s, supported formats are inline, json, raw, nova, and template", splunkFormatParsed)
 		}
 		splunkFormat = splunkFormatParsed
 	} else {
@@ -309,15 +361,17 @@ func New(info logger.Info) (logger.Logger, error) {
 	switch splunkFormat {
 	case splunkFormatInline:
 		nullEvent := &splunkMessageEvent{
-			Tag:   tag,
-			Attrs: attrs,
+			Tag:    tag,
+			Attrs:  attrs,
+			suffix: encodeEventSuffix(tag, attrs),
 		}
 
 		loggerWrapper = &splunkLoggerInline{logger, nullEvent}
 	case splunkFormatJSON:
 		nullEvent := &splunkMessageEvent{
-			Tag:   tag,
-			Attrs: attrs,
+			Tag:    tag,
+			Attrs:  attrs,
+			suffix: encodeEventSuffix(tag, attrs),
 		}
 
 		loggerWrapper = &splunkLoggerJSON{&splunkLoggerInline{logger, nullEvent}}
@@ -348,17 +402,49 @@ func New(info logger.Info) (logger.Logger, error) {
 			prefix.WriteString(" ")
 		}
 
+		nullMessage.Entity = nullMessage.Host
+
 		loggerWrapper = &splunkLoggerNova{logger, prefix.Bytes()}
+	case splunkFormatTemplate:
+		eventTemplate, err := parseEventTemplate(info, tag, attrs)
+		if err != nil {
+			return nil, err
+		}
+
+		loggerWrapper = &splunkLoggerTemplate{logger, eventTemplate}
 	default:
 		return nil, fmt.Errorf("Unexpected format %s", splunkFormat)
 	}
 
+	logger.encoder = newMessageEncoder(nullMessage)
+
+	logger.shadow, err = newShadowSender(info, logger.encoder, batching)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.deadLetters = acquireDeadLetterFile(info.ContainerID)
+
+	if registry != nil && logger.output == nil && getAdvancedOptionBool(envVarSharedSender, false) {
+		logger.sender = registry.acquire(hecTargetKey(info, target.url, batching), target, batching)
+		logger.hecTarget = logger.sender.target
+		logger.shard = logger.sender.shard(info.ContainerID)
+		logger.stream = nil
+		return loggerWrapper, nil
+	}
+
 	go loggerWrapper.worker()
 
 	return loggerWrapper, nil
 }
 
 func (l *splunkLoggerInline) Log(msg *logger.Message) error {
+	message, _ := l.formatMessage(msg)
+	logger.PutMessage(msg)
+	return l.queueMessageAsync(message)
+}
+
+func (l *splunkLoggerInline) formatMessage(msg *logger.Message) (*splunkMessage, error) {
 	message := l.createSplunkMessage(msg)
 
 	event := *l.nullEvent
@@ -366,21 +452,29 @@ func (l *splunkLoggerInline) Log(msg *logger.Message) error {
 	event.Source = msg.Source
 
 	message.Event = &event
+	return message, nil
+}
+
+func (l *splunkLoggerNova) Log(msg *logger.Message) error {
+	message, _ := l.formatMessage(msg)
 	logger.PutMessage(msg)
 	return l.queueMessageAsync(message)
 }
 
-func (l *splunkLoggerNova) Log(msg *logger.Message) error {
+func (l *splunkLoggerNova) formatMessage(msg *logger.Message) (*splunkMessage, error) {
 	message := l.createSplunkMessage(msg)
-	message.Entity = message.Host
-	message.Source = message.Source
 
 	message.Event = string(append(l.prefix, msg.Line...))
+	return message, nil
+}
+
+func (l *splunkLoggerJSON) Log(msg *logger.Message) error {
+	message, _ := l.formatMessage(msg)
 	logger.PutMessage(msg)
 	return l.queueMessageAsync(message)
 }
 
-func (l *splunkLoggerJSON) Log(msg *logger.Message) error {
+func (l *splunkLoggerJSON) formatMessage(msg *logger.Message) (*splunkMessage, error) {
 	message := l.createSplunkMessage(msg)
 	event := *l.nullEvent
 
@@ -394,41 +488,75 @@ func (l *splunkLoggerJSON) Log(msg *logger.Message) error {
 	event.Source = msg.Source
 
 	message.Event = &event
+	return message, nil
+}
+
+func (l *splunkLoggerRaw) Log(msg *logger.Message) error {
+	message, _ := l.formatMessage(msg)
 	logger.PutMessage(msg)
 	return l.queueMessageAsync(message)
 }
 
-func (l *splunkLoggerRaw) Log(msg *logger.Message) error {
+func (l *splunkLoggerRaw) formatMessage(msg *logger.Message) (*splunkMessage, error) {
 	message := l.createSplunkMessage(msg)
 
 	message.Event = string(append(l.prefix, msg.Line...))
+	return message, nil
+}
+
+func (l *splunkLoggerTemplate) Log(msg *logger.Message) error {
+	message, err := l.formatMessage(msg)
 	logger.PutMessage(msg)
+	if err != nil {
+		return err
+	}
 	return l.queueMessageAsync(message)
 }
 
+func (l *splunkLoggerTemplate) formatMessage(msg *logger.Message) (*splunkMessage, error) {
+	message := l.createSplunkMessage(msg)
+
+	event, err := l.eventTemplate.render(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	message.Event = event
+	return message, nil
+}
+
 func (l *splunkLogger) queueMessageAsync(message *splunkMessage) error {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
 	if l.closedCond != nil {
 		return fmt.Errorf("%s: driver is closed", driverName)
 	}
+	l.stats.addReceived(1)
+	if l.shadow != nil {
+		l.shadow.offer(message)
+	}
+	if l.shard != nil {
+		l.shard.queue(l, message)
+		return nil
+	}
 	l.stream <- message
 	return nil
 }
 
 func (l *splunkLogger) worker() {
+	if l.concurrentRequests > 1 {
+		l.concurrentWorker()
+		return
+	}
 	timer := time.NewTicker(l.postMessagesFrequency)
+	defer timer.Stop()
 	var messages []*splunkMessage
 	for {
 		select {
 		case message, open := <-l.stream:
 			if !open {
 				l.postMessages(messages, true)
-				l.lock.Lock()
-				defer l.lock.Unlock()
-				l.transport.CloseIdleConnections()
-				l.closed = true
-				l.closedCond.Signal()
+				l.markClosed()
 				return
 			}
 			messages = append(messages, message)
@@ -444,6 +572,21 @@ func (l *splunkLogger) worker() {
 	}
 }
 
+// markClosed unblocks Close after worker sent everything it could
+func (l *splunkLogger) markClosed() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.output != nil {
+		if err := l.output.close(); err != nil {
+			logrus.Error(err)
+		}
+	} else {
+		l.transport.CloseIdleConnections()
+	}
+	l.closed = true
+	l.closedCond.Signal()
+}
+
 func (l *splunkLogger) postMessages(messages []*splunkMessage, lastChance bool) []*splunkMessage {
 	messagesLen := len(messages)
 	for i := 0; i < messagesLen; i += l.postMessagesBatchSize {
@@ -451,22 +594,20 @@ func (l *splunkLogger) postMessages(messages []*splunkMessage, lastChance bool)
 		if upperBound > messagesLen {
 			upperBound = messagesLen
 		}
-		if err := l.tryPostMessages(messages[i:upperBound]); err != nil {
+		sent, err := l.tryPostMessages(messages[i:upperBound])
+		if err != nil {
 			logrus.Error(err)
+			// Skip messages sent before error
+			i += sent
+			l.stats.addFailed(upperBound - i)
 			if messagesLen-i >= l.bufferMaximum || lastChance {
-				// If this is last chance - print them all to the daemon log
+				// If this is last chance - drop them all
 				if lastChance {
 					upperBound = messagesLen
 				}
-				// Not all sent, but buffer has got to its maximum, let's log all messages
+				// Not all sent, but buffer has got to its maximum, let's drop all messages
 				// we could not send and return buffer minus one batch size
-				for j := i; j < upperBound; j++ {
-					if jsonEvent, err := json.Marshal(messages[j]); err != nil {
-						logrus.Error(err)
-					} else {
-						logrus.Error(fmt.Errorf("Failed to send a message '%s'", string(jsonEvent)))
-					}
-				}
+				l.dropMessages(messages[i:upperBound], err)
 				return messages[upperBound:messagesLen]
 			}
 			// Not all sent, returning buffer from where we have not sent messages
@@ -477,66 +618,84 @@ func (l *splunkLogger) postMessages(messages []*splunkMessage, lastChance bool)
 	return messages[:0]
 }
 
-func (l *splunkLogger) tryPostMessages(messages []*splunkMessage) error {
-	if len(messages) == 0 {
-		return nil
-	}
-	var buffer bytes.Buffer
-	var writer io.Writer
-	var gzipWriter *gzip.Writer
-	var err error
-	// If gzip compression is enabled - create gzip writer with specified compression
-	// level. If gzip compression is disabled, use standard buffer as a writer
-	if l.gzipCompression {
-		gzipWriter, err = gzip.NewWriterLevel(&buffer, l.gzipCompressionLevel)
-		if err != nil {
-			return err
-		}
-		writer = gzipWriter
-	} else {
-		writer = &buffer
-	}
-	for _, message := range messages {
-		jsonEvent, err := json.Marshal(message)
-		if err != nil {
-			return err
-		}
-		if _, err := writer.Write(jsonEvent); err != nil {
-			return err
-		}
-	}
-	// If gzip compression is enabled, tell it, that we are done
-	if l.gzipCompression {
-		err = gzipWriter.Close()
-		if err != nil {
-			return err
-		}
+// dropMessages counts messages we could not send because of err and writes
+// them to the dead-letter file
+func (l *splunkLogger) dropMessages(messages []*splunkMessage, err error) {
+	l.stats.addDropped(len(messages))
+	reason, status := dropReason(err)
+	l.writeDeadLetters(messages, reason, status)
+}
+
+// dropOverflow counts messages which the sink of the logger dropped because
+// its queue was full and writes them to the dead-letter file. Logger has
+// never received them, so they are counted as received too.
+func (l *splunkLogger) dropOverflow(messages []*splunkMessage) {
+	l.stats.addReceived(len(messages))
+	l.dropMessages(messages, errSinkQueueFull)
+}
+
+// writeDeadLetters writes messages to the dead-letter file of the container.
+// Messages are never written to the daemon log, only their number and the
+// reason.
+func (l *splunkLogger) writeDeadLetters(messages []*splunkMessage, reason string, status int) {
+	entry := logrus.WithFields(logrus.Fields{
+		"id":       l.containerID,
+		"url":      l.url,
+		"messages": len(messages),
+		"reason":   reason,
+	})
+	if l.deadLetters == nil {
+		entry.Error("Dropped messages")
+		return
 	}
-	req, err := http.NewRequest("POST", l.url, bytes.NewBuffer(buffer.Bytes()))
+	err := l.deadLetters.write(messages, deadLetterRecord{
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Reason:      reason,
+		Status:      status,
+		Output:      l.outputName,
+		URL:         l.url,
+		ContainerID: l.containerID,
+	})
 	if err != nil {
-		return err
+		entry.WithError(err).Error("Failed to write dropped messages to dead-letter file")
+		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", l.auth)
-	// Tell if we are sending gzip compressed body
-	if l.gzipCompression {
-		req.Header.Set("Content-Encoding", "gzip")
+	entry.WithField("file", l.deadLetters.path).Error("Dropped messages written to dead-letter file")
+}
+
+// tryPostMessages returns number of messages sent, or dropped because they are
+// too large or rejected by the destination, before error
+func (l *splunkLogger) tryPostMessages(messages []*splunkMessage) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
 	}
-	res, err := l.client.Do(req)
-	if err != nil {
-		return err
+	if l.output != nil {
+		rejected := 0
+		sent, err := l.output.send(messages, func(messages []*splunkMessage, reason string, status int) {
+			// Messages are never accepted by the destination
+			rejected += len(messages)
+			l.stats.addDropped(len(messages))
+			l.writeDeadLetters(messages, reason, status)
+		})
+		l.stats.addSent(sent - rejected)
+		return sent, err
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		var body []byte
-		body, err = ioutil.ReadAll(res.Body)
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("%s: failed to send event - %s - %s", driverName, res.Status, body)
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	ends, err := encodeMessages(buffer, len(messages), func(buffer *bytes.Buffer, i int) error {
+		return l.encoder.encodeMessage(buffer, messages[i])
+	})
+	if err != nil {
+		return 0, err
 	}
-	io.Copy(ioutil.Discard, res.Body)
-	return nil
+	tooLarge := 0
+	sent, err := l.postEncoded(buffer.Bytes(), ends, func(i int, err error) {
+		// Message is too large to be ever accepted by HEC
+		tooLarge++
+		l.dropMessages(messages[i:i+1], err)
+	})
+	l.stats.addSent(sent - tooLarge)
+	return sent, err
 }
 
 func (l *splunkLogger) Close() error {
@@ -544,14 +703,47 @@ func (l *splunkLogger) Close() error {
 	defer l.lock.Unlock()
 	if l.closedCond == nil {
 		l.closedCond = sync.NewCond(&l.lock)
-		close(l.stream)
-		for !l.closed {
-			l.closedCond.Wait()
+		if l.shard != nil {
+			l.shard.flush(l)
+			l.sender.release()
+			l.closed = true
+		} else {
+			close(l.stream)
+			for !l.closed {
+				l.closedCond.Wait()
+			}
+		}
+		logrus.WithFields(l.stats.fields()).WithField("url", l.url).Debug("Splunk logger closed")
+		if l.shadow != nil {
+			l.shadow.close()
+		}
+		if l.deadLetters != nil {
+			l.deadLetters.release()
 		}
 	}
 	return nil
 }
 
+// abort cancels requests in flight, so Close does not wait for HEC and drops
+// messages it could not send. Target of the shared sender is used by other
+// loggers too, it is cancelled only by senderRegistry on shutdown.
+func (l *splunkLogger) abort() {
+	if l.sender == nil {
+		l.cancel()
+	}
+	if l.shadow != nil {
+		l.shadow.abort()
+	}
+}
+
+func (l *splunkLogger) deliveryStats() *deliveryStats {
+	return &l.stats
+}
+
+func (l *splunkLogger) shadowSender() *shadowSender {
+	return l.shadow
+}
+
 func (l *splunkLogger) Name() string {
 	return driverName
 }
@@ -559,11 +751,31 @@ func (l *splunkLogger) Name() string {
 func (l *splunkLogger) createSplunkMessage(msg *logger.Message) *splunkMessage {
 	message := *l.nullMessage
 	message.Time = fmt.Sprintf("%f", float64(msg.Timestamp.UnixNano())/float64(time.Second))
+	message.timestamp = msg.Timestamp
+	message.stream = msg.Source
 	return &message
 }
 
-// ValidateLogOpt looks for all supported by splunk driver options
+// ValidateLogOpt looks for all supported by splunk driver options, options of
+// every destination are validated separately
 func ValidateLogOpt(cfg map[string]string) error {
+	destinations, err := destinationConfigs(cfg)
+	if err != nil {
+		return err
+	}
+	for _, destination := range destinations {
+		if err := validateLogOpt(destination.config); err != nil {
+			if destination.name == defaultDestinationName {
+				return err
+			}
+			return errors.Wrapf(err, "destination %s", destination.name)
+		}
+	}
+	return nil
+}
+
+// validateLogOpt validates options of one destination
+func validateLogOpt(cfg map[string]string) error {
 	for key := range cfg {
 		switch key {
 		case splunkURLKey:
@@ -572,13 +784,67 @@ func ValidateLogOpt(cfg map[string]string) error {
 		case splunkSourceKey:
 		case splunkSourceTypeKey:
 		case splunkIndexKey:
+		case splunkHostKey:
 		case splunkCAPathKey:
 		case splunkCANameKey:
 		case splunkInsecureSkipVerifyKey:
 		case splunkFormatKey:
+		case splunkFormatTemplateKey:
 		case splunkVerifyConnectionKey:
 		case splunkGzipCompressionKey:
 		case splunkGzipCompressionLevelKey:
+		case splunkMetadataKey:
+		case splunkOrchestratorKey:
+		case splunkPostMessagesFrequencyKey:
+		case splunkPostMessagesBatchSizeKey:
+		case splunkBufferMaximumKey:
+		case splunkChannelSizeKey:
+		case splunkStrictOrderingKey:
+		case splunkLocalStoreKey:
+		case splunkSearchURLKey:
+		case splunkSearchTokenKey:
+		case splunkOutputKey:
+		case syslogAddressKey:
+		case syslogFacilityKey:
+		case syslogFormatKey:
+		case otlpEndpointKey:
+		case otlpProtocolKey:
+		case otlpHeadersKey:
+		case fluentdAddressKey:
+		case fluentdRequireAckKey:
+		case fluentdSharedKeyKey:
+		case fluentdUsernameKey:
+		case fluentdPasswordKey:
+		case fluentdSelfHostnameKey:
+		case elasticsearchURLKey:
+		case elasticsearchIndexKey:
+		case elasticsearchUsernameKey:
+		case elasticsearchPasswordKey:
+		case elasticsearchAPIKeyKey:
+		case lokiURLKey:
+		case lokiFormatKey:
+		case lokiLabelsKey:
+		case lokiDockerLabelsKey:
+		case lokiTenantIDKey:
+		case archiveS3BucketKey:
+		case archiveS3EndpointKey:
+		case archiveS3RegionKey:
+		case archiveS3PrefixKey:
+		case archiveS3PathStyleKey:
+		case archiveS3AccessKeyIDKey:
+		case archiveS3SecretAccessKeyKey:
+		case archiveMaxSizeKey:
+		case archiveMaxAgeKey:
+		case splunkDestinationsFileKey:
+		case splunkFilterStreamKey:
+		case splunkFilterIncludeKey:
+		case splunkFilterExcludeKey:
+		case splunkShadowURLKey:
+		case splunkShadowTokenKey:
+		case splunkShadowSampleKey:
+		case localMaxSizeKey:
+		case localMaxFileKey:
+		case localCompressKey:
 		case envKey:
 		case envRegexKey:
 		case labelsKey:
@@ -587,6 +853,30 @@ func ValidateLogOpt(cfg map[string]string) error {
 			return fmt.Errorf("unknown log opt '%s' for %s log driver", key, driverName)
 		}
 	}
+	if _, err := parseBatchingOptions(cfg); err != nil {
+		return err
+	}
+	if _, err := parseMetadataFields(cfg[splunkMetadataKey]); err != nil {
+		return err
+	}
+	if err := validateLocalLogOpt(cfg); err != nil {
+		return err
+	}
+	if _, _, err := parseSearchOptions(cfg); err != nil {
+		return err
+	}
+	if err := validateOutputLogOpt(cfg); err != nil {
+		return err
+	}
+	if err := validateArchiveLogOpt(cfg); err != nil {
+		return err
+	}
+	if _, err := parseMessageFilter(cfg); err != nil {
+		return err
+	}
+	if err := validateShadowOptions(cfg); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -623,6 +913,47 @@ func parseURL(info logger.Info) (*url.URL, error) {
 	return splunkURL, nil
 }
 
+// parseTLSConfig returns TLS settings of connections to Splunk
+func parseTLSConfig(info logger.Info) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	// Splunk is using autogenerated certificates by default,
+	// allow users to trust them with skipping verification
+	if insecureSkipVerifyStr, ok := info.Config[splunkInsecureSkipVerifyKey]; ok {
+		insecureSkipVerify, err := strconv.ParseBool(insecureSkipVerifyStr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.InsecureSkipVerify = insecureSkipVerify
+	}
+
+	// If path to the root certificate is provided - load it
+	if caPath, ok := info.Config[splunkCAPathKey]; ok {
+		caCert, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		caPool := x509.NewCertPool()
+		caPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = caPool
+	}
+
+	if caName, ok := info.Config[splunkCANameKey]; ok {
+		tlsConfig.ServerName = caName
+	}
+
+	return tlsConfig, nil
+}
+
+// newHTTPTransport returns transport of HTTP outputs, the search and the
+// shadow HEC. Requests use proxy from HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+func newHTTPTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+}
+
 func verifySplunkConnection(l *splunkLogger) error {
 	req, err := http.NewRequest(http.MethodOptions, l.url, nil)
 	if err != nil {
@@ -659,6 +990,19 @@ func getAdvancedOptionDuration(envName string, defaultValue time.Duration) time.
 	return parsedValue
 }
 
+func getAdvancedOptionBool(envName string, defaultValue bool) bool {
+	valueStr := os.Getenv(envName)
+	if valueStr == "" {
+		return defaultValue
+	}
+	parsedValue, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("Failed to parse value of %s as boolean. Using default %v. %v", envName, defaultValue, err))
+		return defaultValue
+	}
+	return parsedValue
+}
+
 func getAdvancedOptionInt(envName string, defaultValue int) int {
 	valueStr := os.Getenv(envName)
 	if valueStr == "" {
@@ -673,43 +1017,111 @@ func getAdvancedOptionInt(envName string, defaultValue int) int {
 }
 
 type driver struct {
-	mu     sync.Mutex
-	logs   map[string]*logPair
-	idx    map[string]*logPair
-	logger logger.Logger
+	mu      sync.Mutex
+	logs    map[string]*logPair
+	idx     map[string]*logPair
+	logger  logger.Logger
+	senders *senderRegistry
+	// Set when plugin is shutting down, no new loggers are started after that
+	stopping bool
 }
 
 type logPair struct {
-	jsonl   logger.Logger
-	splunkl logger.Logger
-	stream  io.ReadCloser
-	info    logger.Info
+	// Local copy in json-file or local format, nil if it is not kept
+	jsonl logger.Logger
+	// Destinations of the container, the first one is configured with options
+	// without index
+	destinations []*destination
+	// Archive of the container in S3, nil if it is not archived
+	archivel *archiveLogger
+	stream   io.ReadCloser
+	info     logger.Info
+
+	// Set before stream is closed, so consumeLog stops instead of retrying
+	closing int32
+	// Closed when consumeLog returns
+	done chan struct{}
+
+	// Sinks are created with the pair and closed by consumeLog
+	local *sink
+	// Sink of every destination, in the same order as destinations
+	remotes []*sink
+	archive *sink
+	// Number of frames which could not be decoded
+	corrupt int64
+}
+
+func newLogPair(jsonl logger.Logger, destinations []*destination, archivel *archiveLogger, stream io.ReadCloser, info logger.Info) *logPair {
+	lf := &logPair{
+		jsonl:        jsonl,
+		destinations: destinations,
+		archivel:     archivel,
+		stream:       stream,
+		info:         info,
+		done:         make(chan struct{}),
+	}
+	lf.remotes = make([]*sink, len(destinations))
+	for i, d := range destinations {
+		lf.remotes[i] = newSink(d.name, d.logger, info.ContainerID, defaultSinkQueueSize, false)
+	}
+	if archivel != nil {
+		lf.archive = newSink(archivel.Name(), archivel, info.ContainerID, defaultSinkQueueSize, false)
+	}
+	if jsonl != nil {
+		lf.local = newSink(jsonl.Name(), jsonl, info.ContainerID, defaultSinkQueueSize, true)
+	}
+	return lf
+}
+
+// stop closes the stream without waiting for the rest of the entries, consumeLog
+// closes loggers and returns after that
+func (lf *logPair) stop() {
+	atomic.StoreInt32(&lf.closing, 1)
+	lf.stream.Close()
+}
+
+// abort cancels requests in flight of the destination and archive loggers
+func (lf *logPair) abort() {
+	for _, d := range lf.destinations {
+		if l, ok := d.logger.(splunkLoggerInterface); ok {
+			l.abort()
+		}
+	}
+	if lf.archivel != nil {
+		lf.archivel.abort()
+	}
+}
+
+// wait waits until consumeLog returns. If it does not return before timeout,
+// the stream is closed, and if loggers still cannot flush, requests in flight
+// are cancelled. Returns false if consumeLog did not return even after that.
+func (lf *logPair) wait(timeout time.Duration) bool {
+	done := []chan struct{}{lf.done}
+	if len(waitClosed(done, timeout)) == 0 {
+		return true
+	}
+	lf.stop()
+	if len(waitClosed(done, abortGracePeriod)) == 0 {
+		return true
+	}
+	lf.abort()
+	return len(waitClosed(done, abortGracePeriod)) == 0
 }
 
 func newDriver() *driver {
 	return &driver{
-		logs: make(map[string]*logPair),
-		idx:  make(map[string]*logPair),
+		logs:    make(map[string]*logPair),
+		idx:     make(map[string]*logPair),
+		senders: newSenderRegistry(),
 	}
 }
 
 func (d *driver) StartLogging(file string, logCtx logger.Info) error {
 	d.mu.Lock()
-	if _, exists := d.logs[file]; exists {
-		d.mu.Unlock()
-		return fmt.Errorf("logger for %q already exists", file)
-	}
+	err := d.canStartLogging(file)
 	d.mu.Unlock()
-
-	if logCtx.LogPath == "" {
-		logCtx.LogPath = filepath.Join("/var/log/docker", logCtx.ContainerID)
-	}
-	if err := os.MkdirAll(filepath.Dir(logCtx.LogPath), 0755); err != nil {
-		return errors.Wrap(err, "error setting up logger dir")
-	}
-	jsonl, err := jsonfilelog.New(logCtx)
 	if err != nil {
-		return errors.Wrap(err, "error creating jsonfile logger")
+		return err
 	}
 
 	err = ValidateLogOpt(logCtx.Config)
@@ -717,19 +1129,57 @@ func (d *driver) StartLogging(file string, logCtx logger.Info) error {
 		return errors.Wrapf(err, "error options logger splunk: %q", file)
 	}
 
-	splunkl, err := New(logCtx)
+	jsonl, err := newLocalLogger(logCtx)
+	if err != nil {
+		return err
+	}
+
+	destinations, err := newDestinations(logCtx, d.senders)
 	if err != nil {
-		return errors.Wrap(err, "error creating splunk logger")
+		if jsonl != nil {
+			jsonl.Close()
+		}
+		return err
+	}
+
+	archivel, err := newArchiveLogger(logCtx)
+	if err != nil {
+		if jsonl != nil {
+			jsonl.Close()
+		}
+		closeDestinations(destinations)
+		return errors.Wrap(err, "error creating archive logger")
 	}
 
-	logrus.WithField("id", logCtx.ContainerID).WithField("file", file).WithField("logpath", logCtx.LogPath).Debugf("Start logging")
+	logrus.WithField("id", logCtx.ContainerID).WithField("file", file).Debugf("Start logging")
 	f, err := fifo.OpenFifo(context.Background(), file, syscall.O_RDONLY, 0700)
 	if err != nil {
+		if jsonl != nil {
+			jsonl.Close()
+		}
+		closeDestinations(destinations)
+		if archivel != nil {
+			archivel.Close()
+		}
 		return errors.Wrapf(err, "error opening logger fifo: %q", file)
 	}
 
+	// Plugin could start shutting down or another logger for the file could
+	// be started while loggers were created
 	d.mu.Lock()
-	lf := &logPair{jsonl, splunkl, f, logCtx}
+	if err := d.canStartLogging(file); err != nil {
+		d.mu.Unlock()
+		f.Close()
+		if jsonl != nil {
+			jsonl.Close()
+		}
+		closeDestinations(destinations)
+		if archivel != nil {
+			archivel.Close()
+		}
+		return err
+	}
+	lf := newLogPair(jsonl, destinations, archivel, f, logCtx)
 	d.logs[file] = lf
 	d.idx[logCtx.ContainerID] = lf
 	d.mu.Unlock()
@@ -738,25 +1188,43 @@ func (d *driver) StartLogging(file string, logCtx logger.Info) error {
 	return nil
 }
 
+// canStartLogging returns error if logging to the file cannot be started, it
+// is called with d.mu locked
+func (d *driver) canStartLogging(file string) error {
+	if d.stopping {
+		return fmt.Errorf("%s: plugin is shutting down", driverName)
+	}
+	if _, exists := d.logs[file]; exists {
+		return fmt.Errorf("logger for %q already exists", file)
+	}
+	return nil
+}
+
+// StopLogging waits until all entries of the fifo are consumed, then flushes
+// and closes all loggers. Local json file is kept, so logs of the stopped
+// container can still be read.
 func (d *driver) StopLogging(file string) error {
 	logrus.WithField("file", file).Debugf("Stop logging")
 	d.mu.Lock()
 	lf, ok := d.logs[file]
 	if ok {
-		lf.stream.Close()
 		delete(d.logs, file)
+		if d.idx[lf.info.ContainerID] == lf {
+			delete(d.idx, lf.info.ContainerID)
+		}
 	}
 	d.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if !lf.wait(stopTimeout()) {
+		logrus.WithField("id", lf.info.ContainerID).Error("logger did not stop after cancelling requests")
+	}
 	return nil
 }
 
-func sendMessage(l logger.Logger, buf *logdriver.LogEntry, containerid string) bool {
-	var msg logger.Message
-	msg.Line = buf.Line
-	msg.Source = buf.Source
-	msg.Partial = buf.Partial
-	msg.Timestamp = time.Unix(0, buf.TimeNano)
-	err := l.Log(&msg)
+func sendMessage(l logger.Logger, msg *logger.Message, containerid string) bool {
+	err := l.Log(msg)
 	if err != nil {
 		logrus.WithField("id", containerid).WithError(err).WithField("message", msg).Error("error writing log message")
 		return false
@@ -764,51 +1232,115 @@ func sendMessage(l logger.Logger, buf *logdriver.LogEntry, containerid string) b
 	return true
 }
 
+// consumeLog reads entries from the stream and passes them to the local,
+// destination and archive sinks. Local sink applies backpressure, so local copy
+// has all lines even if destinations are slow or fail.
 func consumeLog(lf *logPair) {
-	dec := protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
-	defer dec.Close()
+	defer close(lf.done)
+	remotes := append([]*sink(nil), lf.remotes...)
+	if lf.archive != nil {
+		remotes = append(remotes, lf.archive)
+	}
+	defer closeSinks(remotes)
+	if lf.local != nil {
+		defer lf.local.close()
+	}
+	defer lf.stream.Close()
+	dec := newEntryReader(lf.stream)
 	var buf logdriver.LogEntry
 	for {
-		if err := dec.ReadMsg(&buf); err != nil {
-			if err == io.EOF {
+		if err := dec.read(&buf); err != nil {
+			if err == io.EOF || atomic.LoadInt32(&lf.closing) != 0 {
 				logrus.WithField("id", lf.info.ContainerID).WithError(err).Debug("shutting down log logger")
-				lf.stream.Close()
 				return
 			}
-			dec = protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
+			if _, ok := err.(*entryError); !ok {
+				logrus.WithField("id", lf.info.ContainerID).WithError(err).Error("error reading log stream")
+				return
+			}
+			// Skip corrupt frame, never pass partially decoded entry to sinks
+			atomic.AddInt64(&lf.corrupt, 1)
+			logrus.WithField("id", lf.info.ContainerID).WithError(err).Error("error reading log entry")
+			buf.Reset()
+			continue
 		}
 
-		if sendMessage(lf.splunkl, &buf, lf.info.ContainerID) == false {
-			continue
+		if lf.local != nil {
+			lf.local.put(newMessage(&buf))
 		}
-		if sendMessage(lf.jsonl, &buf, lf.info.ContainerID) == false {
-			continue
+		for i, d := range lf.destinations {
+			if d.filter != nil && !d.filter.match(&buf) {
+				atomic.AddInt64(&lf.remotes[i].stats.filtered, 1)
+				continue
+			}
+			lf.remotes[i].put(newMessage(&buf))
+		}
+		if lf.archive != nil {
+			lf.archive.put(newMessage(&buf))
 		}
 
 		buf.Reset()
 	}
 }
 
-func (d *driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCloser, error) {
+// readLogsFromSearch reads events from Splunk search if the fallback is enabled,
+// otherwise returns err of the local copy
+func readLogsFromSearch(ctx context.Context, info logger.Info, config logger.ReadConfig, err error) (io.ReadCloser, error) {
+	search, searchErr := newSearchClient(info)
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	if search == nil {
+		return nil, err
+	}
+	logrus.WithField("id", info.ContainerID).WithError(err).Debug("Local copy is not available, reading logs from Splunk search")
+	return search.readLogs(ctx, config)
+}
+
+// ReadLogs streams entries of the local copy until they match config, or until
+// ctx is cancelled when the caller goes away
+func (d *driver) ReadLogs(ctx context.Context, info logger.Info, config logger.ReadConfig) (io.ReadCloser, error) {
 	d.mu.Lock()
 	lf, exists := d.idx[info.ContainerID]
 	d.mu.Unlock()
-	if !exists {
-		return nil, fmt.Errorf("logger does not exist for %s", info.ContainerID)
+
+	var lr logger.LogReader
+	if exists {
+		if lf.jsonl == nil {
+			return readLogsFromSearch(ctx, info, config, fmt.Errorf("%s: reading logs is not supported with %s=%s", driverName, splunkLocalStoreKey, localStoreNone))
+		}
+		var ok bool
+		lr, ok = lf.jsonl.(logger.LogReader)
+		if !ok {
+			return nil, fmt.Errorf("logger does not support reading")
+		}
+	} else {
+		// Container is stopped, read its local copy without opening it for
+		// writing. Nothing writes to it anymore, so there is nothing to follow.
+		reader, err := openLocalReader(info)
+		if err != nil {
+			return readLogsFromSearch(ctx, info, config, err)
+		}
+		lr = reader
+		config.Follow = false
 	}
 
 	r, w := io.Pipe()
-	lr, ok := lf.jsonl.(logger.LogReader)
-	if !ok {
-		return nil, fmt.Errorf("logger does not support reading")
-	}
 
 	go func() {
 		watcher := lr.ReadLogs(config)
 
 		enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
 		defer enc.Close()
-		defer watcher.Close()
+		defer watcher.ConsumerGone()
+
+		// Following stops at Until even if there are no new entries
+		var until <-chan time.Time
+		if config.Follow && !config.Until.IsZero() {
+			timer := time.NewTimer(config.Until.Sub(time.Now()))
+			defer timer.Stop()
+			until = timer.C
+		}
 
 		var buf logdriver.LogEntry
 		for {
@@ -819,8 +1351,26 @@ func (d *driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCl
 					return
 				}
 
+				// Filter by time here as well, so every format of the local copy
+				// honours Since and Until the same way
+				if !config.Since.IsZero() && msg.Timestamp.Before(config.Since) {
+					continue
+				}
+				if !config.Until.IsZero() && msg.Timestamp.After(config.Until) {
+					w.Close()
+					return
+				}
+
 				buf.Line = msg.Line
-				buf.Partial = msg.Partial
+				buf.Partial = msg.PLogMetaData != nil
+				buf.PartialLogMetadata = nil
+				if msg.PLogMetaData != nil {
+					buf.PartialLogMetadata = &logdriver.PartialLogEntryMetadata{
+						Last:    msg.PLogMetaData.Last,
+						Id:      msg.PLogMetaData.ID,
+						Ordinal: int32(msg.PLogMetaData.Ordinal),
+					}
+				}
 				buf.TimeNano = msg.Timestamp.UnixNano()
 				buf.Source = msg.Source
 
@@ -831,6 +1381,12 @@ func (d *driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCl
 			case err := <-watcher.Err:
 				w.CloseWithError(err)
 				return
+			case <-until:
+				w.Close()
+				return
+			case <-ctx.Done():
+				w.CloseWithError(ctx.Err())
+				return
 			}
 
 			buf.Reset()
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/jsonfilelog"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+// waitGoroutines waits until number of goroutines gets back to expected
+func waitGoroutines(t *testing.T, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > expected {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("Goroutines leaked, expected %d, got %d\n%s", expected, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Verify that StopLogging drains the stream, flushes and closes loggers, and
+// logs of the stopped container can still be read
+func TestStopLogging(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	dir, err := ioutil.TempDir("", "splunk-logging-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	goroutines := runtime.NumGoroutine()
+
+	d := newDriver()
+	info := logger.Info{
+		ContainerID: "container1iid",
+		LogPath:     filepath.Join(dir, "container1iid.log"),
+	}
+	jsonl, err := jsonfilelog.New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, w := startTestLogPair(t, d, hec, "container1iid", jsonl)
+
+	writeTestEntries(t, w, 3)
+	w.Close()
+
+	if err := d.StopLogging("container1iid"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lf.done:
+	default:
+		t.Fatal("consumeLog should return before StopLogging")
+	}
+
+	if len(hec.messages) != 3 {
+		t.Fatalf("Expected # of messages %d, got %d", 3, len(hec.messages))
+	}
+
+	if len(d.logs) != 0 || len(d.idx) != 0 {
+		t.Fatalf("Logger is not removed %v %v", d.logs, d.idx)
+	}
+
+	waitGoroutines(t, goroutines)
+
+	r, err := d.ReadLogs(context.Background(), info, logger.ReadConfig{Tail: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
+	var buf logdriver.LogEntry
+	read := 0
+	for {
+		if err := dec.ReadMsg(&buf); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		read++
+		buf.Reset()
+	}
+	dec.Close()
+	if read != 3 {
+		t.Fatalf("Expected %d entries in json file, got %d", 3, read)
+	}
+
+	if _, err := d.ReadLogs(context.Background(), logger.Info{ContainerID: "unknown", LogPath: filepath.Join(dir, "unknown.log")}, logger.ReadConfig{Tail: -1}); err == nil {
+		t.Fatal("Expecting error for unknown container")
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that StopLogging does not wait for the stream longer than timeout
+func TestStopLoggingTimeout(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	if err := os.Setenv(envVarStopTimeout, "100ms"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarStopTimeout)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	goroutines := runtime.NumGoroutine()
+
+	d := newDriver()
+	jsonl := &nopLogger{}
+	_, w := startTestLogPair(t, d, hec, "container1iid", jsonl)
+
+	// Writer is never closed, so stream is not drained
+	writeTestEntries(t, w, 2)
+
+	start := time.Now()
+	if err := d.StopLogging("container1iid"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("StopLogging took too long %v", elapsed)
+	}
+
+	if len(hec.messages) != 2 {
+		t.Fatalf("Expected # of messages %d, got %d", 2, len(hec.messages))
+	}
+
+	if !jsonl.closed {
+		t.Fatal("Json file logger should be closed")
+	}
+
+	waitGoroutines(t, goroutines)
+
+	err := hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/templates"
+	"github.com/docker/docker/pkg/urlutil"
+)
+
+const (
+	elasticsearchURLKey      = "elasticsearch-url"
+	elasticsearchIndexKey    = "elasticsearch-index"
+	elasticsearchUsernameKey = "elasticsearch-username"
+	elasticsearchPasswordKey = "elasticsearch-password"
+	elasticsearchAPIKeyKey   = "elasticsearch-api-key"
+)
+
+const (
+	defaultElasticsearchIndex = "docker-2006.01.02"
+	elasticsearchBulkPath     = "/_bulk"
+)
+
+// elasticsearchIndexPart is template action rendered for the container, or
+// time layout formatted with the time of every message
+type elasticsearchIndexPart struct {
+	value  string
+	layout bool
+}
+
+// elasticsearchOutput sends every batch as one _bulk request. Items rejected
+// with retryable status stay in the buffer and are sent again, other rejected
+// items are written to the dead-letter file.
+type elasticsearchOutput struct {
+	target *hecTarget
+	index  []elasticsearchIndexPart
+
+	host  string
+	tag   string
+	attrs map[string]string
+}
+
+// elasticsearchDocument is the source of indexed documents
+type elasticsearchDocument struct {
+	Timestamp string            `json:"@timestamp"`
+	Message   string            `json:"message"`
+	Stream    string            `json:"stream,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Tag       string            `json:"tag,omitempty"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+}
+
+// elasticsearchBulkResponse is the part of _bulk response used to find
+// rejected items
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+func newElasticsearchOutput(ctx context.Context, info logger.Info, metadata outputMetadata) (*elasticsearchOutput, error) {
+	bulkURL, err := parseElasticsearchURL(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	orchestrator, err := detectOrchestrator(info)
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseElasticsearchIndex(info.Config, &templateData{&info, orchestrator})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := parseTLSConfig(info)
+	if err != nil {
+		return nil, err
+	}
+	gzipCompression, gzipCompressionLevel, err := parseGzipOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := newHTTPTransport(tlsConfig)
+	return &elasticsearchOutput{
+		target: &hecTarget{
+			ctx: ctx,
+			client: &http.Client{
+				Transport: transport,
+			},
+			transport:            transport,
+			url:                  bulkURL.String(),
+			auth:                 elasticsearchAuth(info.Config),
+			contentType:          "application/x-ndjson",
+			gzipCompression:      gzipCompression,
+			gzipCompressionLevel: gzipCompressionLevel,
+		},
+		index: index,
+		host:  metadata.host,
+		tag:   metadata.tag,
+		attrs: metadata.attrs,
+	}, nil
+}
+
+// parseElasticsearchURL returns URL of the _bulk endpoint
+func parseElasticsearchURL(cfg map[string]string) (*url.URL, error) {
+	urlStr, ok := cfg[elasticsearchURLKey]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is expected with %s=%s", driverName, elasticsearchURLKey, splunkOutputKey, outputElasticsearch)
+	}
+	bulkURL, err := url.Parse(urlStr)
+	if err != nil || !urlutil.IsURL(urlStr) || !bulkURL.IsAbs() {
+		return nil, fmt.Errorf("%s: expected format scheme://dns_name_or_ip:port for %s", driverName, elasticsearchURLKey)
+	}
+	bulkURL.Path = strings.TrimSuffix(bulkURL.Path, "/") + elasticsearchBulkPath
+	return bulkURL, nil
+}
+
+// parseElasticsearchIndexTemplate parses elasticsearch-index and returns its
+// top level nodes
+func parseElasticsearchIndexTemplate(cfg map[string]string) ([]parse.Node, error) {
+	value, ok := cfg[elasticsearchIndexKey]
+	if !ok {
+		value = defaultElasticsearchIndex
+	}
+	tmpl, err := templates.NewParse(elasticsearchIndexKey, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to parse template of %s: %v", driverName, elasticsearchIndexKey, err)
+	}
+	if tmpl.Tree == nil || len(tmpl.Tree.Root.Nodes) == 0 {
+		return nil, fmt.Errorf("%s: %s cannot be empty", driverName, elasticsearchIndexKey)
+	}
+	return tmpl.Tree.Root.Nodes, nil
+}
+
+// parseElasticsearchIndex renders template actions of elasticsearch-index for
+// the container. Text between actions is time layout, so digits and names of
+// months and days in it are replaced with the time of the message. Text which
+// should stay as it is can be quoted in an action, like {{"app1"}}. Actions
+// with a body, like {{if}}...{{end}}, are rendered as a whole, so text inside
+// them is not time layout either.
+func parseElasticsearchIndex(cfg map[string]string, data *templateData) ([]elasticsearchIndexPart, error) {
+	nodes, err := parseElasticsearchIndexTemplate(cfg)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]elasticsearchIndexPart, 0, len(nodes))
+	for _, node := range nodes {
+		if text, ok := node.(*parse.TextNode); ok {
+			parts = append(parts, elasticsearchIndexPart{string(text.Text), true})
+			continue
+		}
+		rendered, err := renderTemplate(elasticsearchIndexKey, node.String(), data)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, elasticsearchIndexPart{rendered, false})
+	}
+	return parts, nil
+}
+
+// elasticsearchAuth returns Authorization header from API key or user credentials
+func elasticsearchAuth(cfg map[string]string) string {
+	if apiKey, ok := cfg[elasticsearchAPIKeyKey]; ok {
+		return "ApiKey " + apiKey
+	}
+	if username, ok := cfg[elasticsearchUsernameKey]; ok {
+		credentials := username + ":" + cfg[elasticsearchPasswordKey]
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	return ""
+}
+
+// validateElasticsearchOptions validates options and the syntax of the index
+// template, the index is rendered when the logger is created
+func validateElasticsearchOptions(cfg map[string]string) error {
+	if _, err := parseElasticsearchURL(cfg); err != nil {
+		return err
+	}
+	if _, err := parseElasticsearchIndexTemplate(cfg); err != nil {
+		return err
+	}
+	if _, ok := cfg[elasticsearchPasswordKey]; ok {
+		if _, ok := cfg[elasticsearchUsernameKey]; !ok {
+			return fmt.Errorf("%s: %s is expected with %s", driverName, elasticsearchUsernameKey, elasticsearchPasswordKey)
+		}
+	}
+	return nil
+}
+
+// indexName returns name of the index for the time of the message
+func (e *elasticsearchOutput) indexName(t time.Time) string {
+	var name bytes.Buffer
+	for _, part := range e.index {
+		if part.layout {
+			name.WriteString(t.UTC().Format(part.value))
+		} else {
+			name.WriteString(part.value)
+		}
+	}
+	return name.String()
+}
+
+// send posts messages in one _bulk request. Messages accepted by Elasticsearch
+// or rejected permanently are moved to the front of messages, and their number
+// is returned, so the rest of messages is retried.
+func (e *elasticsearchOutput) send(messages []*splunkMessage, reject func(messages []*splunkMessage, reason string, status int)) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, message := range messages {
+		action := map[string]map[string]string{
+			"create": {"_index": e.indexName(message.timestamp)},
+		}
+		if err := encoder.Encode(action); err != nil {
+			return 0, err
+		}
+		document := elasticsearchDocument{
+			Timestamp: message.timestamp.UTC().Format(time.RFC3339Nano),
+			Message:   messageLine(message),
+			Stream:    message.stream,
+			Host:      e.host,
+			Tag:       e.tag,
+			Attrs:     e.attrs,
+		}
+		if err := encoder.Encode(&document); err != nil {
+			return 0, err
+		}
+	}
+
+	var response bytes.Buffer
+	if err := e.target.postBody(body.Bytes(), &response); err != nil {
+		return 0, err
+	}
+	var result elasticsearchBulkResponse
+	if err := json.Unmarshal(response.Bytes(), &result); err != nil {
+		return 0, fmt.Errorf("%s: failed to parse bulk response - %v", driverName, err)
+	}
+	if !result.Errors {
+		return len(messages), nil
+	}
+	if len(result.Items) != len(messages) {
+		return 0, fmt.Errorf("%s: bulk response has %d items for %d messages", driverName, len(result.Items), len(messages))
+	}
+
+	var retry []*splunkMessage
+	var lastError json.RawMessage
+	done := 0
+	for i, item := range result.Items {
+		for _, status := range item {
+			switch {
+			case status.Status < 300:
+				messages[done] = messages[i]
+				done++
+			case status.Status == http.StatusTooManyRequests || status.Status >= 500:
+				retry = append(retry, messages[i])
+				lastError = status.Error
+			default:
+				reject(messages[i:i+1], string(status.Error), status.Status)
+				messages[done] = messages[i]
+				done++
+			}
+		}
+	}
+	copy(messages[done:], retry)
+	if len(retry) > 0 {
+		return done, fmt.Errorf("%s: %d messages were rejected by %s and will be retried - %s", driverName, len(retry), e.target.url, lastError)
+	}
+	return done, nil
+}
+
+func (e *elasticsearchOutput) close() error {
+	e.target.transport.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// elasticsearchBulkItem is one action and document of a bulk request
+type elasticsearchBulkItem struct {
+	index    string
+	document elasticsearchDocument
+}
+
+// elasticsearchMock accepts _bulk requests and rejects documents with the
+// message set in rejected with the status
+type elasticsearchMock struct {
+	t        *testing.T
+	mu       sync.Mutex
+	rejected map[string]int
+	requests []*http.Request
+	items    []elasticsearchBulkItem
+}
+
+func (m *elasticsearchMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		reader = gzipReader
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, r)
+
+	var items []string
+	errors := false
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var action map[string]map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			m.t.Fatal(err)
+		}
+		if !scanner.Scan() {
+			m.t.Fatal("Action without document")
+		}
+		var document elasticsearchDocument
+		if err := json.Unmarshal(scanner.Bytes(), &document); err != nil {
+			m.t.Fatal(err)
+		}
+		if status, ok := m.rejected[document.Message]; ok {
+			errors = true
+			items = append(items, fmt.Sprintf(`{"create":{"status":%d,"error":{"type":"rejected"}}}`, status))
+			continue
+		}
+		m.items = append(m.items, elasticsearchBulkItem{action["create"]["_index"], document})
+		items = append(items, `{"create":{"status":201}}`)
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+func (m *elasticsearchMock) received() ([]*http.Request, []elasticsearchBulkItem) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests, m.items
+}
+
+// Verify that documents are indexed into templated index with gzip and basic
+// authentication
+func TestElasticsearchOutput(t *testing.T) {
+	mock := &elasticsearchMock{t: t}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkOutputKey:          outputElasticsearch,
+			elasticsearchURLKey:      server.URL + "/",
+			elasticsearchIndexKey:    `logs-{{.Name}}-{{"v1"}}-2006.01.02`,
+			elasticsearchUsernameKey: "user",
+			elasticsearchPasswordKey: "password",
+			splunkGzipCompressionKey: "true",
+			splunkHostKey:            "myhost",
+			tagKey:                   "mytag",
+			labelsKey:                "a",
+		},
+		ContainerID:     "containeriid",
+		ContainerName:   "/container_name",
+		ContainerLabels: map[string]string{"a": "b"},
+	}
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2018, 3, 1, 23, 59, 59, 0, time.UTC)
+	second := first.Add(time.Second)
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("first"), Source: "stdout", Timestamp: first}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("second"), Source: "stderr", Timestamp: second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, items := mock.received()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(requests))
+	}
+	request := requests[0]
+	username, password, ok := request.BasicAuth()
+	if request.URL.Path != elasticsearchBulkPath ||
+		request.Header.Get("Content-Type") != "application/x-ndjson" ||
+		request.Header.Get("Content-Encoding") != "gzip" ||
+		!ok || username != "user" || password != "password" {
+		t.Fatalf("Unexpected request %s %v", request.URL, request.Header)
+	}
+
+	expected := []elasticsearchBulkItem{
+		{"logs-container_name-v1-2018.03.01", elasticsearchDocument{"2018-03-01T23:59:59Z", "first", "stdout", "myhost", "mytag", nil}},
+		{"logs-container_name-v1-2018.03.02", elasticsearchDocument{"2018-03-02T00:00:00Z", "second", "stderr", "myhost", "mytag", nil}},
+	}
+	if len(items) != len(expected) {
+		t.Fatalf("Unexpected items %v", items)
+	}
+	for i, item := range items {
+		if item.document.Attrs["a"] != "b" {
+			t.Fatalf("Unexpected attrs %v", item.document.Attrs)
+		}
+		item.document.Attrs = nil
+		if !reflect.DeepEqual(item, expected[i]) {
+			t.Fatalf("Unexpected item %+v, expected %+v", item, expected[i])
+		}
+	}
+}
+
+// Verify that only items rejected with retryable status are retried
+func TestElasticsearchOutputPartialRetry(t *testing.T) {
+	mock := &elasticsearchMock{t: t, rejected: map[string]int{"busy": 429, "invalid": 400}}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			elasticsearchURLKey:    server.URL,
+			elasticsearchAPIKeyKey: "secret",
+		},
+		ContainerID: "containeriid",
+	}
+	rejected := &deadLetterRecorder{}
+	output, err := newElasticsearchOutput(context.Background(), info, outputMetadata{host: "myhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+
+	var messages []*splunkMessage
+	for _, line := range []string{"first", "busy", "invalid", "second"} {
+		messages = append(messages, &splunkMessage{Event: line, timestamp: time.Unix(1519905600, 0)})
+	}
+	sent, err := output.send(messages, rejected.deadLetter)
+	if err == nil || sent != 3 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+	if messageLine(messages[3]) != "busy" {
+		t.Fatalf("Expected rejected message at the end, got %s", messageLine(messages[3]))
+	}
+	if len(rejected.messages) != 1 || messageLine(rejected.messages[0]) != "invalid" || rejected.statuses[0] != 400 {
+		t.Fatalf("Expected invalid message in dead letters, got %v %v", rejected.messages, rejected.statuses)
+	}
+
+	requests, items := mock.received()
+	if requests[0].Header.Get("Authorization") != "ApiKey secret" {
+		t.Fatalf("Unexpected headers %v", requests[0].Header)
+	}
+	if len(items) != 2 || items[0].document.Message != "first" || items[1].document.Message != "second" ||
+		items[0].index != "docker-2018.03.01" {
+		t.Fatalf("Unexpected items %v", items)
+	}
+
+	// Retried message is accepted when Elasticsearch is not busy anymore
+	mock.mu.Lock()
+	delete(mock.rejected, "busy")
+	mock.mu.Unlock()
+	if sent, err := output.send(messages[sent:], rejected.deadLetter); err != nil || sent != 1 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+	if _, items := mock.received(); len(items) != 3 || items[2].document.Message != "busy" {
+		t.Fatalf("Unexpected items %v", items)
+	}
+}
+
+// Verify that items rejected permanently are counted as dropped, not as sent
+func TestElasticsearchOutputRejectedStats(t *testing.T) {
+	mock := &elasticsearchMock{t: t, rejected: map[string]int{"invalid": 400}}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkOutputKey:     outputElasticsearch,
+			elasticsearchURLKey: server.URL,
+		},
+		ContainerID: "elasticsearchrejected",
+	}
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := loggerDriver.(*splunkLoggerInline)
+	for _, line := range []string{"first", "invalid", "second"} {
+		if err := l.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := l.stats.snapshot(); stats.sent != 2 || stats.dropped != 1 {
+		t.Fatalf("Unexpected stats %v", l.stats.fields())
+	}
+}
+
+func TestParseElasticsearchIndex(t *testing.T) {
+	info := logger.Info{ContainerName: "/app1"}
+	data := &templateData{&info, &orchestratorInfo{}}
+	index, err := parseElasticsearchIndex(map[string]string{elasticsearchIndexKey: `{{.Name}}-{{"app1"}}-{{if .Name}}v1-{{end}}2006`}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &elasticsearchOutput{index: index}
+	// Digits of the container name, quoted text and text of blocks are not
+	// time layout
+	if name := output.indexName(time.Unix(1519905600, 0)); name != "app1-app1-v1-2018" {
+		t.Fatalf("Unexpected index %s", name)
+	}
+
+	if _, err := parseElasticsearchIndex(map[string]string{elasticsearchIndexKey: "{{.Unknown}}"}, data); err == nil {
+		t.Fatal("Expecting error for unknown field")
+	}
+	if err := validateElasticsearchOptions(map[string]string{elasticsearchURLKey: "localhost:9200"}); err == nil {
+		t.Fatal("Expecting error for url without scheme")
+	}
+	for _, index := range []string{"", "{{.Name", "{{if .Name}}logs"} {
+		if err := ValidateLogOpt(map[string]string{
+			splunkOutputKey:       outputElasticsearch,
+			elasticsearchURLKey:   "http://localhost:9200",
+			elasticsearchIndexKey: index,
+		}); err == nil {
+			t.Fatalf("Expecting error for index %q", index)
+		}
+	}
+}
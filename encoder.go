@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"unicode/utf8"
+)
+
+// Buffers which grew above this size are not returned to the pool, so one
+// huge batch does not pin memory for the lifetime of the plugin
+const maxPooledBufferSize = 4 * 1024 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+func putBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buffer)
+}
+
+// One pool of gzip writers for every compression level, from
+// gzip.DefaultCompression (-1) to gzip.BestCompression (9)
+var gzipWriterPools [gzip.BestCompression - gzip.DefaultCompression + 1]sync.Pool
+
+func getGzipWriter(buffer *bytes.Buffer, level int) (*gzip.Writer, error) {
+	if gzipWriter, ok := gzipWriterPools[level-gzip.DefaultCompression].Get().(*gzip.Writer); ok {
+		gzipWriter.Reset(buffer)
+		return gzipWriter, nil
+	}
+	gzipWriter, err := gzip.NewWriterLevel(ioutil.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	gzipWriter.Reset(buffer)
+	return gzipWriter, nil
+}
+
+func putGzipWriter(gzipWriter *gzip.Writer, level int) {
+	gzipWriter.Reset(ioutil.Discard)
+	gzipWriterPools[level-gzip.DefaultCompression].Put(gzipWriter)
+}
+
+// messageEncoder writes batches of messages in the format expected by HEC.
+// Fields which are the same for every message of the logger (host, source,
+// sourcetype, index and entity) are encoded once from nullMessage.
+type messageEncoder struct {
+	nullMessage *splunkMessage
+	// Pre-encoded `,"host":...}` part of the envelope
+	suffix []byte
+}
+
+func newMessageEncoder(nullMessage *splunkMessage) *messageEncoder {
+	encoder := &messageEncoder{nullMessage: nullMessage}
+
+	envelope := *nullMessage
+	envelope.Event = nil
+	envelope.Time = ""
+	if encoded, err := json.Marshal(&envelope); err == nil {
+		prefix := []byte(`{"event":null,"time":""`)
+		if bytes.HasPrefix(encoded, prefix) {
+			encoder.suffix = encoded[len(prefix):]
+		}
+	}
+	return encoder
+}
+
+// encode appends JSON of every message to buffer
+func (e *messageEncoder) encode(buffer *bytes.Buffer, messages []*splunkMessage) error {
+	for _, message := range messages {
+		if err := e.encodeMessage(buffer, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *messageEncoder) encodeMessage(buffer *bytes.Buffer, message *splunkMessage) error {
+	if e.suffix == nil ||
+		message.Host != e.nullMessage.Host ||
+		message.Source != e.nullMessage.Source ||
+		message.SourceType != e.nullMessage.SourceType ||
+		message.Index != e.nullMessage.Index ||
+		message.Entity != e.nullMessage.Entity {
+		return encodeJSON(buffer, message)
+	}
+
+	start := buffer.Len()
+	buffer.WriteString(`{"event":`)
+	if err := encodeEvent(buffer, message.Event); err != nil {
+		buffer.Truncate(start)
+		return err
+	}
+	buffer.WriteString(`,"time":`)
+	writeJSONString(buffer, message.Time)
+	buffer.Write(e.suffix)
+	return nil
+}
+
+func encodeEvent(buffer *bytes.Buffer, event interface{}) error {
+	switch event := event.(type) {
+	case string:
+		writeJSONString(buffer, event)
+		return nil
+	case *json.RawMessage:
+		if event != nil {
+			return json.Compact(buffer, *event)
+		}
+	case *splunkMessageEvent:
+		if event != nil && event.suffix != nil {
+			buffer.WriteString(`{"line":`)
+			if err := encodeEvent(buffer, event.Line); err != nil {
+				return err
+			}
+			buffer.WriteString(`,"source":`)
+			writeJSONString(buffer, event.Source)
+			buffer.Write(event.suffix)
+			return nil
+		}
+	}
+	return encodeJSON(buffer, event)
+}
+
+func encodeJSON(buffer *bytes.Buffer, v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buffer.Write(encoded)
+	return nil
+}
+
+// encodeEventSuffix pre-encodes the tag and attrs part of splunkMessageEvent
+func encodeEventSuffix(tag string, attrs map[string]string) []byte {
+	encoded, err := json.Marshal(&struct {
+		Tag   string            `json:"tag,omitempty"`
+		Attrs map[string]string `json:"attrs,omitempty"`
+	}{tag, attrs})
+	if err != nil {
+		return nil
+	}
+	// Replace opening brace with a separator, unless there is nothing to add
+	if len(encoded) == 2 {
+		return []byte("}")
+	}
+	encoded[0] = ','
+	return encoded
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString writes s as a JSON string, escaping it the same way as
+// encoding/json does
+func writeJSONString(buffer *bytes.Buffer, s string) {
+	buffer.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buffer.WriteString(s[start:i])
+			switch b {
+			case '\\', '"':
+				buffer.WriteByte('\\')
+				buffer.WriteByte(b)
+			case '\n':
+				buffer.WriteString(`\n`)
+			case '\r':
+				buffer.WriteString(`\r`)
+			case '\t':
+				buffer.WriteString(`\t`)
+			default:
+				buffer.WriteString(`\u00`)
+				buffer.WriteByte(hexDigits[b>>4])
+				buffer.WriteByte(hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buffer.WriteString(s[start:i])
+			buffer.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON, but not valid JavaScript
+		if c == '\u2028' || c == '\u2029' {
+			buffer.WriteString(s[start:i])
+			buffer.WriteString(`\u202`)
+			buffer.WriteByte(hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buffer.WriteString(s[start:])
+	buffer.WriteByte('"')
+}
+
+// pooledBody is a request body backed by a pooled buffer. Transport can read
+// the body even after response is returned, so the buffer can be reused only
+// after the body is closed.
+type pooledBody struct {
+	*bytes.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newPooledBody(data []byte) *pooledBody {
+	return &pooledBody{
+		Reader: bytes.NewReader(data),
+		closed: make(chan struct{}),
+	}
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+	})
+	return nil
+}
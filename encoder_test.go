@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify encoder produces the same JSON as encoding/json
+func TestMessageEncoder(t *testing.T) {
+	nullMessage := &splunkMessage{
+		Host:       "myhost",
+		Source:     "mysource",
+		SourceType: "mysourcetype",
+		Index:      "myindex",
+	}
+	rawJSONMessage := json.RawMessage(`{ "a" : [1, 2, {"b": "c"}] }`)
+	lines := []string{
+		"",
+		"plain",
+		"quotes \" and \\ backslash",
+		"control \n\r\t\x01 characters",
+		"html <a href=\"x\">&</a>",
+		"unicode \u00fc \u20ac \u2028 \u2029",
+		"invalid \xff utf8",
+	}
+
+	var events []interface{}
+	for _, line := range lines {
+		events = append(events, line)
+		events = append(events, &splunkMessageEvent{
+			Line:   line,
+			Source: "stdout",
+			Tag:    "mytag",
+			Attrs:  map[string]string{"b": "2", "a": line},
+			suffix: encodeEventSuffix("mytag", map[string]string{"b": "2", "a": line}),
+		})
+	}
+	events = append(events, &rawJSONMessage)
+	events = append(events, &splunkMessageEvent{
+		Line:   &rawJSONMessage,
+		Source: "stderr",
+		suffix: encodeEventSuffix("", nil),
+	})
+	events = append(events, map[string]interface{}{"not": "optimized"})
+
+	encoder := newMessageEncoder(nullMessage)
+	if encoder.suffix == nil {
+		t.Fatal("Envelope should be pre-encoded")
+	}
+
+	for _, event := range events {
+		message := *nullMessage
+		message.Event = event
+		message.Time = "1.000000"
+
+		var buffer bytes.Buffer
+		if err := encoder.encode(&buffer, []*splunkMessage{&message}); err != nil {
+			t.Fatal(err)
+		}
+		expected, err := json.Marshal(&message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var actualValue, expectedValue interface{}
+		if err := json.Unmarshal(buffer.Bytes(), &actualValue); err != nil {
+			t.Fatalf("Invalid JSON %s: %v", buffer.Bytes(), err)
+		}
+		if err := json.Unmarshal(expected, &expectedValue); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actualValue, expectedValue) {
+			t.Fatalf("Unexpected encoding %s, expected %s", buffer.Bytes(), expected)
+		}
+	}
+}
+
+// Verify messages which differ from nullMessage are still encoded correctly
+func TestMessageEncoderOverriddenFields(t *testing.T) {
+	nullMessage := &splunkMessage{
+		Host: "myhost",
+	}
+	encoder := newMessageEncoder(nullMessage)
+
+	message := *nullMessage
+	message.Event = "line"
+	message.Time = "1.000000"
+	message.Index = "otherindex"
+
+	var buffer bytes.Buffer
+	if err := encoder.encode(&buffer, []*splunkMessage{&message}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded splunkMessage
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Index != "otherindex" || decoded.Host != "myhost" || decoded.Event != "line" {
+		t.Fatalf("Unexpected message %v", decoded)
+	}
+}
+
+// newDiscardingCollector starts HEC which accepts and discards all events, so
+// benchmarks do not measure the mock
+func newDiscardingCollector() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.Copy(ioutil.Discard, request.Body)
+		writer.WriteHeader(http.StatusOK)
+	}))
+}
+
+func benchmarkEncodeMessage(b *testing.B, format string) {
+	hec := newDiscardingCollector()
+	defer hec.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL,
+			splunkTokenKey:            "4642492F-D8BD-47F1-A005-0C08AE4657DF",
+			splunkFormatKey:           format,
+			splunkVerifyConnectionKey: "false",
+			labelsKey:                 "a",
+		},
+		ContainerID: "containeriid",
+		ContainerLabels: map[string]string{
+			"a": "b",
+		},
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer loggerDriver.Close()
+
+	var l *splunkLogger
+	switch loggerDriver := loggerDriver.(type) {
+	case *splunkLoggerInline:
+		l = loggerDriver.splunkLogger
+	case *splunkLoggerJSON:
+		l = loggerDriver.splunkLogger
+	case *splunkLoggerRaw:
+		l = loggerDriver.splunkLogger
+	}
+
+	var message *splunkMessage
+	// Capture a message created by the logger without sending it
+	l.stream = make(chan *splunkMessage, 1)
+	if err := loggerDriver.Log(&logger.Message{Line: []byte(`{"level":"info","msg":"benchmark <message>"}`), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		b.Fatal(err)
+	}
+	message = <-l.stream
+	messages := []*splunkMessage{message}
+
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+		if err := l.encoder.encode(buffer, messages); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Allocations per operation are allocations per encoded event
+func BenchmarkEncodeMessageInline(b *testing.B) {
+	benchmarkEncodeMessage(b, splunkFormatInline)
+}
+
+func BenchmarkEncodeMessageJSON(b *testing.B) {
+	benchmarkEncodeMessage(b, splunkFormatJSON)
+}
+
+func BenchmarkEncodeMessageRaw(b *testing.B) {
+	benchmarkEncodeMessage(b, splunkFormatRaw)
+}
+
+// Compare with encoding every message with encoding/json
+func BenchmarkEncodeMessageMarshal(b *testing.B) {
+	message := &splunkMessage{
+		Event: &splunkMessageEvent{
+			Line:   `{"level":"info","msg":"benchmark <message>"}`,
+			Source: "stdout",
+			Tag:    "containeriid",
+			Attrs:  map[string]string{"a": "b"},
+		},
+		Time: "1.000000",
+		Host: "myhost",
+	}
+
+	var buffer bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+		if err := encodeJSON(&buffer, message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkTryPostMessages(b *testing.B, gzipCompression string) {
+	hec := newDiscardingCollector()
+	defer hec.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL,
+			splunkTokenKey:            "4642492F-D8BD-47F1-A005-0C08AE4657DF",
+			splunkGzipCompressionKey:  gzipCompression,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID: "containeriid",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer loggerDriver.Close()
+	l := loggerDriver.(*splunkLoggerInline)
+
+	messages := make([]*splunkMessage, defaultPostMessagesBatchSize)
+	for i := range messages {
+		message := l.createSplunkMessage(&logger.Message{Timestamp: time.Now()})
+		event := *l.nullEvent
+		event.Line = "benchmark message"
+		event.Source = "stdout"
+		message.Event = &event
+		messages[i] = message
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.tryPostMessages(messages); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Every operation sends one batch of defaultPostMessagesBatchSize events
+func BenchmarkTryPostMessages(b *testing.B) {
+	benchmarkTryPostMessages(b, "false")
+}
+
+func BenchmarkTryPostMessagesGzip(b *testing.B) {
+	benchmarkTryPostMessages(b, "true")
+}
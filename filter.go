@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+)
+
+const (
+	splunkFilterStreamKey  = "splunk-filter-stream"
+	splunkFilterIncludeKey = "splunk-filter-include"
+	splunkFilterExcludeKey = "splunk-filter-exclude"
+)
+
+// messageFilter selects entries sent to one destination
+type messageFilter struct {
+	stream  string
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// parseMessageFilter returns nil if no filter options are set
+func parseMessageFilter(cfg map[string]string) (*messageFilter, error) {
+	filter := &messageFilter{}
+	set := false
+	if stream, ok := cfg[splunkFilterStreamKey]; ok {
+		switch stream {
+		case "stdout":
+		case "stderr":
+		default:
+			return nil, fmt.Errorf("%s: unknown %s '%s', supported values are stdout and stderr", driverName, splunkFilterStreamKey, stream)
+		}
+		filter.stream = stream
+		set = true
+	}
+	for _, option := range []struct {
+		key    string
+		regexp **regexp.Regexp
+	}{
+		{splunkFilterIncludeKey, &filter.include},
+		{splunkFilterExcludeKey, &filter.exclude},
+	} {
+		expr, ok := cfg[option.key]
+		if !ok {
+			continue
+		}
+		compiled, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to parse %s - %v", driverName, option.key, err)
+		}
+		*option.regexp = compiled
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// match returns true if the entry should be sent
+func (f *messageFilter) match(entry *logdriver.LogEntry) bool {
+	if f.stream != "" && entry.Source != f.stream {
+		return false
+	}
+	if f.include != nil && !f.include.Match(entry.Line) {
+		return false
+	}
+	if f.exclude != nil && f.exclude.Match(entry.Line) {
+		return false
+	}
+	return true
+}
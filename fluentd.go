@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	fluentdAddressKey      = "fluentd-address"
+	fluentdRequireAckKey   = "fluentd-require-ack"
+	fluentdSharedKeyKey    = "fluentd-shared-key"
+	fluentdUsernameKey     = "fluentd-username"
+	fluentdPasswordKey     = "fluentd-password"
+	fluentdSelfHostnameKey = "fluentd-self-hostname"
+)
+
+const (
+	defaultFluentdPort = "24224"
+	// Tag of events when container tag is empty, forward protocol requires one
+	defaultFluentdTag = "docker"
+)
+
+// fluentdOptions are parsed fluentd-* options
+type fluentdOptions struct {
+	address    string
+	useTLS     bool
+	requireAck bool
+	// Shared key authentication is used when sharedKey is set, user
+	// authentication is used when server asks for it
+	sharedKey    string
+	username     string
+	password     string
+	selfHostname string
+}
+
+// parseFluentdOptions validates fluentd-* options
+func parseFluentdOptions(cfg map[string]string) (*fluentdOptions, error) {
+	addressStr, ok := cfg[fluentdAddressKey]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is expected with %s=%s", driverName, fluentdAddressKey, splunkOutputKey, outputFluentd)
+	}
+	address, err := url.Parse(addressStr)
+	if err != nil || address.Host == "" {
+		return nil, fmt.Errorf("%s: expected format tcp|tcp+tls://host:port for %s", driverName, fluentdAddressKey)
+	}
+	options := &fluentdOptions{
+		sharedKey:    cfg[fluentdSharedKeyKey],
+		username:     cfg[fluentdUsernameKey],
+		password:     cfg[fluentdPasswordKey],
+		selfHostname: cfg[fluentdSelfHostnameKey],
+	}
+	switch address.Scheme {
+	case "tcp":
+	case "tcp+tls":
+		options.useTLS = true
+	default:
+		return nil, fmt.Errorf("%s: unsupported scheme '%s' in %s, supported schemes are tcp and tcp+tls", driverName, address.Scheme, fluentdAddressKey)
+	}
+	port := defaultFluentdPort
+	if address.Port() != "" {
+		port = address.Port()
+	}
+	options.address = net.JoinHostPort(address.Hostname(), port)
+
+	if requireAckStr, ok := cfg[fluentdRequireAckKey]; ok {
+		options.requireAck, err = strconv.ParseBool(requireAckStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid value '%s' for %s", driverName, requireAckStr, fluentdRequireAckKey)
+		}
+	}
+	if options.sharedKey == "" && (options.username != "" || options.password != "") {
+		return nil, fmt.Errorf("%s: %s and %s are expected with %s", driverName, fluentdUsernameKey, fluentdPasswordKey, fluentdSharedKeyKey)
+	}
+	return options, nil
+}
+
+// fluentdOutput sends every batch as one PackedForward message. With ack
+// required, batch is sent again when server does not acknowledge it.
+type fluentdOutput struct {
+	options *fluentdOptions
+	tag     string
+	// Pre-encoded container fields of every record
+	recordSuffix []byte
+	recordFields int
+
+	mu     sync.Mutex
+	conn   outputConn
+	reader *bufio.Reader
+}
+
+func newFluentdOutput(ctx context.Context, info logger.Info, metadata outputMetadata) (*fluentdOutput, error) {
+	options, err := parseFluentdOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	if options.selfHostname == "" {
+		options.selfHostname = metadata.host
+	}
+	f := &fluentdOutput{
+		options: options,
+		tag:     metadata.tag,
+	}
+	if f.tag == "" {
+		f.tag = defaultFluentdTag
+	}
+
+	// Records have the same fields as records of docker fluentd driver
+	fields := map[string]string{
+		"container_id":   info.ContainerID,
+		"container_name": info.Name(),
+	}
+	for key, value := range metadata.attrs {
+		if _, ok := fields[key]; !ok && key != "log" && key != "source" {
+			fields[key] = value
+		}
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f.recordSuffix = appendMsgpackString(f.recordSuffix, key)
+		f.recordSuffix = appendMsgpackString(f.recordSuffix, fields[key])
+	}
+	f.recordFields = len(keys) + 2
+
+	f.conn = outputConn{
+		ctx:       ctx,
+		network:   "tcp",
+		address:   options.address,
+		onConnect: f.connect,
+	}
+	if options.useTLS {
+		f.conn.tlsConfig, err = outputTLSConfig(info, options.address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *fluentdOutput) send(messages []*splunkMessage, reject func(messages []*splunkMessage, reason string, status int)) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var entries []byte
+	for _, message := range messages {
+		entries = appendMsgpackArrayHeader(entries, 2)
+		entries = appendMsgpackEventTime(entries, message.timestamp)
+		entries = appendMsgpackMapHeader(entries, f.recordFields)
+		entries = appendMsgpackString(entries, "log")
+		entries = appendMsgpackString(entries, messageLine(message))
+		entries = appendMsgpackString(entries, "source")
+		entries = appendMsgpackString(entries, message.stream)
+		entries = append(entries, f.recordSuffix...)
+	}
+
+	var chunk string
+	frame := appendMsgpackArrayHeader(nil, 3)
+	frame = appendMsgpackString(frame, f.tag)
+	frame = appendMsgpackBin(frame, entries)
+	if f.options.requireAck {
+		id, err := randomBytes(16)
+		if err != nil {
+			return 0, err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		frame = appendMsgpackMapHeader(frame, 2)
+		frame = appendMsgpackString(frame, "chunk")
+		frame = appendMsgpackString(frame, chunk)
+	} else {
+		frame = appendMsgpackMapHeader(frame, 1)
+	}
+	frame = appendMsgpackString(frame, "size")
+	frame = appendMsgpackUint(frame, uint64(len(messages)))
+
+	err := f.conn.do(func(conn net.Conn) error {
+		if _, err := conn.Write(frame); err != nil {
+			return err
+		}
+		if chunk == "" {
+			return nil
+		}
+		return f.readAck(chunk)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("%s: failed to send messages to fluentd %s - %v", driverName, f.options.address, err)
+	}
+	return len(messages), nil
+}
+
+func (f *fluentdOutput) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conn.disconnect()
+	return nil
+}
+
+// readAck waits for response with the chunk id of the message
+func (f *fluentdOutput) readAck(chunk string) error {
+	response, err := readMsgpack(f.reader)
+	if err != nil {
+		return err
+	}
+	fields, ok := response.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected response %v", response)
+	}
+	if ack := msgpackString(fields["ack"]); ack != chunk {
+		return fmt.Errorf("unexpected ack '%s', expected '%s'", ack, chunk)
+	}
+	return nil
+}
+
+// connect authenticates new connection when shared key is set
+func (f *fluentdOutput) connect(conn net.Conn) error {
+	f.reader = bufio.NewReader(conn)
+	if f.options.sharedKey == "" {
+		return nil
+	}
+
+	helo, err := readMsgpack(f.reader)
+	if err != nil {
+		return err
+	}
+	heloFields, ok := helo.([]interface{})
+	if !ok || len(heloFields) != 2 || msgpackString(heloFields[0]) != "HELO" {
+		return fmt.Errorf("unexpected HELO %v", helo)
+	}
+	heloOptions, _ := heloFields[1].(map[string]interface{})
+	nonce := msgpackString(heloOptions["nonce"])
+	authSalt := msgpackString(heloOptions["auth"])
+
+	salt, err := randomBytes(16)
+	if err != nil {
+		return err
+	}
+	sharedKeySalt := hex.EncodeToString(salt)
+	username, passwordDigest := "", ""
+	if authSalt != "" {
+		username = f.options.username
+		passwordDigest = sha512Hex(authSalt, username, f.options.password)
+	}
+	ping := appendMsgpackArrayHeader(nil, 6)
+	ping = appendMsgpackString(ping, "PING")
+	ping = appendMsgpackString(ping, f.options.selfHostname)
+	ping = appendMsgpackString(ping, sharedKeySalt)
+	ping = appendMsgpackString(ping, sha512Hex(sharedKeySalt, f.options.selfHostname, nonce, f.options.sharedKey))
+	ping = appendMsgpackString(ping, username)
+	ping = appendMsgpackString(ping, passwordDigest)
+	if _, err := conn.Write(ping); err != nil {
+		return err
+	}
+
+	pong, err := readMsgpack(f.reader)
+	if err != nil {
+		return err
+	}
+	pongFields, ok := pong.([]interface{})
+	if !ok || len(pongFields) != 5 || msgpackString(pongFields[0]) != "PONG" {
+		return fmt.Errorf("unexpected PONG %v", pong)
+	}
+	if authenticated, _ := pongFields[1].(bool); !authenticated {
+		return fmt.Errorf("authentication failed: %s", msgpackString(pongFields[2]))
+	}
+	serverHostname := msgpackString(pongFields[3])
+	if msgpackString(pongFields[4]) != sha512Hex(sharedKeySalt, serverHostname, nonce, f.options.sharedKey) {
+		return fmt.Errorf("server %s does not know the shared key", serverHostname)
+	}
+	return nil
+}
+
+func sha512Hex(values ...string) string {
+	hash := sha512.New()
+	for _, value := range values {
+		hash.Write([]byte(value))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
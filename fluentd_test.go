@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// fluentdEvent is one entry of PackedForward message received by the mock
+type fluentdEvent struct {
+	tag    string
+	time   time.Time
+	record map[string]interface{}
+}
+
+// fluentdServerMock accepts forward protocol connections, authenticates them
+// with shared key and acknowledges chunks
+type fluentdServerMock struct {
+	t        *testing.T
+	listener net.Listener
+	events   chan fluentdEvent
+	// Shared key, username and password expected from clients
+	sharedKey string
+	username  string
+	password  string
+	// Connection is closed without ack when this message is read, it is
+	// shared by connections so it is guarded by lock
+	lock        sync.Mutex
+	dropMessage int
+}
+
+func newFluentdServerMock(t *testing.T) *fluentdServerMock {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fluentdServerMock{t: t, listener: listener, events: make(chan fluentdEvent, 100)}
+}
+
+func (s *fluentdServerMock) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fluentdServerMock) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if s.sharedKey != "" && !s.authenticate(conn, reader) {
+		return
+	}
+	for {
+		message, err := readMsgpack(reader)
+		if err != nil {
+			return
+		}
+		if s.drop() {
+			return
+		}
+		fields := message.([]interface{})
+		tag := fields[0].(string)
+		entries := bufio.NewReader(bytes.NewReader(fields[1].([]byte)))
+		for {
+			entry, err := readMsgpack(entries)
+			if err != nil {
+				break
+			}
+			pair := entry.([]interface{})
+			eventTime := pair[0].([]byte)
+			s.events <- fluentdEvent{
+				tag:    tag,
+				time:   time.Unix(int64(binary.BigEndian.Uint32(eventTime[:4])), int64(binary.BigEndian.Uint32(eventTime[4:]))),
+				record: pair[1].(map[string]interface{}),
+			}
+		}
+		option := fields[2].(map[string]interface{})
+		if chunk, ok := option["chunk"]; ok {
+			ack := appendMsgpackMapHeader(nil, 1)
+			ack = appendMsgpackString(ack, "ack")
+			ack = appendMsgpackString(ack, chunk.(string))
+			conn.Write(ack)
+		}
+	}
+}
+
+// drop counts read messages and returns true for the message which closes
+// the connection
+func (s *fluentdServerMock) drop() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.dropMessage == 0 {
+		return false
+	}
+	s.dropMessage--
+	return s.dropMessage == 0
+}
+
+func (s *fluentdServerMock) authenticate(conn net.Conn, reader *bufio.Reader) bool {
+	helo := appendMsgpackArrayHeader(nil, 2)
+	helo = appendMsgpackString(helo, "HELO")
+	helo = appendMsgpackMapHeader(helo, 3)
+	helo = appendMsgpackString(helo, "nonce")
+	helo = appendMsgpackBin(helo, []byte("nonce"))
+	helo = appendMsgpackString(helo, "auth")
+	helo = appendMsgpackString(helo, "authsalt")
+	helo = appendMsgpackString(helo, "keepalive")
+	helo = append(helo, 0xc3)
+	conn.Write(helo)
+
+	message, err := readMsgpack(reader)
+	if err != nil {
+		return false
+	}
+	ping := message.([]interface{})
+	hostname, salt := ping[1].(string), ping[2].(string)
+	authenticated := ping[3].(string) == sha512Hex(salt, hostname, "nonce", s.sharedKey) &&
+		ping[4].(string) == s.username &&
+		ping[5].(string) == sha512Hex("authsalt", s.username, s.password)
+
+	pong := appendMsgpackArrayHeader(nil, 5)
+	pong = appendMsgpackString(pong, "PONG")
+	if authenticated {
+		pong = append(pong, 0xc3)
+		pong = appendMsgpackString(pong, "")
+	} else {
+		pong = append(pong, 0xc2)
+		pong = appendMsgpackString(pong, "invalid key")
+	}
+	pong = appendMsgpackString(pong, "server")
+	pong = appendMsgpackString(pong, sha512Hex(salt, "server", "nonce", s.sharedKey))
+	conn.Write(pong)
+	return authenticated
+}
+
+func (s *fluentdServerMock) receive() fluentdEvent {
+	select {
+	case event := <-s.events:
+		return event
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("Timeout waiting for fluentd event")
+	}
+	return fluentdEvent{}
+}
+
+// Verify that messages are sent with tag and attrs after shared key and user
+// authentication, and acknowledged
+func TestFluentdOutput(t *testing.T) {
+	server := newFluentdServerMock(t)
+	server.sharedKey = "secret"
+	server.username = "user"
+	server.password = "password"
+	defer server.listener.Close()
+	go server.serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkOutputKey:      outputFluentd,
+			fluentdAddressKey:    "tcp://" + server.listener.Addr().String(),
+			fluentdRequireAckKey: "true",
+			fluentdSharedKeyKey:  "secret",
+			fluentdUsernameKey:   "user",
+			fluentdPasswordKey:   "password",
+			splunkHostKey:        "myhost",
+			tagKey:               "docker.{{.ID}}",
+			labelsKey:            "a",
+		},
+		ContainerID:     "containeriid",
+		ContainerName:   "/container_name",
+		ContainerLabels: map[string]string{"a": "b"},
+	}
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Unix(1519905600, 123)
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("first"), Source: "stdout", Timestamp: timestamp}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("second"), Source: "stderr", Timestamp: timestamp}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []struct{ line, source string }{{"first", "stdout"}, {"second", "stderr"}} {
+		event := server.receive()
+		if event.tag != "docker.containeriid" || !event.time.Equal(timestamp) {
+			t.Fatalf("Unexpected event %+v", event)
+		}
+		if event.record["log"] != expected.line ||
+			event.record["source"] != expected.source ||
+			event.record["container_id"] != "containeriid" ||
+			event.record["container_name"] != "container_name" ||
+			event.record["a"] != "b" ||
+			len(event.record) != 5 {
+			t.Fatalf("Unexpected record %v", event.record)
+		}
+	}
+}
+
+// Verify that batch which was not acknowledged is sent again on a new connection
+func TestFluentdOutputResend(t *testing.T) {
+	server := newFluentdServerMock(t)
+	server.dropMessage = 2
+	defer server.listener.Close()
+	go server.serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			fluentdAddressKey:    "tcp://" + server.listener.Addr().String(),
+			fluentdRequireAckKey: "true",
+		},
+	}
+	output, err := newFluentdOutput(context.Background(), info, outputMetadata{host: "myhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+
+	message := &splunkMessage{Event: "first", timestamp: time.Unix(1519905600, 0), stream: "stdout"}
+	if sent, err := output.send([]*splunkMessage{message}, nil); err != nil || sent != 1 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+	// Server closes connection instead of acknowledging the second batch, it
+	// is sent again on a new connection
+	message.Event = "second"
+	if sent, err := output.send([]*splunkMessage{message}, nil); err != nil || sent != 1 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+	for _, line := range []string{"first", "second"} {
+		if event := server.receive(); event.record["log"] != line || event.tag != defaultFluentdTag {
+			t.Fatalf("Unexpected event %+v", event)
+		}
+	}
+}
+
+// Verify that sending fails when server rejects the shared key
+func TestFluentdOutputAuthenticationFailed(t *testing.T) {
+	server := newFluentdServerMock(t)
+	server.sharedKey = "secret"
+	defer server.listener.Close()
+	go server.serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			fluentdAddressKey:   "tcp://" + server.listener.Addr().String(),
+			fluentdSharedKeyKey: "wrong",
+		},
+	}
+	output, err := newFluentdOutput(context.Background(), info, outputMetadata{host: "myhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+
+	message := &splunkMessage{Event: "first", timestamp: time.Unix(1519905600, 0)}
+	if sent, err := output.send([]*splunkMessage{message}, nil); err == nil || sent != 0 {
+		t.Fatalf("Expecting error, got %d, %v", sent, err)
+	}
+}
+
+func TestParseFluentdOptions(t *testing.T) {
+	options, err := parseFluentdOptions(map[string]string{fluentdAddressKey: "tcp+tls://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.address != "example.com:24224" || !options.useTLS || options.requireAck {
+		t.Fatalf("Unexpected options %+v", options)
+	}
+
+	for _, cfg := range []map[string]string{
+		{},
+		{fluentdAddressKey: "udp://example.com"},
+		{fluentdAddressKey: "tcp://example.com", fluentdRequireAckKey: "maybe"},
+		{fluentdAddressKey: "tcp://example.com", fluentdUsernameKey: "user"},
+	} {
+		if _, err := parseFluentdOptions(cfg); err == nil {
+			t.Fatalf("Expecting error for %v", cfg)
+		}
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	long := string(bytes.Repeat([]byte("a"), 300))
+	b := appendMsgpackArrayHeader(nil, 5)
+	b = appendMsgpackString(b, "short")
+	b = appendMsgpackString(b, long)
+	b = appendMsgpackUint(b, 70000)
+	b = appendMsgpackBin(b, []byte{1, 2})
+	b = appendMsgpackMapHeader(b, 1)
+	b = appendMsgpackString(b, "key")
+	b = appendMsgpackUint(b, 5)
+
+	value, err := readMsgpack(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := value.([]interface{})
+	if values[0] != "short" || values[1] != long || values[2] != int64(70000) ||
+		!bytes.Equal(values[3].([]byte), []byte{1, 2}) || values[4].(map[string]interface{})["key"] != int64(5) {
+		t.Fatalf("Unexpected values %v", values)
+	}
+}
@@ -57,6 +57,10 @@ func handlers(h *sdk.Handler, d *driver) {
 	})
 
 	h.HandleFunc("/LogDriver.Capabilities", func(w http.ResponseWriter, r *http.Request) {
+		// Capabilities are reported once for the plugin, not per container, so
+		// reading is always supported. Containers which set splunk-local-store=none
+		// read from the search, without search ReadLogs fails before the stream
+		// starts and docker logs shows the error.
 		json.NewEncoder(w).Encode(&CapabilitiesResponse{
 			Cap: logger.Capability{ReadLogs: true},
 		})
@@ -69,7 +73,8 @@ func handlers(h *sdk.Handler, d *driver) {
 			return
 		}
 
-		stream, err := d.ReadLogs(req.Info, req.Config)
+		// Reading stops when the client goes away
+		stream, err := d.ReadLogs(r.Context(), req.Info, req.Config)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
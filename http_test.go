@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/jsonfilelog"
+	"github.com/docker/go-plugins-helpers/sdk"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+// startTestPlugin serves plugin API of the driver on a local port
+func startTestPlugin(t *testing.T, d *driver) (string, net.Listener) {
+	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
+	handlers(&h, d)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.Serve(listener)
+	return "http://" + listener.Addr().String(), listener
+}
+
+func postReadLogs(ctx context.Context, t *testing.T, url string, info logger.Info, config logger.ReadConfig) *http.Response {
+	body, err := json.Marshal(&ReadLogsRequest{Info: info, Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/LogDriver.ReadLogs", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("Unexpected response %s %s", res.Status, message)
+	}
+	return res
+}
+
+func readLines(t *testing.T, r io.Reader) []string {
+	dec := protoio.NewUint32DelimitedReader(r, binary.BigEndian, 1e6)
+	var lines []string
+	var buf logdriver.LogEntry
+	for {
+		if err := dec.ReadMsg(&buf); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			return lines
+		}
+		lines = append(lines, string(bytes.TrimSuffix(buf.Line, []byte("\n"))))
+		buf.Reset()
+	}
+}
+
+// Verify that ReadLogs of a stopped container honours Since, Until and Tail
+func TestReadLogsStoppedContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunk-logging-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := logger.Info{
+		Config:      map[string]string{},
+		ContainerID: "containeriid",
+		LogPath:     filepath.Join(dir, "containeriid.log"),
+	}
+	jsonl, err := jsonfilelog.New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 5; i++ {
+		msg := &logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: start.Add(time.Duration(i) * time.Minute)}
+		if err := jsonl.Log(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jsonl.Close()
+
+	url, listener := startTestPlugin(t, newDriver())
+	defer listener.Close()
+
+	for _, test := range []struct {
+		config   logger.ReadConfig
+		expected string
+	}{
+		{logger.ReadConfig{Tail: -1}, "[0 1 2 3 4]"},
+		{logger.ReadConfig{Tail: 2}, "[3 4]"},
+		{logger.ReadConfig{Tail: -1, Since: start.Add(2 * time.Minute)}, "[2 3 4]"},
+		{logger.ReadConfig{Tail: -1, Until: start.Add(2 * time.Minute)}, "[0 1 2]"},
+		{logger.ReadConfig{Tail: -1, Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, "[1 2 3]"},
+		// Nothing writes to stopped container, so reading does not follow
+		{logger.ReadConfig{Tail: -1, Follow: true}, "[0 1 2 3 4]"},
+	} {
+		res := postReadLogs(context.Background(), t, url, info, test.config)
+		lines := readLines(t, res.Body)
+		res.Body.Close()
+		if fmt.Sprint(lines) != test.expected {
+			t.Fatalf("Expected %s for %+v, got %v", test.expected, test.config, lines)
+		}
+	}
+}
+
+// Verify that following logs stops when the client goes away
+func TestReadLogsFollowCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunk-logging-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := logger.Info{
+		Config:      map[string]string{},
+		ContainerID: "containeriid",
+		LogPath:     filepath.Join(dir, "containeriid.log"),
+	}
+	jsonl, err := jsonfilelog.New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonl.Close()
+	if err := jsonl.Log(&logger.Message{Line: []byte("first"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDriver()
+	d.idx[info.ContainerID] = newLogPair(jsonl, []*destination{{name: defaultDestinationName, logger: &nopLogger{}}}, nil, nil, info)
+
+	url, listener := startTestPlugin(t, d)
+	defer listener.Close()
+
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := postReadLogs(ctx, t, url, info, logger.ReadConfig{Tail: -1, Follow: true})
+	dec := protoio.NewUint32DelimitedReader(res.Body, binary.BigEndian, 1e6)
+	var buf logdriver.LogEntry
+	if err := dec.ReadMsg(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := jsonl.Log(&logger.Message{Line: []byte("second"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := dec.ReadMsg(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(bytes.TrimSuffix(buf.Line, []byte("\n"))) != "second" {
+		t.Fatalf("Unexpected line %s", buf.Line)
+	}
+
+	cancel()
+	res.Body.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	waitGoroutines(t, goroutines)
+}
+
+// Verify that reading logs of a container without local copy and search fails
+// before the stream starts, with an error which names the option
+func TestReadLogsWithoutLocalStore(t *testing.T) {
+	url, listener := startTestPlugin(t, newDriver())
+	defer listener.Close()
+
+	info := logger.Info{
+		Config:      map[string]string{splunkLocalStoreKey: localStoreNone},
+		ContainerID: "containeriid",
+	}
+	body, err := json.Marshal(&ReadLogsRequest{Info: info, Config: logger.ReadConfig{Tail: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(url+"/LogDriver.ReadLogs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	message, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusInternalServerError || !bytes.Contains(message, []byte(splunkLocalStoreKey+"="+localStoreNone)) {
+		t.Fatalf("Unexpected response %s %s", res.Status, message)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/jsonfilelog"
+	"github.com/docker/docker/daemon/logger/jsonfilelog/jsonlog"
+	"github.com/docker/docker/daemon/logger/local"
+	"github.com/pkg/errors"
+)
+
+const (
+	splunkLocalStoreKey = "splunk-local-store"
+)
+
+// Formats of the local copy of logs, which is used by docker logs
+const (
+	localStoreNone     = "none"
+	localStoreJSONFile = "json-file"
+	localStoreLocal    = "local"
+)
+
+// Options of the local copy, the same as options of json-file and local drivers
+const (
+	localMaxSizeKey  = "max-size"
+	localMaxFileKey  = "max-file"
+	localCompressKey = "compress"
+)
+
+const (
+	// Entries of local format are framed with their size before and after
+	localEntrySizeLen = 4
+	// Same limit as for entries read from the fifo
+	maxLocalEntrySize = 1e6
+)
+
+// Plugin-wide defaults of the local copy, used when container does not set
+// the option
+const (
+	envVarLocalStore    = "SPLUNK_LOGGING_DRIVER_LOCAL_STORE"
+	envVarLocalMaxSize  = "SPLUNK_LOGGING_DRIVER_LOCAL_MAX_SIZE"
+	envVarLocalMaxFile  = "SPLUNK_LOGGING_DRIVER_LOCAL_MAX_FILE"
+	envVarLocalCompress = "SPLUNK_LOGGING_DRIVER_LOCAL_COMPRESS"
+)
+
+var localOptionEnvVars = map[string]string{
+	localMaxSizeKey:  envVarLocalMaxSize,
+	localMaxFileKey:  envVarLocalMaxFile,
+	localCompressKey: envVarLocalCompress,
+}
+
+// defaultLocalStore returns the plugin-wide format of the local copy
+func defaultLocalStore() string {
+	if store := os.Getenv(envVarLocalStore); store != "" {
+		return store
+	}
+	return localStoreJSONFile
+}
+
+// parseLocalStore returns the format of the local copy of the container
+func parseLocalStore(cfg map[string]string) (string, error) {
+	store, ok := cfg[splunkLocalStoreKey]
+	if !ok {
+		store = defaultLocalStore()
+	}
+	switch store {
+	case localStoreNone:
+	case localStoreJSONFile:
+	case localStoreLocal:
+	default:
+		return "", fmt.Errorf("%s: unknown %s '%s', supported values are none, json-file and local", driverName, splunkLocalStoreKey, store)
+	}
+	return store, nil
+}
+
+// localLogInfo returns info for the local logger, with rotation options from
+// plugin env for options which are not set for the container
+func localLogInfo(info logger.Info, store string) logger.Info {
+	config := make(map[string]string, len(info.Config)+len(localOptionEnvVars))
+	for key, value := range info.Config {
+		config[key] = value
+	}
+	for key, envName := range localOptionEnvVars {
+		if _, ok := config[key]; ok {
+			continue
+		}
+		if value := os.Getenv(envName); value != "" {
+			config[key] = value
+		}
+	}
+	info.Config = config
+	info.LogPath = logPath(info, store)
+	return info
+}
+
+// logPath returns path of the local copy, the same for running and stopped
+// containers. Every format has its own file, so changing the format does not
+// mix them.
+func logPath(info logger.Info, store string) string {
+	path := info.LogPath
+	if path == "" {
+		path = filepath.Join("/var/log/docker", info.ContainerID)
+	}
+	if store == localStoreLocal {
+		path += ".local"
+	}
+	return path
+}
+
+// newLocalLogger creates logger of the local copy, or returns nil if the
+// container does not keep local copy
+func newLocalLogger(info logger.Info) (logger.Logger, error) {
+	store, err := parseLocalStore(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	if store == localStoreNone {
+		return nil, nil
+	}
+	info = localLogInfo(info, store)
+	if err := os.MkdirAll(filepath.Dir(info.LogPath), 0755); err != nil {
+		return nil, errors.Wrap(err, "error setting up logger dir")
+	}
+	var l logger.Logger
+	if store == localStoreLocal {
+		l, err = local.New(info)
+	} else {
+		l, err = jsonfilelog.New(info)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating %s logger", store)
+	}
+	return l, nil
+}
+
+// localReader reads the local copy of a stopped container. Unlike loggers of
+// json-file and local formats it never opens files for writing, so reading
+// does not create, truncate or rotate them.
+type localReader struct {
+	path  string
+	store string
+}
+
+// openLocalReader returns reader of the local copy of a stopped container
+func openLocalReader(info logger.Info) (*localReader, error) {
+	store, err := parseLocalStore(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	if store == localStoreNone {
+		return nil, fmt.Errorf("%s: reading logs is not supported with %s=%s", driverName, splunkLocalStoreKey, store)
+	}
+	path := logPath(info, store)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("logger does not exist for %s", info.ContainerID)
+	}
+	return &localReader{path: path, store: store}, nil
+}
+
+// ReadLogs sends messages of all files of the local copy, from the oldest
+// rotated file to the current one, or only the last config.Tail messages.
+// Nothing writes to the files anymore, so there is nothing to follow.
+func (r *localReader) ReadLogs(config logger.ReadConfig) *logger.LogWatcher {
+	watcher := logger.NewLogWatcher()
+	go func() {
+		defer close(watcher.Msg)
+		if err := r.read(watcher, config.Tail); err != nil {
+			watcher.Err <- err
+		}
+	}()
+	return watcher
+}
+
+func (r *localReader) read(watcher *logger.LogWatcher, tail int) error {
+	if tail == 0 {
+		return nil
+	}
+	send := func(msg *logger.Message) bool {
+		select {
+		case watcher.Msg <- msg:
+			return true
+		case <-watcher.WatchConsumerGone():
+			return false
+		}
+	}
+	var last []*logger.Message
+	for _, name := range r.files() {
+		done, err := r.readFile(name, func(msg *logger.Message) bool {
+			if tail < 0 {
+				return send(msg)
+			}
+			last = append(last, msg)
+			if len(last) > tail {
+				last = last[1:]
+			}
+			return true
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	for _, msg := range last {
+		if !send(msg) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// files returns rotated files, the oldest first, and the current file. Files
+// are rotated to path.1, path.2 and so on, compressed files have .gz suffix.
+func (r *localReader) files() []string {
+	var rotated []string
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s.%d", r.path, i)
+		if _, err := os.Stat(name); err != nil {
+			name += ".gz"
+			if _, err := os.Stat(name); err != nil {
+				break
+			}
+		}
+		rotated = append(rotated, name)
+	}
+	files := make([]string, 0, len(rotated)+1)
+	for i := len(rotated) - 1; i >= 0; i-- {
+		files = append(files, rotated[i])
+	}
+	return append(files, r.path)
+}
+
+// readFile passes every message of the file to handle, until handle returns
+// false. Returns true if reading was stopped by handle.
+func (r *localReader) readFile(name string, handle func(msg *logger.Message) bool) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Rotated after the list of files was read
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if filepath.Ext(name) == ".gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return false, errors.Wrapf(err, "error reading %s", name)
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	decode := newJSONFileDecoder(rd)
+	if r.store == localStoreLocal {
+		decode = newLocalDecoder(rd)
+	}
+	for {
+		msg, err := decode()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "error reading %s", name)
+		}
+		if !handle(msg) {
+			return true, nil
+		}
+	}
+}
+
+// messageDecoder returns the next message of the file, or io.EOF after the
+// last one
+type messageDecoder func() (*logger.Message, error)
+
+// newJSONFileDecoder decodes files of json-file format
+func newJSONFileDecoder(rd io.Reader) messageDecoder {
+	dec := json.NewDecoder(rd)
+	return func() (*logger.Message, error) {
+		var entry jsonlog.JSONLog
+		if err := dec.Decode(&entry); err != nil {
+			return nil, err
+		}
+		return &logger.Message{Line: []byte(entry.Log), Source: entry.Stream, Timestamp: entry.Created}, nil
+	}
+}
+
+// newLocalDecoder decodes files of local format. Like the local driver it
+// adds new line to complete messages.
+func newLocalDecoder(rd io.Reader) messageDecoder {
+	header := make([]byte, localEntrySizeLen)
+	return func() (*logger.Message, error) {
+		if _, err := io.ReadFull(rd, header); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxLocalEntrySize {
+			return nil, fmt.Errorf("entry of %d bytes is too large", size)
+		}
+		// Entry and its size after it
+		buf := make([]byte, size+localEntrySizeLen)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		var entry logdriver.LogEntry
+		if err := entry.Unmarshal(buf[:size]); err != nil {
+			return nil, err
+		}
+		msg := &logger.Message{Line: entry.Line, Source: entry.Source, Timestamp: time.Unix(0, entry.TimeNano), PLogMetaData: partialMetaData(&entry)}
+		if msg.PLogMetaData == nil {
+			msg.Line = append(msg.Line, '\n')
+		}
+		return msg, nil
+	}
+}
+
+// validateLocalLogOpt validates the format and rotation options of the local
+// copy with the driver of that format
+func validateLocalLogOpt(cfg map[string]string) error {
+	store, err := parseLocalStore(cfg)
+	if err != nil {
+		return err
+	}
+	options := make(map[string]string)
+	for key := range localOptionEnvVars {
+		if value, ok := cfg[key]; ok {
+			options[key] = value
+		}
+	}
+	switch store {
+	case localStoreJSONFile:
+		return jsonfilelog.ValidateLogOpt(options)
+	case localStoreLocal:
+		return local.ValidateLogOpt(options)
+	}
+	return nil
+}
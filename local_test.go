@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify that rotation options of containers take precedence over plugin env
+func TestLocalLogInfo(t *testing.T) {
+	if err := os.Setenv(envVarLocalMaxSize, "10m"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarLocalMaxSize)
+
+	if err := os.Setenv(envVarLocalMaxFile, "3"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarLocalMaxFile)
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:    "http://127.0.0.1",
+			localMaxFileKey: "5",
+		},
+		ContainerID: "containeriid",
+	}
+
+	local := localLogInfo(info, localStoreJSONFile)
+	if local.Config[localMaxSizeKey] != "10m" ||
+		local.Config[localMaxFileKey] != "5" ||
+		local.Config[splunkURLKey] != "http://127.0.0.1" {
+		t.Fatalf("Unexpected config %v", local.Config)
+	}
+
+	if _, ok := local.Config[localCompressKey]; ok {
+		t.Fatalf("Unexpected %s in config %v", localCompressKey, local.Config)
+	}
+
+	if local.LogPath != "/var/log/docker/containeriid" {
+		t.Fatalf("Unexpected log path %s", local.LogPath)
+	}
+
+	if _, ok := info.Config[localMaxSizeKey]; ok {
+		t.Fatal("Config of the container should not be modified")
+	}
+}
+
+// Verify that format of the local copy is validated and used
+func TestLocalStore(t *testing.T) {
+	if err := ValidateLogOpt(map[string]string{splunkLocalStoreKey: "journald"}); err == nil {
+		t.Fatal("Expecting error for unknown format of local copy")
+	}
+
+	dir, err := ioutil.TempDir("", "splunk-logging-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkLocalStoreKey: localStoreNone,
+		},
+		ContainerID: "containeriid",
+		LogPath:     filepath.Join(dir, "containeriid.log"),
+	}
+
+	l, err := newLocalLogger(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != nil {
+		t.Fatal("Local copy should not be kept")
+	}
+
+	d := newDriver()
+	if _, err := d.ReadLogs(context.Background(), info, logger.ReadConfig{Tail: -1}); err == nil {
+		t.Fatal("Expecting error when reading logs without local copy")
+	}
+
+	info.Config[splunkLocalStoreKey] = localStoreLocal
+	l, err = newLocalLogger(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Log(&logger.Message{Line: []byte("line"), Source: "stdout"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(info.LogPath + ".local"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(info.LogPath); err == nil {
+		t.Fatal("Json file should not be created")
+	}
+
+	r, err := d.ReadLogs(context.Background(), info, logger.ReadConfig{Tail: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+}
+
+// Verify that local copy of a stopped container is read from rotated files
+// without modifying them
+func TestLocalReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunk-logging-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, store := range []string{localStoreJSONFile, localStoreLocal} {
+		info := logger.Info{
+			Config: map[string]string{
+				splunkLocalStoreKey: store,
+			},
+			ContainerID: "containeriid",
+			LogPath:     filepath.Join(dir, store+".log"),
+		}
+		path := logPath(info, store)
+
+		// Write 3 files with 2 lines each, like the driver rotates them
+		for i, name := range []string{path + ".2", path + ".1", path} {
+			l, err := newLocalLogger(info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 2; j++ {
+				line := fmt.Sprintf("%d", i*2+j)
+				if err := l.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if name != path {
+				if err := os.Rename(path, name); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		// The oldest file is compressed
+		data, err := ioutil.ReadFile(path + ".2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(data)
+		gz.Close()
+		if err := ioutil.WriteFile(path+".2.gz", compressed.Bytes(), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(path + ".2"); err != nil {
+			t.Fatal(err)
+		}
+		before, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := openLocalReader(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tail := range []int{-1, 3, 0} {
+			watcher := reader.ReadLogs(logger.ReadConfig{Tail: tail})
+			var lines []string
+			for msg := range watcher.Msg {
+				lines = append(lines, string(msg.Line))
+			}
+			select {
+			case err := <-watcher.Err:
+				t.Fatal(err)
+			default:
+			}
+			expected := []string{"0\n", "1\n", "2\n", "3\n", "4\n", "5\n"}
+			if tail >= 0 {
+				expected = expected[len(expected)-tail:]
+			}
+			if fmt.Sprint(lines) != fmt.Sprint(expected) {
+				t.Fatalf("Unexpected lines of %s with tail %d %q", store, tail, lines)
+			}
+		}
+
+		after, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(before) != len(after) {
+			t.Fatalf("Files should not be created, got %d files, expected %d", len(after), len(before))
+		}
+		for i := range before {
+			if before[i].Name() != after[i].Name() || before[i].Size() != after[i].Size() || !before[i].ModTime().Equal(after[i].ModTime()) {
+				t.Fatalf("File %s should not be modified", before[i].Name())
+			}
+		}
+	}
+}
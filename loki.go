@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/pkg/urlutil"
+)
+
+const (
+	lokiURLKey          = "loki-url"
+	lokiFormatKey       = "loki-format"
+	lokiLabelsKey       = "loki-labels"
+	lokiDockerLabelsKey = "loki-docker-labels"
+	lokiTenantIDKey     = "loki-tenant-id"
+)
+
+const (
+	lokiFormatProtobuf = "protobuf"
+	lokiFormatJSON     = "json"
+)
+
+const (
+	// Path of the push API when loki-url does not have one
+	lokiPushPath = "/loki/api/v1/push"
+	// Labels of streams when loki-labels is not set
+	defaultLokiLabels = "container_name,stream"
+)
+
+// Labels which can be selected with loki-labels
+const (
+	lokiLabelContainerName = "container_name"
+	lokiLabelContainerID   = "container_id"
+	lokiLabelImageName     = "image_name"
+	lokiLabelStream        = "stream"
+	lokiLabelHost          = "host"
+	lokiLabelTag           = "tag"
+)
+
+// lokiOptions are parsed loki-* options
+type lokiOptions struct {
+	pushURL      *url.URL
+	format       string
+	labels       []string
+	dockerLabels []string
+	tenantID     string
+}
+
+// parseLokiOptions validates loki-* options
+func parseLokiOptions(cfg map[string]string) (*lokiOptions, error) {
+	urlStr, ok := cfg[lokiURLKey]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is expected with %s=%s", driverName, lokiURLKey, splunkOutputKey, outputLoki)
+	}
+	pushURL, err := url.Parse(urlStr)
+	if err != nil || !urlutil.IsURL(urlStr) || !pushURL.IsAbs() {
+		return nil, fmt.Errorf("%s: expected format scheme://dns_name_or_ip:port for %s", driverName, lokiURLKey)
+	}
+	if pushURL.Path == "" || pushURL.Path == "/" {
+		pushURL.Path = lokiPushPath
+	}
+	options := &lokiOptions{
+		pushURL:  pushURL,
+		format:   lokiFormatProtobuf,
+		tenantID: cfg[lokiTenantIDKey],
+	}
+
+	if format, ok := cfg[lokiFormatKey]; ok {
+		switch format {
+		case lokiFormatProtobuf:
+		case lokiFormatJSON:
+		default:
+			return nil, fmt.Errorf("%s: unknown %s '%s', supported values are protobuf and json", driverName, lokiFormatKey, format)
+		}
+		options.format = format
+	}
+
+	labels, ok := cfg[lokiLabelsKey]
+	if !ok {
+		labels = defaultLokiLabels
+	}
+	for _, label := range splitList(labels) {
+		switch label {
+		case lokiLabelContainerName:
+		case lokiLabelContainerID:
+		case lokiLabelImageName:
+		case lokiLabelStream:
+		case lokiLabelHost:
+		case lokiLabelTag:
+		default:
+			return nil, fmt.Errorf("%s: unknown label '%s' in %s", driverName, label, lokiLabelsKey)
+		}
+		options.labels = append(options.labels, label)
+	}
+	options.dockerLabels = splitList(cfg[lokiDockerLabelsKey])
+	if len(options.labels) == 0 && len(options.dockerLabels) == 0 {
+		return nil, fmt.Errorf("%s: streams need at least one label, set %s or %s", driverName, lokiLabelsKey, lokiDockerLabelsKey)
+	}
+	return options, nil
+}
+
+// splitList returns not empty items of comma separated list
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// lokiOutput pushes every batch in one request, messages are grouped into
+// streams by labels. Entries rejected by Loki, like out of order entries, are
+// written to the dead-letter file, rate limited and failed requests are
+// retried.
+type lokiOutput struct {
+	target  *hecTarget
+	options *lokiOptions
+	// Labels of the container, without stream label
+	labels      map[string]string
+	streamLabel bool
+	// Labels of stdout, stderr and messages without stream, the map is not
+	// changed after the output is created, so it can be used concurrently
+	streamLabels map[string]*lokiLabels
+}
+
+// lokiLabels is label set of a stream
+type lokiLabels struct {
+	values map[string]string
+	// Labels in LogQL selector format, like {container_name="web", stream="stdout"}
+	encoded string
+}
+
+// lokiStream is entries of a batch with the same labels
+type lokiStream struct {
+	labels  *lokiLabels
+	entries []*splunkMessage
+}
+
+func newLokiOutput(ctx context.Context, info logger.Info, metadata outputMetadata) (*lokiOutput, error) {
+	options, err := parseLokiOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := parseTLSConfig(info)
+	if err != nil {
+		return nil, err
+	}
+	gzipCompression, gzipCompressionLevel, err := parseGzipOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &hecTarget{
+		ctx:         ctx,
+		url:         options.pushURL.String(),
+		contentType: "application/x-protobuf",
+	}
+	// Protobuf requests are always compressed with snappy
+	if options.format == lokiFormatJSON {
+		target.contentType = "application/json"
+		target.gzipCompression = gzipCompression
+		target.gzipCompressionLevel = gzipCompressionLevel
+	}
+	if options.tenantID != "" {
+		target.headers = map[string]string{"X-Scope-OrgID": options.tenantID}
+	}
+	target.transport = newHTTPTransport(tlsConfig)
+	target.client = &http.Client{
+		Transport: target.transport,
+	}
+
+	values := map[string]string{
+		lokiLabelContainerName: info.Name(),
+		lokiLabelContainerID:   info.ContainerID,
+		lokiLabelImageName:     info.ContainerImageName,
+		lokiLabelHost:          metadata.host,
+		lokiLabelTag:           metadata.tag,
+	}
+	l := &lokiOutput{
+		target:       target,
+		options:      options,
+		labels:       make(map[string]string),
+		streamLabels: make(map[string]*lokiLabels),
+	}
+	for _, label := range options.labels {
+		if label == lokiLabelStream {
+			l.streamLabel = true
+		} else if value := values[label]; value != "" {
+			l.labels[label] = value
+		}
+	}
+	for _, label := range options.dockerLabels {
+		if value, ok := info.ContainerLabels[label]; ok && value != "" {
+			l.labels[lokiLabelName(label)] = value
+		}
+	}
+	for _, stream := range []string{"stdout", "stderr", ""} {
+		l.streamLabels[stream] = l.newLabels(stream)
+	}
+	return l, nil
+}
+
+// lokiLabelName replaces characters which are not allowed in label names
+func lokiLabelName(name string) string {
+	label := []byte(name)
+	for i, c := range label {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			label[i] = '_'
+		}
+	}
+	return string(label)
+}
+
+// labelsOf returns labels of the stream of the message
+func (l *lokiOutput) labelsOf(stream string) *lokiLabels {
+	if labels, ok := l.streamLabels[stream]; ok {
+		return labels
+	}
+	return l.newLabels(stream)
+}
+
+func (l *lokiOutput) newLabels(stream string) *lokiLabels {
+	values := make(map[string]string, len(l.labels)+1)
+	for name, value := range l.labels {
+		values[name] = value
+	}
+	if l.streamLabel && stream != "" {
+		values[lokiLabelStream] = stream
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[name])
+	}
+	return &lokiLabels{values: values, encoded: "{" + strings.Join(pairs, ", ") + "}"}
+}
+
+func (l *lokiOutput) send(messages []*splunkMessage, reject func(messages []*splunkMessage, reason string, status int)) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	// Loki rejects entries older than the last entry of the stream, so
+	// entries of every stream are sorted
+	var streams []*lokiStream
+	index := make(map[string]*lokiStream)
+	for _, message := range messages {
+		labels := l.labelsOf(message.stream)
+		stream, ok := index[labels.encoded]
+		if !ok {
+			stream = &lokiStream{labels: labels}
+			index[labels.encoded] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, message)
+	}
+	for _, stream := range streams {
+		entries := stream.entries
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].timestamp.Before(entries[j].timestamp)
+		})
+	}
+
+	var body []byte
+	if l.options.format == lokiFormatJSON {
+		var err error
+		body, err = l.encodeJSON(streams)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		body = snappyEncode(l.encodeProto(streams))
+	}
+
+	err := l.target.postBody(body, nil)
+	if err == nil {
+		return len(messages), nil
+	}
+	sendErr, ok := err.(*sendError)
+	if !ok {
+		return 0, err
+	}
+	switch sendErr.statusCode {
+	case http.StatusBadRequest:
+		// Loki accepts valid entries of the request and responds with 400 for
+		// entries it will never accept, like out of order entries. The response
+		// lists ignored entries only as text, so all entries are rejected and
+		// written to the dead-letter file with the response as the reason. They
+		// are counted as dropped, although some of them were indexed, and
+		// replaying the dead-letter file duplicates those entries.
+		reason, status := dropReason(sendErr)
+		reject(messages, reason, status)
+		return len(messages), nil
+	case http.StatusTooManyRequests:
+		return 0, fmt.Errorf("%s: Loki is rate limiting, %d messages will be retried - %s", driverName, len(messages), bytes.TrimSpace(sendErr.body))
+	}
+	return 0, err
+}
+
+func (l *lokiOutput) close() error {
+	l.target.transport.CloseIdleConnections()
+	return nil
+}
+
+// encodeProto returns logproto.PushRequest with the streams
+func (l *lokiOutput) encodeProto(streams []*lokiStream) []byte {
+	var request []byte
+	for _, stream := range streams {
+		encoded := appendProtoString(nil, 1, stream.labels.encoded)
+		for _, entry := range stream.entries {
+			// google.protobuf.Timestamp
+			var timestamp []byte
+			timestamp = appendProtoKey(timestamp, 1, protoWireVarint)
+			timestamp = appendProtoVarint(timestamp, uint64(entry.timestamp.Unix()))
+			timestamp = appendProtoKey(timestamp, 2, protoWireVarint)
+			timestamp = appendProtoVarint(timestamp, uint64(entry.timestamp.Nanosecond()))
+
+			var encodedEntry []byte
+			encodedEntry = appendProtoBytes(encodedEntry, 1, timestamp)
+			encodedEntry = appendProtoString(encodedEntry, 2, messageLine(entry))
+			encoded = appendProtoBytes(encoded, 2, encodedEntry)
+		}
+		request = appendProtoBytes(request, 1, encoded)
+	}
+	return request
+}
+
+// encodeJSON returns push request in JSON format, timestamps are nanoseconds
+// as strings
+func (l *lokiOutput) encodeJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		values := make([][2]string, len(stream.entries))
+		for i, entry := range stream.entries {
+			values[i] = [2]string{strconv.FormatInt(entry.timestamp.UnixNano(), 10), messageLine(entry)}
+		}
+		request.Streams = append(request.Streams, jsonStream{stream.labels.values, values})
+	}
+	return json.Marshal(&request)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// snappyDecode decodes snappy block format
+func snappyDecode(t *testing.T, src []byte) []byte {
+	length, n := binary.Uvarint(src)
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			literal := int(tag >> 2)
+			src = src[1:]
+			if literal >= 60 {
+				size := literal - 59
+				var buf [4]byte
+				copy(buf[:], src[:size])
+				literal = int(binary.LittleEndian.Uint32(buf[:]))
+				src = src[size:]
+			}
+			dst = append(dst, src[:literal+1]...)
+			src = src[literal+1:]
+			continue
+		case 1:
+			t.Fatal("Unexpected copy with 1 byte offset")
+		case 2:
+			offset := int(binary.LittleEndian.Uint16(src[1:]))
+			for i := 0; i <= int(tag>>2); i++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+			src = src[3:]
+		case 3:
+			t.Fatal("Unexpected copy with 4 byte offset")
+		}
+	}
+	if uint64(len(dst)) != length {
+		t.Fatalf("Decoded %d bytes, expected %d", len(dst), length)
+	}
+	return dst
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("abc"),
+		bytes.Repeat([]byte("container_name=web stream=stdout "), 100),
+		bytes.Repeat([]byte("a"), 100000),
+	} {
+		encoded := snappyEncode(data)
+		if decoded := snappyDecode(t, encoded); !bytes.Equal(decoded, data) {
+			t.Fatalf("Unexpected decoded data of %d bytes", len(data))
+		}
+		if len(data) > 1000 && len(encoded) > len(data)/5 {
+			t.Fatalf("Data of %d bytes is compressed to %d bytes", len(data), len(encoded))
+		}
+	}
+}
+
+// lokiMock records push requests and responds with status
+type lokiMock struct {
+	t        *testing.T
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (m *lokiMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		reader = gzipReader
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, r)
+	m.bodies = append(m.bodies, body)
+	if m.status != 0 {
+		w.WriteHeader(m.status)
+		w.Write([]byte("entry out of order\n"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func lokiTestInfo(url string) logger.Info {
+	return logger.Info{
+		Config: map[string]string{
+			splunkOutputKey:     outputLoki,
+			lokiURLKey:          url,
+			lokiLabelsKey:       "container_name,image_name,stream",
+			lokiDockerLabelsKey: "com.example.team",
+			lokiTenantIDKey:     "tenant",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageName: "container_image_name",
+		ContainerLabels:    map[string]string{"com.example.team": "dev"},
+	}
+}
+
+func logLokiMessages(t *testing.T, info logger.Info) {
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Unix(1519905600, 0)
+	for _, message := range []*logger.Message{
+		{Line: []byte("second"), Source: "stdout", Timestamp: base.Add(time.Second)},
+		{Line: []byte("error"), Source: "stderr", Timestamp: base},
+		{Line: []byte("first"), Source: "stdout", Timestamp: base.Add(5)},
+	} {
+		if err := loggerDriver.Log(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that messages are pushed as snappy compressed protobuf, grouped by
+// labels and sorted by time
+func TestLokiOutputProtobuf(t *testing.T) {
+	mock := &lokiMock{t: t}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	logLokiMessages(t, lokiTestInfo(server.URL))
+
+	if len(mock.requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(mock.requests))
+	}
+	request := mock.requests[0]
+	if request.URL.Path != lokiPushPath ||
+		request.Header.Get("Content-Type") != "application/x-protobuf" ||
+		request.Header.Get("X-Scope-OrgID") != "tenant" {
+		t.Fatalf("Unexpected request %s %v", request.URL, request.Header)
+	}
+
+	pushRequest := snappyDecode(t, mock.bodies[0])
+	streams := protoFields(t, pushRequest, 1)
+	expected := []struct {
+		labels string
+		lines  []string
+		nanos  []uint64
+	}{
+		{`{com_example_team="dev", container_name="container_name", image_name="container_image_name", stream="stdout"}`, []string{"first", "second"}, []uint64{5, 0}},
+		{`{com_example_team="dev", container_name="container_name", image_name="container_image_name", stream="stderr"}`, []string{"error"}, []uint64{0}},
+	}
+	if len(streams) != len(expected) {
+		t.Fatalf("Expected %d streams, got %d", len(expected), len(streams))
+	}
+	for i, stream := range streams {
+		if labels := string(protoFields(t, stream.data, 1)[0].data); labels != expected[i].labels {
+			t.Fatalf("Unexpected labels %s", labels)
+		}
+		entries := protoFields(t, stream.data, 2)
+		if len(entries) != len(expected[i].lines) {
+			t.Fatalf("Unexpected entries of %s", expected[i].labels)
+		}
+		for j, entry := range entries {
+			timestamp := protoFields(t, entry.data, 1)[0].data
+			var nanos uint64
+			if fields := protoFields(t, timestamp, 2); len(fields) > 0 {
+				nanos = fields[0].value
+			}
+			if line := string(protoFields(t, entry.data, 2)[0].data); line != expected[i].lines[j] || nanos != expected[i].nanos[j] {
+				t.Fatalf("Unexpected entry %s at %d", line, nanos)
+			}
+		}
+	}
+}
+
+// Verify that JSON push requests are compressed with gzip
+func TestLokiOutputJSON(t *testing.T) {
+	mock := &lokiMock{t: t}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	info := lokiTestInfo(server.URL + "/custom/push")
+	info.Config[lokiFormatKey] = lokiFormatJSON
+	info.Config[lokiLabelsKey] = "container_name"
+	info.Config[splunkGzipCompressionKey] = "true"
+	logLokiMessages(t, info)
+
+	request := mock.requests[0]
+	if request.URL.Path != "/custom/push" ||
+		request.Header.Get("Content-Type") != "application/json" ||
+		request.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Unexpected request %s %v", request.URL, request.Header)
+	}
+	var pushRequest struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(mock.bodies[0], &pushRequest); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushRequest.Streams) != 1 {
+		t.Fatalf("Unexpected streams %s", mock.bodies[0])
+	}
+	stream := pushRequest.Streams[0]
+	expectedValues := [][2]string{
+		{"1519905600000000000", "error"},
+		{"1519905600000000005", "first"},
+		{"1519905601000000000", "second"},
+	}
+	if !reflect.DeepEqual(stream.Stream, map[string]string{"container_name": "container_name", "com_example_team": "dev"}) ||
+		!reflect.DeepEqual(stream.Values, expectedValues) {
+		t.Fatalf("Unexpected stream %s", mock.bodies[0])
+	}
+}
+
+// Verify that rejected entries are written to dead letters and rate limited
+// requests are retried
+func TestLokiOutputRejected(t *testing.T) {
+	mock := &lokiMock{t: t, status: http.StatusBadRequest}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	info := lokiTestInfo(server.URL)
+	rejected := &deadLetterRecorder{}
+	output, err := newLokiOutput(context.Background(), info, outputMetadata{host: "myhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+
+	messages := []*splunkMessage{{Event: "old", timestamp: time.Unix(1519905600, 0), stream: "stdout"}}
+	if sent, err := output.send(messages, rejected.deadLetter); err != nil || sent != 1 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+	if len(rejected.messages) != 1 || rejected.statuses[0] != http.StatusBadRequest {
+		t.Fatalf("Expected rejected message in dead letters, got %v %v", rejected.messages, rejected.statuses)
+	}
+
+	mock.mu.Lock()
+	mock.status = http.StatusTooManyRequests
+	mock.mu.Unlock()
+	if sent, err := output.send(messages, rejected.deadLetter); err == nil || sent != 0 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+
+	mock.mu.Lock()
+	mock.status = 0
+	mock.mu.Unlock()
+	if sent, err := output.send(messages, rejected.deadLetter); err != nil || sent != 1 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+}
+
+// Verify that entries of a request rejected with 400 are counted as dropped,
+// not as sent
+func TestLokiOutputRejectedStats(t *testing.T) {
+	mock := &lokiMock{t: t, status: http.StatusBadRequest}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	info := lokiTestInfo(server.URL)
+	info.ContainerID = "lokirejected"
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := loggerDriver.(*splunkLoggerInline)
+	for _, line := range []string{"first", "second"} {
+		if err := l.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := l.stats.snapshot(); stats.sent != 0 || stats.dropped != 2 {
+		t.Fatalf("Unexpected stats %v", l.stats.fields())
+	}
+}
+
+func TestParseLokiOptions(t *testing.T) {
+	options, err := parseLokiOptions(map[string]string{lokiURLKey: "http://loki:3100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.pushURL.String() != "http://loki:3100"+lokiPushPath || options.format != lokiFormatProtobuf ||
+		!reflect.DeepEqual(options.labels, []string{lokiLabelContainerName, lokiLabelStream}) {
+		t.Fatalf("Unexpected options %+v", options)
+	}
+
+	for _, cfg := range []map[string]string{
+		{},
+		{lokiURLKey: "loki:3100"},
+		{lokiURLKey: "http://loki:3100", lokiFormatKey: "xml"},
+		{lokiURLKey: "http://loki:3100", lokiLabelsKey: "unknown"},
+		{lokiURLKey: "http://loki:3100", lokiLabelsKey: ""},
+	} {
+		if _, err := parseLokiOptions(cfg); err == nil {
+			t.Fatalf("Expecting error for %v", cfg)
+		}
+	}
+
+	if name := lokiLabelName("com.example/team-1"); name != "com_example_team_1" {
+		t.Fatalf("Unexpected label name %s", name)
+	}
+}
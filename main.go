@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/sdk"
@@ -29,8 +31,27 @@ func main() {
 		os.Exit(1)
 	}
 
+	d := newDriver()
 	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
-	handlers(&h, newDriver())
+	handlers(&h, d)
+
+	// Docker sends SIGTERM when plugin is disabled or upgraded, flush all
+	// loggers before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		timeout := shutdownTimeout()
+		logrus.WithField("signal", sig).WithField("timeout", timeout).Info("Shutting down, flushing loggers")
+		report := d.shutdown(timeout)
+		if report.lost > 0 {
+			logrus.WithFields(report.fields()).Error("Shut down, some messages are lost")
+		} else {
+			logrus.WithFields(report.fields()).Info("Shut down, all messages are flushed")
+		}
+		os.Exit(0)
+	}()
+
 	if err := h.ServeUnix(socketAddress, 0); err != nil {
 		panic(err)
 	}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Names of the container metadata fields which can be selected with
+// splunk-metadata
+const (
+	metadataContainerID         = "container_id"
+	metadataContainerName       = "container_name"
+	metadataContainerImageName  = "container_image_name"
+	metadataContainerImageID    = "container_image_id"
+	metadataContainerCreated    = "container_created"
+	metadataContainerEntrypoint = "container_entrypoint"
+	metadataContainerArgs       = "container_args"
+	metadataDaemonName          = "daemon_name"
+	// Selects all of the fields above
+	metadataAll = "all"
+)
+
+var metadataFields = map[string]func(info logger.Info) string{
+	metadataContainerID: func(info logger.Info) string {
+		return info.ContainerID
+	},
+	metadataContainerName: func(info logger.Info) string {
+		return info.Name()
+	},
+	metadataContainerImageName: func(info logger.Info) string {
+		return info.ContainerImageName
+	},
+	metadataContainerImageID: func(info logger.Info) string {
+		return info.ContainerImageID
+	},
+	metadataContainerCreated: func(info logger.Info) string {
+		if info.ContainerCreated.IsZero() {
+			return ""
+		}
+		return info.ContainerCreated.UTC().Format(time.RFC3339Nano)
+	},
+	metadataContainerEntrypoint: func(info logger.Info) string {
+		return info.ContainerEntrypoint
+	},
+	metadataContainerArgs: func(info logger.Info) string {
+		return strings.Join(info.ContainerArgs, " ")
+	},
+	metadataDaemonName: func(info logger.Info) string {
+		return info.DaemonName
+	},
+}
+
+// parseMetadataFields returns the list of metadata fields selected with
+// splunk-metadata, validating that every one of them is known
+func parseMetadataFields(fieldsStr string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(fieldsStr, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if field == metadataAll {
+			for name := range metadataFields {
+				fields = append(fields, name)
+			}
+			continue
+		}
+		if _, ok := metadataFields[field]; !ok {
+			return nil, fmt.Errorf("%s: unknown field '%s' in %s", driverName, field, splunkMetadataKey)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// containerMetadata returns the values of the container metadata fields selected
+// with splunk-metadata. Empty values are skipped. Container id is always added
+// when search fallback is enabled, so events of the container can be found.
+func containerMetadata(info logger.Info) (map[string]string, error) {
+	fields, err := parseMetadataFields(info.Config[splunkMetadataKey])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := info.Config[splunkSearchURLKey]; ok {
+		fields = append(fields, metadataContainerID)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	metadata := make(map[string]string, len(fields))
+	for _, field := range fields {
+		if value := metadataFields[field](info); value != "" {
+			metadata[field] = value
+		}
+	}
+	return metadata, nil
+}
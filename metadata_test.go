@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify selected container metadata is attached to inline events
+func TestInlineFormatWithMetadata(t *testing.T) {
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	created := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:      hec.URL(),
+			splunkTokenKey:    hec.token,
+			splunkMetadataKey: "container_name,container_image_name,container_created,container_args,daemon_name",
+			labelsKey:         "a",
+		},
+		ContainerID:         "containeriid",
+		ContainerName:       "/container_name",
+		ContainerImageID:    "contaimageid",
+		ContainerImageName:  "container_image_name",
+		ContainerCreated:    created,
+		ContainerEntrypoint: "/bin/sh",
+		ContainerArgs:       []string{"-c", "echo"},
+		ContainerLabels: map[string]string{
+			"a": "b",
+		},
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("1"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 1 {
+		t.Fatal("Expected one message")
+	}
+
+	if event, err := hec.messages[0].EventAsMap(); err != nil {
+		t.Fatal(err)
+	} else {
+		attrs := event["attrs"].(map[string]interface{})
+		if attrs["a"] != "b" ||
+			attrs[metadataContainerName] != "container_name" ||
+			attrs[metadataContainerImageName] != "container_image_name" ||
+			attrs[metadataContainerCreated] != "2018-01-02T03:04:05Z" ||
+			attrs[metadataContainerArgs] != "-c echo" ||
+			len(attrs) != 5 {
+			t.Fatalf("Unexpected attrs in message %v", attrs)
+		}
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify container metadata is added to the raw prefix
+func TestRawFormatWithMetadata(t *testing.T) {
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:      hec.URL(),
+			splunkTokenKey:    hec.token,
+			splunkFormatKey:   splunkFormatRaw,
+			splunkMetadataKey: metadataContainerImageID,
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	splunkLoggerDriver, ok := loggerDriver.(*splunkLoggerRaw)
+	if !ok {
+		t.Fatal("Unexpected Splunk Logging Driver type")
+	}
+
+	if string(splunkLoggerDriver.prefix) != "containeriid container_image_id=contaimageid " {
+		t.Fatalf("Unexpected prefix %s", splunkLoggerDriver.prefix)
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify all fields can be selected and unknown fields are rejected
+func TestParseMetadataFields(t *testing.T) {
+	fields, err := parseMetadataFields(metadataAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != len(metadataFields) {
+		t.Fatalf("Expected all fields, got %v", fields)
+	}
+
+	if _, err := parseMetadataFields("container_name,unknown"); err == nil {
+		t.Fatal("Expecting error on unknown metadata field")
+	}
+
+	if err := ValidateLogOpt(map[string]string{splunkMetadataKey: "unknown"}); err == nil {
+		t.Fatal("Expecting error on unknown metadata field when container is created")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// MessagePack encoding of the types used by fluentd forward protocol
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xdc, byte(n>>8), byte(n))
+	}
+	return append(b, 0xdd, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xde, byte(n>>8), byte(n))
+	}
+	return append(b, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xc5, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xc6, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, data...)
+}
+
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return append(b, 0xcd, byte(v>>8), byte(v))
+	case v <= math.MaxUint32:
+		return append(b, 0xce, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	b = append(b, 0xcf)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// appendMsgpackEventTime appends fluentd EventTime, extension type 0 with
+// seconds and nanoseconds
+func appendMsgpackEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(buf[4:], uint32(t.Nanosecond()))
+	return append(b, buf[:]...)
+}
+
+// readMsgpack decodes one value. Maps are returned as map[string]interface{},
+// str as string, bin as []byte, integers as int64 and extensions as []byte.
+func readMsgpack(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		return readMsgpackBytes(r, int(c&0x1f), true)
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := readMsgpackLength(r, c-0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, n, false)
+	case 0xd9, 0xda, 0xdb:
+		n, err := readMsgpackLength(r, c-0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, n, true)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := readMsgpackUint(r, 1<<(c-0xcc))
+		return int64(v), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := readMsgpackUint(r, size)
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	case 0xca:
+		v, err := readMsgpackUint(r, 4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := readMsgpackUint(r, 8)
+		return math.Float64frombits(v), err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackLength(r, c-0xdc+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n)
+	case 0xde, 0xdf:
+		n, err := readMsgpackLength(r, c-0xde+1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// Fixed size extension, type is skipped
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, 1<<(c-0xd4), false)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackLength(r, c-0xc7)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(r, n, false)
+	}
+	return nil, fmt.Errorf("unexpected msgpack type 0x%x", c)
+}
+
+// readMsgpackLength reads length of 1, 2 or 4 bytes selected by sizeIndex 0, 1 or 2
+func readMsgpackLength(r *bufio.Reader, sizeIndex byte) (int, error) {
+	v, err := readMsgpackUint(r, 1<<sizeIndex)
+	return int(v), err
+}
+
+func readMsgpackUint(r *bufio.Reader, size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func readMsgpackBytes(r *bufio.Reader, n int, str bool) (interface{}, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if str {
+		return string(data), nil
+	}
+	return data, nil
+}
+
+func readMsgpackArray(r *bufio.Reader, n int) ([]interface{}, error) {
+	values := make([]interface{}, n)
+	for i := range values {
+		value, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n int) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		values[msgpackString(key)] = value
+	}
+	return values, nil
+}
+
+// msgpackString returns str or bin value as string, fluentd implementations
+// use both for the same fields
+func msgpackString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
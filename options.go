@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	splunkPostMessagesFrequencyKey = "splunk-post-messages-frequency"
+	splunkPostMessagesBatchSizeKey = "splunk-post-messages-batch-size"
+	splunkBufferMaximumKey         = "splunk-buffer-max"
+	splunkChannelSizeKey           = "splunk-channel-size"
+	splunkStrictOrderingKey        = "splunk-strict-ordering"
+)
+
+// batchingOptions control how messages of one logger are buffered and sent.
+// Plugin-wide defaults come from SPLUNK_LOGGING_DRIVER_* env variables and can
+// be overridden for every container with log-opts.
+type batchingOptions struct {
+	postMessagesFrequency time.Duration
+	postMessagesBatchSize int
+	bufferMaximum         int
+	streamChannelSize     int
+	// Batches are sent one at a time in order, even if several requests are
+	// allowed to be in flight
+	strictOrdering bool
+}
+
+// defaultBatchingOptions reads plugin-wide values from env. Invalid values are
+// reported to the plugin log and replaced with defaults, so a misconfigured
+// plugin still starts.
+func defaultBatchingOptions() batchingOptions {
+	options := batchingOptions{
+		postMessagesFrequency: getAdvancedOptionDuration(envVarPostMessagesFrequency, defaultPostMessagesFrequency),
+		postMessagesBatchSize: getAdvancedOptionInt(envVarPostMessagesBatchSize, defaultPostMessagesBatchSize),
+		bufferMaximum:         getAdvancedOptionInt(envVarBufferMaximum, defaultBufferMaximum),
+		streamChannelSize:     getAdvancedOptionInt(envVarStreamChannelSize, defaultStreamChannelSize),
+		strictOrdering:        getAdvancedOptionBool(envVarStrictOrdering, false),
+	}
+	if options.postMessagesFrequency <= 0 {
+		logrus.Error(fmt.Sprintf("Value of %s should be positive. Using default %v.", envVarPostMessagesFrequency, defaultPostMessagesFrequency))
+		options.postMessagesFrequency = defaultPostMessagesFrequency
+	}
+	if options.postMessagesBatchSize < 1 {
+		logrus.Error(fmt.Sprintf("Value of %s should be at least 1. Using default %d.", envVarPostMessagesBatchSize, defaultPostMessagesBatchSize))
+		options.postMessagesBatchSize = defaultPostMessagesBatchSize
+	}
+	if options.bufferMaximum < 1 {
+		logrus.Error(fmt.Sprintf("Value of %s should be at least 1. Using default %d.", envVarBufferMaximum, defaultBufferMaximum))
+		options.bufferMaximum = defaultBufferMaximum
+	}
+	if options.streamChannelSize < 0 {
+		logrus.Error(fmt.Sprintf("Value of %s should not be negative. Using default %d.", envVarStreamChannelSize, defaultStreamChannelSize))
+		options.streamChannelSize = defaultStreamChannelSize
+	}
+	return options
+}
+
+// parseBatchingOptions returns plugin-wide batching options overridden with
+// log-opts of the container. Unlike env variables, invalid log-opts are errors.
+func parseBatchingOptions(cfg map[string]string) (batchingOptions, error) {
+	options := defaultBatchingOptions()
+
+	if value, ok := cfg[splunkPostMessagesFrequencyKey]; ok {
+		frequency, err := time.ParseDuration(value)
+		if err != nil {
+			return options, fmt.Errorf("%s: failed to parse value of %s as duration: %v", driverName, splunkPostMessagesFrequencyKey, err)
+		}
+		if frequency <= 0 {
+			return options, fmt.Errorf("%s: value of %s should be positive, got %s", driverName, splunkPostMessagesFrequencyKey, value)
+		}
+		options.postMessagesFrequency = frequency
+	}
+
+	var err error
+	if options.postMessagesBatchSize, err = parseOptionInt(cfg, splunkPostMessagesBatchSizeKey, 1, options.postMessagesBatchSize); err != nil {
+		return options, err
+	}
+	if options.bufferMaximum, err = parseOptionInt(cfg, splunkBufferMaximumKey, 1, options.bufferMaximum); err != nil {
+		return options, err
+	}
+	if options.streamChannelSize, err = parseOptionInt(cfg, splunkChannelSizeKey, 0, options.streamChannelSize); err != nil {
+		return options, err
+	}
+	if value, ok := cfg[splunkStrictOrderingKey]; ok {
+		if options.strictOrdering, err = strconv.ParseBool(value); err != nil {
+			return options, fmt.Errorf("%s: failed to parse value of %s as boolean: %v", driverName, splunkStrictOrderingKey, err)
+		}
+	}
+	return options, nil
+}
+
+// parseOptionInt returns the value of the log-opt key, or defaultValue if it is
+// not set. Values less than min are errors.
+func parseOptionInt(cfg map[string]string, key string, min int, defaultValue int) (int, error) {
+	value, ok := cfg[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	parsedValue, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s: failed to parse value of %s as integer: %v", driverName, key, err)
+	}
+	if int(parsedValue) < min {
+		return 0, fmt.Errorf("%s: value of %s should be at least %d, got %s", driverName, key, min, value)
+	}
+	return int(parsedValue), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify that invalid batching options are rejected
+func TestValidateBatchingOptions(t *testing.T) {
+	for _, cfg := range []map[string]string{
+		{splunkPostMessagesFrequencyKey: "often"},
+		{splunkPostMessagesFrequencyKey: "0s"},
+		{splunkPostMessagesBatchSizeKey: "a"},
+		{splunkPostMessagesBatchSizeKey: "0"},
+		{splunkBufferMaximumKey: "-1"},
+		{splunkChannelSizeKey: "-1"},
+	} {
+		if err := ValidateLogOpt(cfg); err == nil {
+			t.Fatalf("Expecting error for %v", cfg)
+		}
+	}
+
+	if err := ValidateLogOpt(map[string]string{splunkChannelSizeKey: "0"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that log-opts override env variables and invalid log-opts fail New
+func TestBatchingOptionsOverrideEnv(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	if err := os.Setenv(envVarPostMessagesBatchSize, "2"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarBufferMaximum, "0"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarBufferMaximum)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:                   hec.URL(),
+			splunkTokenKey:                 hec.token,
+			splunkPostMessagesBatchSizeKey: "5",
+			splunkChannelSizeKey:           "7",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	splunkLoggerDriver, ok := loggerDriver.(*splunkLoggerInline)
+	if !ok {
+		t.Fatal("Unexpected Splunk Logging Driver type")
+	}
+
+	if splunkLoggerDriver.postMessagesFrequency != 10*time.Hour ||
+		splunkLoggerDriver.postMessagesBatchSize != 5 ||
+		splunkLoggerDriver.bufferMaximum != defaultBufferMaximum ||
+		cap(splunkLoggerDriver.stream) != 7 {
+		t.Fatalf("Values from log-opts and env are not used: %v, %v, %v, %v",
+			splunkLoggerDriver.postMessagesFrequency,
+			splunkLoggerDriver.postMessagesBatchSize,
+			splunkLoggerDriver.bufferMaximum,
+			cap(splunkLoggerDriver.stream))
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := loggerDriver.Log(&logger.Message{Line: []byte("line"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One batch of 5, not batches of 2 from env
+	if hec.numOfRequests != 2 {
+		t.Fatalf("Unexpected number of requests %d", hec.numOfRequests)
+	}
+
+	info.Config[splunkBufferMaximumKey] = "none"
+	if _, err := New(info); err == nil {
+		t.Fatal("Expecting error for invalid log-opt")
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Supported values of splunk-orchestrator
+const (
+	orchestratorNone       = "none"
+	orchestratorAuto       = "auto"
+	orchestratorSwarm      = "swarm"
+	orchestratorKubernetes = "kubernetes"
+)
+
+// Well-known labels set on containers by Docker Swarm
+const (
+	swarmServiceNameLabel = "com.docker.swarm.service.name"
+	swarmTaskNameLabel    = "com.docker.swarm.task.name"
+	swarmNodeIDLabel      = "com.docker.swarm.node.id"
+	swarmStackLabel       = "com.docker.stack.namespace"
+)
+
+// Well-known labels set on containers by Kubernetes (dockershim). Pod labels
+// are copied to the container, so the recommended app labels are available too.
+const (
+	kubernetesPodNameLabel      = "io.kubernetes.pod.name"
+	kubernetesPodNamespaceLabel = "io.kubernetes.pod.namespace"
+	kubernetesAppNameLabel      = "app.kubernetes.io/name"
+	kubernetesAppLabel          = "app"
+)
+
+// orchestratorInfo holds normalized fields derived from the orchestrator labels
+// of the container. Fields are exported so they can be used in templates.
+type orchestratorInfo struct {
+	Orchestrator string
+	Service      string
+	Task         string
+	Node         string
+	Pod          string
+	Namespace    string
+}
+
+// detectOrchestrator derives orchestrator fields from container labels, based
+// on the mode selected with splunk-orchestrator. When the mode is not set or
+// the container does not run under an orchestrator all fields are empty.
+func detectOrchestrator(info logger.Info) (*orchestratorInfo, error) {
+	mode, ok := info.Config[splunkOrchestratorKey]
+	if !ok {
+		mode = orchestratorNone
+	}
+
+	o := &orchestratorInfo{}
+	labels := info.ContainerLabels
+
+	switch mode {
+	case orchestratorNone:
+		return o, nil
+	case orchestratorAuto, orchestratorSwarm, orchestratorKubernetes:
+	default:
+		return nil, fmt.Errorf("%s: unknown orchestrator '%s' for %s, supported values are none, auto, swarm, and kubernetes",
+			driverName, mode, splunkOrchestratorKey)
+	}
+
+	if (mode == orchestratorAuto || mode == orchestratorSwarm) && labels[swarmServiceNameLabel] != "" {
+		o.Orchestrator = orchestratorSwarm
+		o.Service = labels[swarmServiceNameLabel]
+		o.Task = labels[swarmTaskNameLabel]
+		o.Node = labels[swarmNodeIDLabel]
+		o.Namespace = labels[swarmStackLabel]
+	} else if (mode == orchestratorAuto || mode == orchestratorKubernetes) && labels[kubernetesPodNameLabel] != "" {
+		o.Orchestrator = orchestratorKubernetes
+		o.Pod = labels[kubernetesPodNameLabel]
+		o.Namespace = labels[kubernetesPodNamespaceLabel]
+		o.Service = labels[kubernetesAppNameLabel]
+		if o.Service == "" {
+			o.Service = labels[kubernetesAppLabel]
+		}
+	}
+
+	return o, nil
+}
+
+// fields returns not empty normalized fields, which are attached to events
+func (o *orchestratorInfo) fields() map[string]string {
+	fields := make(map[string]string)
+	if o.Orchestrator == "" {
+		return fields
+	}
+	fields["orchestrator"] = o.Orchestrator
+	for key, value := range map[string]string{
+		"service":   o.Service,
+		"task":      o.Task,
+		"node":      o.Node,
+		"pod":       o.Pod,
+		"namespace": o.Namespace,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify swarm labels are recognized and usable in index and sourcetype
+func TestOrchestratorSwarm(t *testing.T) {
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:          hec.URL(),
+			splunkTokenKey:        hec.token,
+			splunkOrchestratorKey: orchestratorAuto,
+			splunkIndexKey:        "{{.Namespace}}",
+			splunkSourceTypeKey:   "docker:{{.Service}}",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+		ContainerLabels: map[string]string{
+			swarmServiceNameLabel: "web",
+			swarmTaskNameLabel:    "web.1.abc",
+			swarmNodeIDLabel:      "node1",
+			swarmStackLabel:       "shop",
+		},
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("1"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 1 {
+		t.Fatal("Expected one message")
+	}
+
+	message := hec.messages[0]
+	if message.Index != "shop" ||
+		message.SourceType != "docker:web" {
+		t.Fatalf("Unexpected values of message %v", message)
+	}
+
+	if event, err := message.EventAsMap(); err != nil {
+		t.Fatal(err)
+	} else {
+		attrs := event["attrs"].(map[string]interface{})
+		if attrs["orchestrator"] != orchestratorSwarm ||
+			attrs["service"] != "web" ||
+			attrs["task"] != "web.1.abc" ||
+			attrs["node"] != "node1" ||
+			attrs["namespace"] != "shop" ||
+			len(attrs) != 5 {
+			t.Fatalf("Unexpected attrs in message %v", attrs)
+		}
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify kubernetes labels are recognized
+func TestOrchestratorKubernetes(t *testing.T) {
+	info := logger.Info{
+		Config: map[string]string{
+			splunkOrchestratorKey: orchestratorKubernetes,
+		},
+		ContainerLabels: map[string]string{
+			kubernetesPodNameLabel:      "web-5d4f",
+			kubernetesPodNamespaceLabel: "default",
+			kubernetesAppLabel:          "web",
+			swarmServiceNameLabel:       "ignored",
+		},
+	}
+
+	o, err := detectOrchestrator(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Orchestrator != orchestratorKubernetes ||
+		o.Pod != "web-5d4f" ||
+		o.Namespace != "default" ||
+		o.Service != "web" ||
+		o.Task != "" {
+		t.Fatalf("Unexpected orchestrator fields %v", o)
+	}
+}
+
+// Verify orchestrator fields are not derived unless enabled
+func TestOrchestratorDisabled(t *testing.T) {
+	info := logger.Info{
+		Config: map[string]string{},
+		ContainerLabels: map[string]string{
+			swarmServiceNameLabel: "web",
+		},
+	}
+
+	o, err := detectOrchestrator(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.fields()) != 0 {
+		t.Fatalf("Unexpected orchestrator fields %v", o)
+	}
+
+	info.Config[splunkOrchestratorKey] = "mesos"
+	if _, err := detectOrchestrator(info); err == nil {
+		t.Fatal("Expecting error on unknown orchestrator")
+	}
+}
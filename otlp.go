@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/pkg/urlutil"
+)
+
+const (
+	otlpEndpointKey = "otlp-endpoint"
+	otlpProtocolKey = "otlp-protocol"
+	otlpHeadersKey  = "otlp-headers"
+)
+
+// Encodings of OTLP over HTTP, named like OTEL_EXPORTER_OTLP_PROTOCOL values
+const (
+	otlpProtocolProtobuf = "http/protobuf"
+	otlpProtocolJSON     = "http/json"
+)
+
+const (
+	// Path of the logs endpoint when otlp-endpoint does not have one
+	otlpLogsPath = "/v1/logs"
+	// Instrumentation scope of all log records
+	otlpScopeName = "splunk-log-plugin"
+)
+
+// Severity numbers of stdout and stderr records
+const (
+	otlpSeverityInfo  = 9
+	otlpSeverityError = 17
+)
+
+// otlpOutput sends batches of messages to OTLP/HTTP logs endpoint, every
+// batch is one export request
+type otlpOutput struct {
+	target   *hecTarget
+	protocol string
+	resource otlpResource
+}
+
+func newOTLPOutput(ctx context.Context, info logger.Info, metadata outputMetadata) (*otlpOutput, error) {
+	endpoint, protocol, headers, err := parseOTLPOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := parseTLSConfig(info)
+	if err != nil {
+		return nil, err
+	}
+	gzipCompression, gzipCompressionLevel, err := parseGzipOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := "application/x-protobuf"
+	if protocol == otlpProtocolJSON {
+		contentType = "application/json"
+	}
+	transport := newHTTPTransport(tlsConfig)
+	return &otlpOutput{
+		target: &hecTarget{
+			ctx:                    ctx,
+			postMessagesBatchBytes: getAdvancedOptionInt(envVarPostMessagesBatchBytes, defaultPostMessagesBatchBytes),
+			client: &http.Client{
+				Transport: transport,
+			},
+			transport:            transport,
+			url:                  endpoint.String(),
+			contentType:          contentType,
+			headers:              headers,
+			gzipCompression:      gzipCompression,
+			gzipCompressionLevel: gzipCompressionLevel,
+		},
+		protocol: protocol,
+		resource: otlpResource{Attributes: otlpResourceAttributes(info, metadata)},
+	}, nil
+}
+
+// parseOTLPOptions validates otlp-endpoint, otlp-protocol and otlp-headers
+func parseOTLPOptions(cfg map[string]string) (*url.URL, string, map[string]string, error) {
+	endpointStr, ok := cfg[otlpEndpointKey]
+	if !ok {
+		return nil, "", nil, fmt.Errorf("%s: %s is expected with %s=%s", driverName, otlpEndpointKey, splunkOutputKey, outputOTLP)
+	}
+	endpoint, err := url.Parse(endpointStr)
+	if err != nil || !urlutil.IsURL(endpointStr) || !endpoint.IsAbs() {
+		return nil, "", nil, fmt.Errorf("%s: expected format scheme://dns_name_or_ip:port for %s", driverName, otlpEndpointKey)
+	}
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = otlpLogsPath
+	}
+
+	protocol := otlpProtocolProtobuf
+	if protocolStr, ok := cfg[otlpProtocolKey]; ok {
+		switch protocolStr {
+		case otlpProtocolProtobuf:
+		case otlpProtocolJSON:
+		default:
+			return nil, "", nil, fmt.Errorf("%s: unknown %s '%s', supported values are http/protobuf and http/json", driverName, otlpProtocolKey, protocolStr)
+		}
+		protocol = protocolStr
+	}
+
+	var headers map[string]string
+	if headersStr, ok := cfg[otlpHeadersKey]; ok {
+		headers = make(map[string]string)
+		for _, header := range strings.Split(headersStr, ",") {
+			if strings.TrimSpace(header) == "" {
+				continue
+			}
+			parts := strings.SplitN(header, "=", 2)
+			key := strings.TrimSpace(parts[0])
+			if len(parts) != 2 || key == "" {
+				return nil, "", nil, fmt.Errorf("%s: expected format key=value,key=value for %s", driverName, otlpHeadersKey)
+			}
+			headers[key] = strings.TrimSpace(parts[1])
+		}
+	}
+	return endpoint, protocol, headers, nil
+}
+
+// otlpResourceAttributes describes the container with semantic conventions,
+// and keeps index, source and sourcetype under the names Splunk HEC exporter
+// of the collector uses. Extra attributes are added as they are.
+func otlpResourceAttributes(info logger.Info, metadata outputMetadata) []otlpKeyValue {
+	var attributes []otlpKeyValue
+	add := func(key, value string) {
+		if value != "" {
+			attributes = append(attributes, otlpKeyValue{key, otlpAnyValue{value}})
+		}
+	}
+	add("container.id", info.ContainerID)
+	add("container.name", info.Name())
+	add("container.image.name", info.ContainerImageName)
+	add("host.name", metadata.host)
+	add("com.splunk.index", metadata.index)
+	add("com.splunk.source", metadata.source)
+	add("com.splunk.sourcetype", metadata.sourceType)
+	keys := make([]string, 0, len(metadata.attrs))
+	for key := range metadata.attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(key, metadata.attrs[key])
+	}
+	return attributes
+}
+
+// send posts messages in export requests not bigger than limit of the
+// endpoint. Batches are split like HEC target does, single message which is
+// too large is never accepted and is rejected.
+func (o *otlpOutput) send(messages []*splunkMessage, reject func(messages []*splunkMessage, reason string, status int)) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+	body, err := o.encodeRequest(messages)
+	if err != nil {
+		return 0, err
+	}
+	if len(body) > o.target.maxBatchBytes() && len(messages) > 1 {
+		return o.sendHalves(messages, reject)
+	}
+	err = o.target.postBody(body, nil)
+	if err == nil {
+		return len(messages), nil
+	}
+	if !isRequestTooLarge(err) {
+		return 0, err
+	}
+	if len(messages) == 1 {
+		reason, status := dropReason(err)
+		reject(messages, reason, status)
+		return 1, nil
+	}
+	o.target.learnMaxBatchBytes(len(body))
+	return o.sendHalves(messages, reject)
+}
+
+func (o *otlpOutput) sendHalves(messages []*splunkMessage, reject func(messages []*splunkMessage, reason string, status int)) (int, error) {
+	middle := len(messages) / 2
+	sent, err := o.send(messages[:middle], reject)
+	if err != nil {
+		return sent, err
+	}
+	n, err := o.send(messages[middle:], reject)
+	return sent + n, err
+}
+
+func (o *otlpOutput) close() error {
+	o.target.transport.CloseIdleConnections()
+	return nil
+}
+
+// encodeRequest returns export request with one resource and one scope
+func (o *otlpOutput) encodeRequest(messages []*splunkMessage) ([]byte, error) {
+	observed := uint64(time.Now().UnixNano())
+	records := make([]otlpLogRecord, len(messages))
+	for i, message := range messages {
+		records[i] = otlpLogRecord{
+			TimeUnixNano:         uint64(message.timestamp.UnixNano()),
+			ObservedTimeUnixNano: observed,
+			SeverityNumber:       otlpSeverityInfo,
+			SeverityText:         "INFO",
+			Body:                 otlpAnyValue{messageLine(message)},
+		}
+		if message.stream == "stderr" {
+			records[i].SeverityNumber = otlpSeverityError
+			records[i].SeverityText = "ERROR"
+		}
+		if message.stream != "" {
+			records[i].Attributes = []otlpKeyValue{{"log.iostream", otlpAnyValue{message.stream}}}
+		}
+	}
+	request := otlpLogsRequest{
+		ResourceLogs: []otlpResourceLogs{{
+			Resource: o.resource,
+			ScopeLogs: []otlpScopeLogs{{
+				Scope:      otlpScope{Name: otlpScopeName},
+				LogRecords: records,
+			}},
+		}},
+	}
+	if o.protocol == otlpProtocolJSON {
+		return json.Marshal(&request)
+	}
+	return request.appendProto(nil), nil
+}
+
+// Messages of ExportLogsServiceRequest, only fields set by the plugin are
+// declared. JSON encoding follows OTLP/JSON, protobuf field numbers follow
+// opentelemetry-proto.
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         uint64         `json:"timeUnixNano,string"`
+	ObservedTimeUnixNano uint64         `json:"observedTimeUnixNano,string"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func (r *otlpLogsRequest) appendProto(b []byte) []byte {
+	for i := range r.ResourceLogs {
+		b = appendProtoBytes(b, 1, r.ResourceLogs[i].appendProto(nil))
+	}
+	return b
+}
+
+func (r *otlpResourceLogs) appendProto(b []byte) []byte {
+	b = appendProtoBytes(b, 1, r.Resource.appendProto(nil))
+	for i := range r.ScopeLogs {
+		b = appendProtoBytes(b, 2, r.ScopeLogs[i].appendProto(nil))
+	}
+	return b
+}
+
+func (r *otlpResource) appendProto(b []byte) []byte {
+	for i := range r.Attributes {
+		b = appendProtoBytes(b, 1, r.Attributes[i].appendProto(nil))
+	}
+	return b
+}
+
+func (s *otlpScopeLogs) appendProto(b []byte) []byte {
+	b = appendProtoBytes(b, 1, appendProtoString(nil, 1, s.Scope.Name))
+	for i := range s.LogRecords {
+		b = appendProtoBytes(b, 2, s.LogRecords[i].appendProto(nil))
+	}
+	return b
+}
+
+func (r *otlpLogRecord) appendProto(b []byte) []byte {
+	b = appendProtoFixed64(b, 1, r.TimeUnixNano)
+	b = appendProtoKey(b, 2, protoWireVarint)
+	b = appendProtoVarint(b, uint64(r.SeverityNumber))
+	b = appendProtoString(b, 3, r.SeverityText)
+	b = appendProtoBytes(b, 5, r.Body.appendProto(nil))
+	for i := range r.Attributes {
+		b = appendProtoBytes(b, 6, r.Attributes[i].appendProto(nil))
+	}
+	return appendProtoFixed64(b, 11, r.ObservedTimeUnixNano)
+}
+
+func (kv *otlpKeyValue) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, kv.Key)
+	return appendProtoBytes(b, 2, kv.Value.appendProto(nil))
+}
+
+func (v *otlpAnyValue) appendProto(b []byte) []byte {
+	// Empty string is still a string value, so it is always written
+	return appendProtoBytes(b, 1, []byte(v.StringValue))
+}
+
+// Protobuf wire types used by OTLP messages
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+)
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoKey(b []byte, field int, wireType int) []byte {
+	return appendProtoVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendProtoKey(b, field, protoWireBytes)
+	b = appendProtoVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendProtoString skips empty strings like proto3 encoders do
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoBytes(b, field, []byte(s))
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = appendProtoKey(b, field, protoWireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// otlpCollectorMock records bodies of export requests, and fails the first
+// failures requests. Bodies larger than maxBody are rejected with 413.
+type otlpCollectorMock struct {
+	t        *testing.T
+	mu       sync.Mutex
+	failures int
+	maxBody  int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (c *otlpCollectorMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = gzipReader
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, r)
+	if len(c.requests) <= c.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if c.maxBody > 0 && len(body) > c.maxBody {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	c.bodies = append(c.bodies, body)
+}
+
+func (c *otlpCollectorMock) received() ([]*http.Request, [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests, c.bodies
+}
+
+// protoField is one field of protobuf message
+type protoField struct {
+	number int
+	value  uint64
+	data   []byte
+}
+
+// readProtoFields decodes fields of protobuf message, nested messages are
+// returned as bytes
+func readProtoFields(t *testing.T, b []byte) []protoField {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		field := protoField{number: int(key >> 3)}
+		switch key & 7 {
+		case protoWireVarint:
+			field.value, n = binary.Uvarint(b)
+			b = b[n:]
+		case protoWireFixed64:
+			field.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protoWireBytes:
+			length, n := binary.Uvarint(b)
+			b = b[n:]
+			field.data = b[:length]
+			b = b[length:]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// protoFields returns fields with the number
+func protoFields(t *testing.T, b []byte, number int) []protoField {
+	var fields []protoField
+	for _, field := range readProtoFields(t, b) {
+		if field.number == number {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// protoAttributes returns key-value pairs of repeated KeyValue field
+func protoAttributes(t *testing.T, b []byte, number int) map[string]string {
+	attributes := make(map[string]string)
+	for _, kv := range protoFields(t, b, number) {
+		key := string(protoFields(t, kv.data, 1)[0].data)
+		value := protoFields(t, protoFields(t, kv.data, 2)[0].data, 1)[0].data
+		attributes[key] = string(value)
+	}
+	return attributes
+}
+
+func otlpTestInfo(endpoint string) logger.Info {
+	return logger.Info{
+		Config: map[string]string{
+			splunkOutputKey: outputOTLP,
+			otlpEndpointKey: endpoint,
+			otlpHeadersKey:  "Authorization=Bearer secret, X-Scope=tenant",
+			splunkHostKey:   "myhost",
+			splunkIndexKey:  "myindex",
+			labelsKey:       "a",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageName: "container_image_name",
+		ContainerLabels:    map[string]string{"a": "b"},
+	}
+}
+
+// Verify that messages are exported as protobuf with container in resource
+// and stream in log record attributes
+func TestOTLPOutputProtobuf(t *testing.T) {
+	collector := &otlpCollectorMock{t: t}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	loggerDriver, err := New(otlpTestInfo(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Unix(1519905600, 5)
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("first"), Source: "stdout", Timestamp: timestamp}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("second"), Source: "stderr", Timestamp: timestamp}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, bodies := collector.received()
+	if len(bodies) != 1 {
+		t.Fatalf("Expected one request, got %d", len(bodies))
+	}
+	request := requests[0]
+	if request.URL.Path != otlpLogsPath ||
+		request.Header.Get("Content-Type") != "application/x-protobuf" ||
+		request.Header.Get("Authorization") != "Bearer secret" ||
+		request.Header.Get("X-Scope") != "tenant" {
+		t.Fatalf("Unexpected request %s %v", request.URL, request.Header)
+	}
+
+	resourceLogs := protoFields(t, bodies[0], 1)
+	if len(resourceLogs) != 1 {
+		t.Fatalf("Unexpected resource logs %v", resourceLogs)
+	}
+	resource := protoFields(t, resourceLogs[0].data, 1)[0].data
+	attributes := protoAttributes(t, resource, 1)
+	expected := map[string]string{
+		"container.id":         "containeriid",
+		"container.name":       "container_name",
+		"container.image.name": "container_image_name",
+		"host.name":            "myhost",
+		"com.splunk.index":     "myindex",
+		"a":                    "b",
+	}
+	if len(attributes) != len(expected) {
+		t.Fatalf("Unexpected resource attributes %v", attributes)
+	}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Fatalf("Unexpected resource attributes %v", attributes)
+		}
+	}
+
+	scopeLogs := protoFields(t, resourceLogs[0].data, 2)[0].data
+	if scope := protoFields(t, scopeLogs, 1)[0].data; string(protoFields(t, scope, 1)[0].data) != otlpScopeName {
+		t.Fatalf("Unexpected scope %q", scope)
+	}
+	records := protoFields(t, scopeLogs, 2)
+	if len(records) != 2 {
+		t.Fatalf("Expected two log records, got %d", len(records))
+	}
+	for i, line := range []string{"first", "second"} {
+		record := records[i].data
+		if protoFields(t, record, 1)[0].value != uint64(timestamp.UnixNano()) {
+			t.Fatalf("Unexpected time of %s", line)
+		}
+		if body := protoFields(t, record, 5)[0].data; string(protoFields(t, body, 1)[0].data) != line {
+			t.Fatalf("Unexpected body %q", body)
+		}
+		severity := protoFields(t, record, 2)[0].value
+		stream := protoAttributes(t, record, 6)["log.iostream"]
+		if (i == 0 && (severity != otlpSeverityInfo || stream != "stdout")) ||
+			(i == 1 && (severity != otlpSeverityError || stream != "stderr")) {
+			t.Fatalf("Unexpected severity %d and stream %s of %s", severity, stream, line)
+		}
+		if protoFields(t, record, 11)[0].value == 0 {
+			t.Fatalf("Observed time is not set for %s", line)
+		}
+	}
+}
+
+// Verify that JSON export requests are compressed and retried like HEC requests
+func TestOTLPOutputJSONRetry(t *testing.T) {
+	collector := &otlpCollectorMock{t: t, failures: 1}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	if err := os.Setenv(envVarPostMessagesFrequency, "10ms"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	info := otlpTestInfo(server.URL + "/custom/logs")
+	info.Config[otlpProtocolKey] = otlpProtocolJSON
+	info.Config[splunkGzipCompressionKey] = "true"
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Log(&logger.Message{Line: []byte(`{"a":"b"}`), Source: "stdout", Timestamp: time.Unix(1519905600, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if _, bodies := collector.received(); len(bodies) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := loggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, bodies := collector.received()
+	if len(requests) != 2 || len(bodies) != 1 {
+		t.Fatalf("Expected failed and retried request, got %d requests", len(requests))
+	}
+	if requests[1].URL.Path != "/custom/logs" ||
+		requests[1].Header.Get("Content-Type") != "application/json" ||
+		requests[1].Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Unexpected request %s %v", requests[1].URL, requests[1].Header)
+	}
+
+	var request otlpLogsRequest
+	if err := json.Unmarshal(bodies[0], &request); err != nil {
+		t.Fatal(err)
+	}
+	record := request.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if record.Body.StringValue != `{"a":"b"}` || record.TimeUnixNano != 1519905600000000000 || record.SeverityText != "INFO" {
+		t.Fatalf("Unexpected log record %+v", record)
+	}
+	var raw map[string][]map[string]interface{}
+	if err := json.Unmarshal(bodies[0], &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["resourceLogs"][0]["scopeLogs"]; !ok {
+		t.Fatalf("Unexpected request %s", bodies[0])
+	}
+}
+
+// Verify that batches are split by batch bytes before they are sent, and that
+// a message which is too large is counted as dropped and not as sent
+func TestOTLPOutputBatchBytes(t *testing.T) {
+	collector := &otlpCollectorMock{t: t, maxBody: 1000}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	if err := os.Setenv(envVarPostMessagesBatchBytes, "1000"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchBytes)
+
+	info := otlpTestInfo(server.URL)
+	info.ContainerID = "otlpbatchbytes"
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := loggerDriver.(*splunkLoggerInline)
+	for i := 0; i < 10; i++ {
+		line := strings.Repeat(strconv.Itoa(i), 200)
+		if i == 5 {
+			line = strings.Repeat("x", 2000)
+		}
+		if err := l.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests, bodies := collector.received()
+	if len(requests) != len(bodies)+1 {
+		t.Fatalf("Expected only the large message to be rejected, got %d requests and %d bodies", len(requests), len(bodies))
+	}
+	records := 0
+	for _, body := range bodies {
+		for _, resourceLogs := range protoFields(t, body, 1) {
+			for _, scopeLogs := range protoFields(t, resourceLogs.data, 2) {
+				records += len(protoFields(t, scopeLogs.data, 2))
+			}
+		}
+	}
+	if records != 9 {
+		t.Fatalf("Expected 9 exported records, got %d", records)
+	}
+	if stats := l.stats.snapshot(); stats.sent != 9 || stats.dropped != 1 {
+		t.Fatalf("Unexpected stats %v", l.stats.fields())
+	}
+}
+
+func TestParseOTLPOptions(t *testing.T) {
+	endpoint, protocol, headers, err := parseOTLPOptions(map[string]string{otlpEndpointKey: "https://collector:4318"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.String() != "https://collector:4318/v1/logs" || protocol != otlpProtocolProtobuf || headers != nil {
+		t.Fatalf("Unexpected options %s %s %v", endpoint, protocol, headers)
+	}
+
+	for _, cfg := range []map[string]string{
+		{},
+		{otlpEndpointKey: "collector:4318"},
+		{otlpEndpointKey: "http://collector:4318", otlpProtocolKey: "grpc"},
+		{otlpEndpointKey: "http://collector:4318", otlpHeadersKey: "novalue"},
+	} {
+		if _, _, _, err := parseOTLPOptions(cfg); err == nil {
+			t.Fatalf("Expecting error for %v", cfg)
+		}
+	}
+}
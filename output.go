@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	splunkOutputKey = "splunk-output"
+)
+
+// Destinations messages can be sent to. Batching and buffering of splunkLogger
+// is the same for all of them, only delivery of a batch is different.
+const (
+	outputHEC     = "hec"
+	outputSyslog  = "syslog"
+	outputOTLP    = "otlp"
+	outputFluentd = "fluentd"
+	// Elasticsearch and OpenSearch share the bulk API
+	outputElasticsearch = "elasticsearch"
+	outputLoki          = "loki"
+)
+
+// messageOutput delivers batches of messages to a destination other than HEC
+type messageOutput interface {
+	// send delivers messages in order and returns number of messages
+	// delivered or rejected before error. Messages the destination rejected
+	// and which are never retried are passed to reject with the reason and
+	// HTTP status of the rejection. Outputs which deliver messages partially
+	// move delivered and rejected messages to the front of messages.
+	send(messages []*splunkMessage, reject func(messages []*splunkMessage, reason string, status int)) (int, error)
+	// close releases connections, it is called after the last send
+	close() error
+}
+
+// outputMetadata is what outputs need to know about the container to describe
+// its messages
+type outputMetadata struct {
+	host       string
+	source     string
+	sourceType string
+	index      string
+	tag        string
+	attrs      map[string]string
+}
+
+// parseOutput returns the destination selected with splunk-output
+func parseOutput(cfg map[string]string) (string, error) {
+	output, ok := cfg[splunkOutputKey]
+	if !ok {
+		return outputHEC, nil
+	}
+	switch output {
+	case outputHEC:
+	case outputSyslog:
+	case outputOTLP:
+	case outputFluentd:
+	case outputElasticsearch:
+	case outputLoki:
+	default:
+		return "", fmt.Errorf("%s: unknown %s '%s', supported values are hec, syslog, otlp, fluentd, elasticsearch and loki", driverName, splunkOutputKey, output)
+	}
+	return output, nil
+}
+
+// newMessageOutput creates output selected with splunk-output. Sending is
+// aborted when ctx is cancelled.
+func newMessageOutput(ctx context.Context, name string, info logger.Info, metadata outputMetadata) (messageOutput, error) {
+	switch name {
+	case outputSyslog:
+		return newSyslogOutput(ctx, info, metadata)
+	case outputOTLP:
+		return newOTLPOutput(ctx, info, metadata)
+	case outputFluentd:
+		return newFluentdOutput(ctx, info, metadata)
+	case outputElasticsearch:
+		return newElasticsearchOutput(ctx, info, metadata)
+	case outputLoki:
+		return newLokiOutput(ctx, info, metadata)
+	}
+	return nil, fmt.Errorf("%s: unexpected output %s", driverName, name)
+}
+
+// validateOutputLogOpt validates options of the selected output
+func validateOutputLogOpt(cfg map[string]string) error {
+	name, err := parseOutput(cfg)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case outputSyslog:
+		_, err = parseSyslogOptions(cfg)
+	case outputOTLP:
+		_, _, _, err = parseOTLPOptions(cfg)
+	case outputFluentd:
+		_, err = parseFluentdOptions(cfg)
+	case outputElasticsearch:
+		err = validateElasticsearchOptions(cfg)
+	case outputLoki:
+		_, err = parseLokiOptions(cfg)
+	}
+	return err
+}
+
+// messageLine returns text of the message as it would be indexed by Splunk,
+// without HEC fields around it
+func messageLine(message *splunkMessage) string {
+	switch event := message.Event.(type) {
+	case string:
+		return event
+	case *json.RawMessage:
+		return string(*event)
+	case *splunkMessageEvent:
+		switch line := event.Line.(type) {
+		case string:
+			return line
+		case *json.RawMessage:
+			return string(*line)
+		}
+	}
+	encoded, _ := json.Marshal(message.Event)
+	return string(encoded)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/backend"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	// Number of messages queued for every sink of a container
+	defaultSinkQueueSize = 1000
+	// Frames of the log stream larger than that are skipped
+	maxStreamEntrySize = 1e6
+)
+
+var errSinkQueueFull = fmt.Errorf("%s: queue of the destination is full", driverName)
+
+// sink delivers messages of one container to one logger from its own
+// goroutine, so a slow or failing logger does not affect other sinks
+type sink struct {
+	name        string
+	logger      logger.Logger
+	containerID string
+	queue       chan *logger.Message
+	done        chan struct{}
+	// Blocking sink applies backpressure to the stream when its queue is
+	// full, non-blocking sink drops messages instead
+	blocking bool
+
+	stats sinkStats
+	// Messages dropped since the queue got full, they are passed to the
+	// logger in batches, used only by put and close
+	overflow []*splunkMessage
+	// Set while the queue is full, so it is logged once
+	overflowing bool
+}
+
+// sinkStats counts messages of one sink, counters are updated atomically
+type sinkStats struct {
+	logged  int64
+	failed  int64
+	dropped int64
+	// Messages which do not match the filter of the destination
+	filtered int64
+}
+
+func (s *sinkStats) fields() logrus.Fields {
+	return logrus.Fields{
+		"logged":   atomic.LoadInt64(&s.logged),
+		"failed":   atomic.LoadInt64(&s.failed),
+		"dropped":  atomic.LoadInt64(&s.dropped),
+		"filtered": atomic.LoadInt64(&s.filtered),
+	}
+}
+
+func newSink(name string, l logger.Logger, containerID string, queueSize int, blocking bool) *sink {
+	s := &sink{
+		name:        name,
+		logger:      l,
+		containerID: containerID,
+		queue:       make(chan *logger.Message, queueSize),
+		done:        make(chan struct{}),
+		blocking:    blocking,
+	}
+	go s.run()
+	return s
+}
+
+func (s *sink) put(msg *logger.Message) {
+	if s.blocking {
+		s.queue <- msg
+		return
+	}
+	select {
+	case s.queue <- msg:
+		if s.overflowing {
+			s.overflowing = false
+			s.flushOverflow()
+		}
+	default:
+		atomic.AddInt64(&s.stats.dropped, 1)
+		if !s.overflowing {
+			s.overflowing = true
+			logrus.WithField("id", s.containerID).WithField("sink", s.name).Warn("Queue is full, dropping messages")
+		}
+		s.drop(msg)
+	}
+}
+
+// drop keeps message dropped because the queue is full, so destination can
+// count it and write it to the dead-letter file
+func (s *sink) drop(msg *logger.Message) {
+	l, ok := s.logger.(splunkLoggerInterface)
+	if !ok {
+		return
+	}
+	message, err := l.formatMessage(msg)
+	logger.PutMessage(msg)
+	if err != nil {
+		logrus.WithField("id", s.containerID).WithField("sink", s.name).WithError(err).Error("Failed to format dropped message")
+		return
+	}
+	s.overflow = append(s.overflow, message)
+	if len(s.overflow) >= cap(s.queue) {
+		s.flushOverflow()
+	}
+}
+
+// flushOverflow passes dropped messages to the destination
+func (s *sink) flushOverflow() {
+	if len(s.overflow) == 0 {
+		return
+	}
+	s.logger.(splunkLoggerInterface).dropOverflow(s.overflow)
+	s.overflow = nil
+}
+
+func (s *sink) run() {
+	defer close(s.done)
+	for msg := range s.queue {
+		if sendMessage(s.logger, msg, s.containerID) {
+			atomic.AddInt64(&s.stats.logged, 1)
+		} else {
+			atomic.AddInt64(&s.stats.failed, 1)
+		}
+	}
+}
+
+// close waits until all queued messages are delivered and closes the logger
+func (s *sink) close() {
+	close(s.queue)
+	<-s.done
+	s.flushOverflow()
+	if err := s.logger.Close(); err != nil {
+		logrus.WithField("id", s.containerID).WithError(err).Errorf("error closing %s logger", s.name)
+	}
+	logrus.WithFields(s.stats.fields()).WithField("id", s.containerID).WithField("sink", s.name).Debug("Sink closed")
+}
+
+// entryReader reads length delimited entries from the log stream. Frames which
+// are too large are skipped as a whole, so the next frame is read from its
+// length prefix and the stream stays aligned.
+type entryReader struct {
+	r      io.Reader
+	lenBuf [4]byte
+	buf    []byte
+}
+
+func newEntryReader(r io.Reader) *entryReader {
+	return &entryReader{r: r}
+}
+
+// entryError is returned for a frame which was read as a whole but cannot be
+// decoded, reading can continue with the next frame
+type entryError struct {
+	err error
+}
+
+func (e *entryError) Error() string {
+	return e.err.Error()
+}
+
+// read decodes the next entry. Errors of the stream are returned as they are,
+// frames which are too large or cannot be decoded are skipped with
+// *entryError.
+func (r *entryReader) read(entry *logdriver.LogEntry) error {
+	if _, err := io.ReadFull(r.r, r.lenBuf[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(r.lenBuf[:])
+	if length > maxStreamEntrySize {
+		if _, err := io.CopyN(ioutil.Discard, r.r, int64(length)); err != nil {
+			return err
+		}
+		return &entryError{fmt.Errorf("%s: log entry of %d bytes is larger than %d bytes", driverName, length, int(maxStreamEntrySize))}
+	}
+	if int(length) > len(r.buf) {
+		r.buf = make([]byte, length)
+	}
+	if _, err := io.ReadFull(r.r, r.buf[:length]); err != nil {
+		return err
+	}
+	entry.Reset()
+	if err := entry.Unmarshal(r.buf[:length]); err != nil {
+		return &entryError{err}
+	}
+	return nil
+}
+
+// newMessage copies the entry, so every sink can own its message
+func newMessage(buf *logdriver.LogEntry) *logger.Message {
+	return &logger.Message{
+		Line:         append([]byte(nil), buf.Line...),
+		Source:       buf.Source,
+		Timestamp:    time.Unix(0, buf.TimeNano),
+		PLogMetaData: partialMetaData(buf),
+	}
+}
+
+// partialMetaData converts the partial metadata of the entry. Older daemons
+// set only Partial, such entry is treated as a part which is not the last one.
+func partialMetaData(buf *logdriver.LogEntry) *backend.PartialLogMetaData {
+	md := buf.GetPartialLogMetadata()
+	if md == nil {
+		if !buf.Partial {
+			return nil
+		}
+		return &backend.PartialLogMetaData{}
+	}
+	return &backend.PartialLogMetaData{Last: md.GetLast(), ID: md.GetId(), Ordinal: int(md.GetOrdinal())}
+}
+
+// isPartial reports whether the message is a part of a longer line which is
+// continued in the next message
+func isPartial(msg *logger.Message) bool {
+	return msg.PLogMetaData != nil && !msg.PLogMetaData.Last
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// recordingLogger keeps lines of all messages, it can fail or block every Log
+type recordingLogger struct {
+	mu      sync.Mutex
+	lines   []string
+	fail    bool
+	blocked chan struct{}
+	closed  bool
+}
+
+func (l *recordingLogger) Log(msg *logger.Message) error {
+	if l.blocked != nil {
+		<-l.blocked
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fail {
+		return errors.New("failed")
+	}
+	l.lines = append(l.lines, string(msg.Line))
+	return nil
+}
+
+func (l *recordingLogger) Name() string { return "recording" }
+
+func (l *recordingLogger) Close() error {
+	l.closed = true
+	return nil
+}
+
+func startRecordingLogPair(jsonl, splunkl logger.Logger) (*logPair, io.WriteCloser) {
+	r, w := io.Pipe()
+	lf := newLogPair(jsonl, []*destination{{name: defaultDestinationName, logger: splunkl}}, nil, r, logger.Info{ContainerID: "containeriid"})
+	go consumeLog(lf)
+	return lf, w
+}
+
+// Verify that local copy has all lines when splunk logger fails
+func TestPipelineSplunkFailure(t *testing.T) {
+	jsonl := &recordingLogger{}
+	splunkl := &recordingLogger{fail: true}
+	lf, w := startRecordingLogPair(jsonl, splunkl)
+
+	writeTestEntries(t, w, 10)
+	w.Close()
+	<-lf.done
+
+	if len(jsonl.lines) != 10 {
+		t.Fatalf("Expected %d lines in local copy, got %d", 10, len(jsonl.lines))
+	}
+
+	if lf.local.stats.logged != 10 || lf.remotes[0].stats.failed != 10 || lf.remotes[0].stats.logged != 0 {
+		t.Fatalf("Unexpected stats %v %v", lf.local.stats.fields(), lf.remotes[0].stats.fields())
+	}
+
+	if !jsonl.closed || !splunkl.closed {
+		t.Fatal("Loggers should be closed")
+	}
+}
+
+// Verify that slow splunk logger does not block local copy
+func TestPipelineSlowSplunk(t *testing.T) {
+	jsonl := &recordingLogger{}
+	splunkl := &recordingLogger{blocked: make(chan struct{})}
+	lf, w := startRecordingLogPair(jsonl, splunkl)
+
+	count := defaultSinkQueueSize + 100
+	writeTestEntries(t, w, count)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jsonl.mu.Lock()
+		logged := len(jsonl.lines)
+		jsonl.mu.Unlock()
+		if logged == count {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Local copy is blocked by splunk logger, %d lines logged", logged)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(splunkl.blocked)
+	w.Close()
+	<-lf.done
+
+	if lf.remotes[0].stats.logged+lf.remotes[0].stats.dropped != int64(count) || lf.remotes[0].stats.dropped == 0 {
+		t.Fatalf("Unexpected stats %v", lf.remotes[0].stats.fields())
+	}
+}
+
+// Verify that messages dropped by the sink of splunk logger are counted by the
+// logger and written to the dead-letter file
+func TestPipelineSinkOverflow(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesBatchSize, fmt.Sprintf("%d", defaultSinkQueueSize)); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarStreamChannelSize, "0"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarStreamChannelSize)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.responseDelay = 300 * time.Millisecond
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID: "overflowcontainer",
+	}
+	splunkl, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	lf := newLogPair(nil, []*destination{{name: defaultDestinationName, logger: splunkl}}, nil, r, info)
+	go consumeLog(lf)
+
+	count := 2*defaultSinkQueueSize + 100
+	writeTestEntries(t, w, count)
+	w.Close()
+	<-lf.done
+
+	dropped := lf.remotes[0].stats.dropped
+	if dropped == 0 {
+		t.Fatalf("Expected sink to drop messages, stats %v", lf.remotes[0].stats.fields())
+	}
+
+	stats := splunkl.(splunkLoggerInterface).deliveryStats().snapshot()
+	if stats.received != int64(count) || stats.dropped != dropped || stats.sent+stats.dropped != int64(count) {
+		t.Fatalf("Unexpected stats %v", stats.fields())
+	}
+
+	records := readDeadLetters(t, filepath.Join(os.Getenv(envVarDeadLetterDir), "overflowcontainer.ndjson"))
+	if int64(len(records)) != dropped || records[0]["reason"] != errSinkQueueFull.Error() {
+		t.Fatalf("Expected %d dead letters, got %d %v", dropped, len(records), records[0])
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that corrupt and too large frames are skipped as a whole and never
+// passed to loggers
+func TestPipelineCorruptFrame(t *testing.T) {
+	jsonl := &recordingLogger{}
+	splunkl := &recordingLogger{}
+	lf, w := startRecordingLogPair(jsonl, splunkl)
+
+	writeTestEntries(t, w, 2)
+	for _, frame := range [][]byte{{0xff, 0xff, 0xff, 0xff}, make([]byte, maxStreamEntrySize+1)} {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(frame)))
+		if _, err := w.Write(append(size, frame...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestEntries(t, w, 3)
+	w.Close()
+	<-lf.done
+
+	if lf.corrupt != 2 {
+		t.Fatalf("Expected %d corrupt frames, got %d", 2, lf.corrupt)
+	}
+
+	if len(jsonl.lines) != 5 || len(splunkl.lines) != 5 {
+		t.Fatalf("Unexpected lines %v %v", jsonl.lines, splunkl.lines)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Every part of multipart upload except the last one must be at least 5 MiB
+	s3MinPartSize = 5 << 20
+	// Number of attempts of every S3 request
+	s3RequestAttempts = 4
+	// Delay before the first retry, doubled after every attempt
+	defaultS3RetryBackoff = 500 * time.Millisecond
+
+	s3SignatureAlgorithm = "AWS4-HMAC-SHA256"
+	s3TimeFormat         = "20060102T150405Z"
+	s3DateFormat         = "20060102"
+)
+
+// s3Credentials sign requests with Signature Version 4
+type s3Credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// s3Client uploads objects to one bucket of S3 or S3-compatible storage
+type s3Client struct {
+	client      *http.Client
+	endpoint    *url.URL
+	bucket      string
+	region      string
+	pathStyle   bool
+	credentials s3Credentials
+	// Delay before the first retry of failed request
+	retryBackoff time.Duration
+	// Returns time of the signature, replaced in tests
+	now func() time.Time
+}
+
+// s3Error is error response of S3 API
+type s3Error struct {
+	statusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: S3 responded with %d %s - %s", driverName, e.statusCode, e.Code, e.Message)
+}
+
+// temporary returns true if the request can succeed when it is sent again
+func (e *s3Error) temporary() bool {
+	return e.statusCode == http.StatusTooManyRequests || e.statusCode >= 500 ||
+		e.Code == "RequestTimeout" || e.Code == "SlowDown" || e.Code == "InternalError"
+}
+
+// objectURL returns URL of the object, or of the bucket if key is empty
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if c.pathStyle {
+		path += "/" + c.bucket
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	path += "/" + key
+	u.Path = path
+	u.RawPath = s3EscapePath(path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// do sends the request until it succeeds, fails with permanent error or
+// attempts are exhausted, and returns the response body
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, headers map[string]string, body []byte) (http.Header, []byte, error) {
+	backoff := c.retryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var header http.Header
+		var response []byte
+		header, response, err = c.doOnce(ctx, method, key, query, headers, body)
+		if err == nil {
+			return header, response, nil
+		}
+		if e, ok := err.(*s3Error); ok && !e.temporary() {
+			return nil, nil, err
+		}
+		if attempt == s3RequestAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
+	return nil, nil, err
+}
+
+func (c *s3Client) doOnce(ctx context.Context, method, key string, query url.Values, headers map[string]string, body []byte) (http.Header, []byte, error) {
+	req, err := http.NewRequest(method, c.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	c.sign(req, body)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, nil, newS3Error(resp.StatusCode, response)
+	}
+	// CompleteMultipartUpload can fail after it responded with 200
+	if bytes.Contains(response, []byte("<Error>")) {
+		return nil, nil, newS3Error(http.StatusInternalServerError, response)
+	}
+	return resp.Header, response, nil
+}
+
+func newS3Error(statusCode int, response []byte) *s3Error {
+	e := &s3Error{statusCode: statusCode}
+	if xml.Unmarshal(response, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(statusCode)
+		e.Message = string(bytes.TrimSpace(response))
+	}
+	return e
+}
+
+// putObject uploads the object in one request
+func (c *s3Client) putObject(ctx context.Context, key, contentType string, body []byte) error {
+	_, _, err := c.do(ctx, http.MethodPut, key, nil, map[string]string{"Content-Type": contentType}, body)
+	return err
+}
+
+// createMultipartUpload returns id of the new upload of the object
+func (c *s3Client) createMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	_, response, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, map[string]string{"Content-Type": contentType}, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(response, &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("%s: unexpected response of CreateMultipartUpload %s", driverName, response)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads part of the upload and returns its ETag
+func (c *s3Client) uploadPart(ctx context.Context, key, uploadID string, partNumber int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {uploadID}}
+	header, _, err := c.do(ctx, http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("ETag"), nil
+}
+
+// completeMultipartUpload assembles the object from uploaded parts
+func (c *s3Client) completeMultipartUpload(ctx context.Context, key, uploadID string, etags []string) error {
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	request := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		request.Parts = append(request.Parts, part{i + 1, etag})
+	}
+	body, err := xml.Marshal(&request)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, map[string]string{"Content-Type": "application/xml"}, body)
+	return err
+}
+
+// abortMultipartUpload removes parts of the upload which will not be completed
+func (c *s3Client) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, _, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
+
+// sign adds Signature Version 4 authorization to the request. Host, Content-Type,
+// Range and x-amz-* headers are signed.
+func (c *s3Client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.credentials.sessionToken)
+	}
+	req.Header.Set("Authorization", c.credentials.authorization(req, c.region, now))
+}
+
+// authorization returns value of Authorization header of the signed request,
+// X-Amz-Date and X-Amz-Content-Sha256 headers must be already set
+func (s s3Credentials) authorization(req *http.Request, region string, now time.Time) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	date := now.Format(s3DateFormat)
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3SignatureAlgorithm,
+		now.Format(s3TimeFormat),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.secretAccessKey)
+	for _, value := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, value)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignatureAlgorithm, s.accessKeyID, scope, signedHeaders, signature)
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, value)
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes every byte of the path except unreserved characters
+// and slashes, as expected in the canonical request
+func s3EscapePath(path string) string {
+	var escaped bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3CanonicalQuery returns query sorted by names with values escaped like
+// path segments
+func s3CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3EscapePath(name)+"="+strings.Replace(s3EscapePath(value), "/", "%2F", -1))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/pkg/urlutil"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+const (
+	splunkSearchURLKey   = "splunk-search-url"
+	splunkSearchTokenKey = "splunk-search-token"
+)
+
+// Path of the REST endpoint which streams search results
+const searchExportPath = "/services/search/jobs/export"
+
+// Layout of _time in search results
+const searchTimeLayout = "2006-01-02T15:04:05.000-07:00"
+
+// searchClient reads events of one container from Splunk search, it is used
+// by ReadLogs when the local copy is not available
+type searchClient struct {
+	client *http.Client
+	url    string
+	auth   string
+	// Search query which selects events of the container
+	query string
+}
+
+// newSearchClient returns client for splunk-search-url, or nil if the fallback
+// is not enabled for the container
+func newSearchClient(info logger.Info) (*searchClient, error) {
+	searchURL, searchToken, err := parseSearchOptions(info.Config)
+	if err != nil || searchURL == nil {
+		return nil, err
+	}
+
+	tlsConfig, err := parseTLSConfig(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Search the same index events are sent to
+	orchestrator, err := detectOrchestrator(info)
+	if err != nil {
+		return nil, err
+	}
+	index, err := renderOptionTemplate(info, splunkIndexKey, &templateData{&info, orchestrator})
+	if err != nil {
+		return nil, err
+	}
+
+	searchURL.Path = strings.TrimSuffix(searchURL.Path, "/") + searchExportPath
+	return &searchClient{
+		client: &http.Client{
+			Transport: newHTTPTransport(tlsConfig),
+		},
+		url:   searchURL.String(),
+		auth:  "Bearer " + searchToken,
+		query: searchQuery(index, info.ContainerID),
+	}, nil
+}
+
+// parseSearchOptions validates splunk-search-url and splunk-search-token, and
+// returns nil url if the fallback is not enabled
+func parseSearchOptions(cfg map[string]string) (*url.URL, string, error) {
+	searchURLStr, ok := cfg[splunkSearchURLKey]
+	if !ok {
+		return nil, "", nil
+	}
+	searchURL, err := url.Parse(searchURLStr)
+	if err != nil || !urlutil.IsURL(searchURLStr) || !searchURL.IsAbs() {
+		return nil, "", fmt.Errorf("%s: expected format scheme://dns_name_or_ip:port for %s", driverName, splunkSearchURLKey)
+	}
+	searchToken, ok := cfg[splunkSearchTokenKey]
+	if !ok {
+		return nil, "", fmt.Errorf("%s: %s is expected with %s", driverName, splunkSearchTokenKey, splunkSearchURLKey)
+	}
+	return searchURL, searchToken, nil
+}
+
+// searchQuery selects events with container_id attached by the logger. It is
+// an attribute of inline and json events, and a key-value pair in raw events.
+// Events of splunk-format=template have it only if the template writes it.
+func searchQuery(index, containerID string) string {
+	query := "search"
+	if index != "" {
+		query += " index=" + strconv.Quote(index)
+	}
+	id := strconv.Quote(containerID)
+	return fmt.Sprintf("%s (attrs.%s=%s OR %s=%s)", query, metadataContainerID, id, metadataContainerID, id)
+}
+
+// readLogs streams events matching config as logdriver.LogEntry frames.
+// Search results are not followed, only events indexed so far are returned.
+func (c *searchClient) readLogs(ctx context.Context, config logger.ReadConfig) (io.ReadCloser, error) {
+	// Like the local copy, no events are returned for tail 0
+	if config.Tail == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	query := c.query
+	// Export returns newest events first
+	if config.Tail > 0 {
+		query += fmt.Sprintf(" | head %d", config.Tail)
+	}
+	query += " | reverse"
+
+	form := url.Values{}
+	form.Set("search", query)
+	form.Set("output_mode", "json")
+	if !config.Since.IsZero() {
+		form.Set("earliest_time", formatSearchTime(config.Since))
+	}
+	if !config.Until.IsZero() {
+		form.Set("latest_time", formatSearchTime(config.Until))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", c.auth)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: failed to search events - %s - %s", driverName, res.Status, body)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		// Client is created for every read, do not keep its connections
+		defer c.client.Transport.(*http.Transport).CloseIdleConnections()
+		defer res.Body.Close()
+		enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
+		defer enc.Close()
+		w.CloseWithError(writeSearchResults(enc, res.Body))
+	}()
+	return r, nil
+}
+
+// searchResult is one line of the export response
+type searchResult struct {
+	Result *struct {
+		Raw  string `json:"_raw"`
+		Time string `json:"_time"`
+	} `json:"result"`
+}
+
+// writeSearchResults converts search results to log entries
+func writeSearchResults(enc protoio.WriteCloser, body io.Reader) error {
+	dec := json.NewDecoder(body)
+	var buf logdriver.LogEntry
+	for {
+		var result searchResult
+		if err := dec.Decode(&result); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Preview, message and last row lines do not have results
+		if result.Result == nil {
+			continue
+		}
+		buf.Reset()
+		buf.Line, buf.Source = parseSearchEvent(result.Result.Raw)
+		if timestamp, err := parseSearchTime(result.Result.Time); err == nil {
+			buf.TimeNano = timestamp.UnixNano()
+		}
+		if err := enc.WriteMsg(&buf); err != nil {
+			return err
+		}
+	}
+}
+
+// parseSearchEvent returns line and stream of the event. Lines of inline and
+// json events are extracted, other events are returned as they are indexed.
+func parseSearchEvent(raw string) ([]byte, string) {
+	var event struct {
+		Line   json.RawMessage `json:"line"`
+		Source string          `json:"source"`
+	}
+	line := []byte(raw)
+	source := "stdout"
+	if err := json.Unmarshal([]byte(raw), &event); err == nil && len(event.Line) > 0 {
+		var lineStr string
+		if err := json.Unmarshal(event.Line, &lineStr); err == nil {
+			line = []byte(lineStr)
+		} else {
+			line = event.Line
+		}
+		if event.Source != "" {
+			source = event.Source
+		}
+	}
+	// Lines of the local copy end with new line, keep it the same
+	return append(line, '\n'), source
+}
+
+func formatSearchTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 3, 64)
+}
+
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(searchTimeLayout, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify that logs are read from Splunk search when local copy is not available
+func TestReadLogsSearchFallback(t *testing.T) {
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != searchExportPath || r.Header.Get("Authorization") != "Bearer searchtoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		form = r.PostForm
+		fmt.Fprintln(w, `{"preview":false,"offset":0,"result":{"_raw":"{\"line\":\"first\",\"source\":\"stdout\",\"attrs\":{\"container_id\":\"containeriid\"}}","_time":"2018-03-01T12:00:00.000+00:00"}}`)
+		fmt.Fprintln(w, `{"preview":false,"offset":1,"result":{"_raw":"{\"line\":{\"a\":\"b\"},\"source\":\"stderr\"}","_time":"2018-03-01T12:00:01.500+00:00"}}`)
+		fmt.Fprintln(w, `{"preview":false,"offset":2,"result":{"_raw":"container_id=containeriid third","_time":"2018-03-01T12:00:02.000+00:00"}}`)
+		fmt.Fprintln(w, `{"preview":false,"lastrow":true}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "splunk-logging-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkIndexKey:       "main",
+			splunkSearchURLKey:   server.URL,
+			splunkSearchTokenKey: "searchtoken",
+		},
+		ContainerID: "containeriid",
+		LogPath:     filepath.Join(dir, "containeriid.log"),
+	}
+
+	d := newDriver()
+	since := time.Unix(1519905600, 0)
+	r, err := d.ReadLogs(context.Background(), info, logger.ReadConfig{Tail: 10, Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := readLines(t, r)
+	r.Close()
+
+	if fmt.Sprint(lines) != `[first {"a":"b"} container_id=containeriid third]` {
+		t.Fatalf("Unexpected lines %v", lines)
+	}
+
+	query := form["search"][0]
+	if !strings.HasPrefix(query, `search index="main" (attrs.container_id="containeriid" OR container_id="containeriid")`) ||
+		!strings.HasSuffix(query, "| head 10 | reverse") {
+		t.Fatalf("Unexpected query %s", query)
+	}
+	if form["earliest_time"][0] != "1519905600.000" || form["output_mode"][0] != "json" {
+		t.Fatalf("Unexpected form %v", form)
+	}
+
+	// Tail 0 returns no events without searching
+	form = nil
+	r, err = d.ReadLogs(context.Background(), info, logger.ReadConfig{Tail: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := readLines(t, r); len(lines) != 0 || form != nil {
+		t.Fatalf("Unexpected lines %v and search %v", lines, form)
+	}
+	r.Close()
+
+	// Without fallback error of the local copy is returned
+	delete(info.Config, splunkSearchURLKey)
+	if _, err := d.ReadLogs(context.Background(), info, logger.ReadConfig{Tail: -1}); err == nil {
+		t.Fatal("Expecting error when local copy does not exist")
+	}
+
+	info.Config[splunkSearchURLKey] = server.URL
+	info.Config[splunkSearchTokenKey] = "wrong"
+	if _, err := d.ReadLogs(context.Background(), info, logger.ReadConfig{Tail: -1}); err == nil {
+		t.Fatal("Expecting error when search fails")
+	}
+}
+
+// Verify that search fallback options are validated and container id is
+// attached to events
+func TestSearchFallbackOptions(t *testing.T) {
+	if err := ValidateLogOpt(map[string]string{splunkSearchURLKey: "https://localhost:8089"}); err == nil {
+		t.Fatal("Expecting error without search token")
+	}
+
+	if err := ValidateLogOpt(map[string]string{splunkSearchURLKey: "localhost", splunkSearchTokenKey: "token"}); err == nil {
+		t.Fatal("Expecting error for invalid search url")
+	}
+
+	metadata, err := containerMetadata(logger.Info{
+		Config: map[string]string{
+			splunkSearchURLKey:   "https://localhost:8089",
+			splunkSearchTokenKey: "token",
+		},
+		ContainerID: "containeriid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata[metadataContainerID] != "containeriid" {
+		t.Fatalf("Container id is not attached %v", metadata)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	// Number of goroutines sending batches for every shared HEC target
+	defaultSenderShards = 4
+)
+
+var errSenderBufferFull = fmt.Errorf("%s: buffer of the logger reached its maximum while HEC is not available", driverName)
+
+const (
+	envVarSharedSender = "SPLUNK_LOGGING_DRIVER_SHARED_SENDER"
+	envVarSenderShards = "SPLUNK_LOGGING_DRIVER_SENDER_SHARDS"
+)
+
+// hecTargetKey identifies loggers which can share connections and batches.
+// Loggers with different batching options get different senders.
+func hecTargetKey(info logger.Info, url string, batching batchingOptions) string {
+	return strings.Join([]string{
+		batching.postMessagesFrequency.String(),
+		strconv.Itoa(batching.postMessagesBatchSize),
+		strconv.Itoa(batching.streamChannelSize),
+		url,
+		info.Config[splunkTokenKey],
+		info.Config[splunkInsecureSkipVerifyKey],
+		info.Config[splunkCAPathKey],
+		info.Config[splunkCANameKey],
+		info.Config[splunkGzipCompressionKey],
+		info.Config[splunkGzipCompressionLevelKey],
+	}, "\x00")
+}
+
+// senderRegistry keeps one hecSender per HEC target, shared by all loggers
+// with the same target
+type senderRegistry struct {
+	mu      sync.Mutex
+	senders map[string]*hecSender
+}
+
+func newSenderRegistry() *senderRegistry {
+	return &senderRegistry{
+		senders: make(map[string]*hecSender),
+	}
+}
+
+// acquire returns sender for the key, creating it with target and batching
+// options if it does not exist. Every acquire should be followed by release.
+func (r *senderRegistry) acquire(key string, target *hecTarget, batching batchingOptions) *hecSender {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sender, ok := r.senders[key]
+	if !ok {
+		sender = newHECSender(r, key, target, batching)
+		r.senders[key] = sender
+	} else if sender.target != target {
+		// Logger uses target of the sender, its own one is never used
+		target.cancel()
+		target.transport.CloseIdleConnections()
+	}
+	sender.refs++
+	return sender
+}
+
+// abort cancels requests in flight of all senders, so loggers flushing to
+// shared senders do not block shutdown
+func (r *senderRegistry) abort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sender := range r.senders {
+		sender.target.cancel()
+	}
+}
+
+func (r *senderRegistry) release(sender *hecSender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sender.refs--
+	if sender.refs == 0 {
+		delete(r.senders, sender.key)
+		sender.stop()
+	}
+}
+
+// hecSender multiplexes messages of all loggers with the same HEC target. Each
+// logger is assigned to one shard, so messages of one container keep their order.
+type hecSender struct {
+	registry *senderRegistry
+	key      string
+	target   *hecTarget
+	shards   []*senderShard
+	// Guarded by registry lock
+	refs int
+}
+
+func newHECSender(registry *senderRegistry, key string, target *hecTarget, batching batchingOptions) *hecSender {
+	shards := getAdvancedOptionInt(envVarSenderShards, defaultSenderShards)
+	if shards < 1 {
+		logrus.Error(fmt.Sprintf("Value of %s should be at least 1. Using default %d.", envVarSenderShards, defaultSenderShards))
+		shards = defaultSenderShards
+	}
+
+	sender := &hecSender{
+		registry: registry,
+		key:      key,
+		target:   target,
+	}
+	for i := 0; i < shards; i++ {
+		shard := &senderShard{
+			target:                target,
+			entries:               make(chan senderEntry, batching.streamChannelSize),
+			postMessagesFrequency: batching.postMessagesFrequency,
+			postMessagesBatchSize: batching.postMessagesBatchSize,
+			done:                  make(chan struct{}),
+		}
+		sender.shards = append(sender.shards, shard)
+		go shard.worker()
+	}
+	return sender
+}
+
+// shard returns shard for the container
+func (s *hecSender) shard(containerID string) *senderShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(containerID))
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *hecSender) release() {
+	s.registry.release(s)
+}
+
+func (s *hecSender) stop() {
+	for _, shard := range s.shards {
+		close(shard.entries)
+		<-shard.done
+	}
+	s.target.cancel()
+	s.target.transport.CloseIdleConnections()
+}
+
+// senderEntry is a message of the owner logger. Entry without message asks
+// shard to flush all messages of the owner and close flushed.
+type senderEntry struct {
+	owner   *splunkLogger
+	message *splunkMessage
+	flushed chan struct{}
+}
+
+// senderShard builds mixed batches from messages of several loggers. Every
+// logger keeps its own buffer limit and stats.
+type senderShard struct {
+	target  *hecTarget
+	entries chan senderEntry
+	done    chan struct{}
+
+	postMessagesFrequency time.Duration
+	postMessagesBatchSize int
+
+	// Number of buffered messages of every logger, used only by worker
+	buffered map[*splunkLogger]int
+}
+
+func (s *senderShard) queue(owner *splunkLogger, message *splunkMessage) {
+	s.entries <- senderEntry{owner: owner, message: message}
+}
+
+// flush blocks until all messages of owner are sent or dropped
+func (s *senderShard) flush(owner *splunkLogger) {
+	flushed := make(chan struct{})
+	s.entries <- senderEntry{owner: owner, flushed: flushed}
+	<-flushed
+}
+
+func (s *senderShard) worker() {
+	defer close(s.done)
+	timer := time.NewTicker(s.postMessagesFrequency)
+	defer timer.Stop()
+	s.buffered = make(map[*splunkLogger]int)
+	var entries []senderEntry
+	// After a failure we retry only on timer, not on every new message
+	failed := false
+	for {
+		select {
+		case entry, open := <-s.entries:
+			if !open {
+				return
+			}
+			if entry.flushed != nil {
+				entries = s.postEntries(entries, entry.owner)
+				close(entry.flushed)
+				continue
+			}
+			entries = append(entries, entry)
+			s.buffered[entry.owner]++
+			// Until the next retry only the buffer maximum of the logger is
+			// applied, its oldest message is dropped
+			if failed && s.buffered[entry.owner] > entry.owner.bufferMaximum {
+				entries = s.trimEntries(entries, nil, errSenderBufferFull)
+			}
+			if !failed && len(entries) >= s.postMessagesBatchSize {
+				entries = s.postEntries(entries, nil)
+				failed = len(entries) > 0
+			}
+		case <-timer.C:
+			entries = s.postEntries(entries, nil)
+			failed = len(entries) > 0
+		}
+	}
+}
+
+// postEntries sends entries in batches. When sending fails, the oldest
+// messages of every logger above its buffer maximum are dropped, and all
+// messages of lastChance logger are dropped. Returns entries which are not
+// sent or dropped.
+func (s *senderShard) postEntries(entries []senderEntry, lastChance *splunkLogger) []senderEntry {
+	entriesLen := len(entries)
+	for i := 0; i < entriesLen; i += s.postMessagesBatchSize {
+		upperBound := i + s.postMessagesBatchSize
+		if upperBound > entriesLen {
+			upperBound = entriesLen
+		}
+		batch := entries[i:upperBound]
+		sent, err := s.tryPostEntries(batch)
+		for _, entry := range batch[:sent] {
+			s.buffered[entry.owner]--
+		}
+		if err != nil {
+			logrus.Error(err)
+			for _, entry := range batch[sent:] {
+				entry.owner.stats.addFailed(1)
+			}
+			return s.trimEntries(entries[i+sent:], lastChance, err)
+		}
+	}
+	for owner, count := range s.buffered {
+		if count == 0 {
+			delete(s.buffered, owner)
+		}
+	}
+	// All sent, return empty buffer
+	return entries[:0]
+}
+
+// trimEntries drops messages of loggers which have more buffered messages
+// than their buffer maximum, so one logger does not lose messages because
+// another one filled the shard
+func (s *senderShard) trimEntries(entries []senderEntry, lastChance *splunkLogger, err error) []senderEntry {
+	drop := make(map[*splunkLogger]int)
+	for owner, count := range s.buffered {
+		if owner == lastChance {
+			drop[owner] = count
+		} else if count > owner.bufferMaximum {
+			drop[owner] = count - owner.bufferMaximum
+		}
+	}
+	if len(drop) == 0 {
+		return entries
+	}
+	dropped := make(map[*splunkLogger][]*splunkMessage)
+	remaining := make([]senderEntry, 0, len(entries))
+	for _, entry := range entries {
+		if drop[entry.owner] > 0 {
+			drop[entry.owner]--
+			s.buffered[entry.owner]--
+			dropped[entry.owner] = append(dropped[entry.owner], entry.message)
+			continue
+		}
+		remaining = append(remaining, entry)
+	}
+	for owner, messages := range dropped {
+		owner.dropMessages(messages, err)
+	}
+	for owner, count := range s.buffered {
+		if count == 0 {
+			delete(s.buffered, owner)
+		}
+	}
+	return remaining
+}
+
+// tryPostEntries returns number of entries sent, or dropped because they are
+// too large, before error
+func (s *senderShard) tryPostEntries(entries []senderEntry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	ends, err := encodeMessages(buffer, len(entries), func(buffer *bytes.Buffer, i int) error {
+		return entries[i].owner.encoder.encodeMessage(buffer, entries[i].message)
+	})
+	if err != nil {
+		return 0, err
+	}
+	tooLarge := make(map[int]bool)
+	sent, err := s.target.postEncoded(buffer.Bytes(), ends, func(i int, err error) {
+		tooLarge[i] = true
+		entries[i].owner.dropMessages([]*splunkMessage{entries[i].message}, err)
+	})
+	for i, entry := range entries[:sent] {
+		if !tooLarge[i] {
+			entry.owner.stats.addSent(1)
+		}
+	}
+	return sent, err
+}
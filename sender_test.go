@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify that loggers with the same HEC target share sender and send mixed batches
+func TestSharedSender(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	if err := os.Setenv(envVarPostMessagesBatchSize, "10"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarSharedSender, "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarSharedSender)
+
+	if err := os.Setenv(envVarSenderShards, "1"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarSenderShards)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	registry := newSenderRegistry()
+
+	var loggers []logger.Logger
+	var infos []logger.Info
+	for _, containerID := range []string{"container1iid", "container2iid"} {
+		info := logger.Info{
+			Config: map[string]string{
+				splunkURLKey:              hec.URL(),
+				splunkTokenKey:            hec.token,
+				splunkVerifyConnectionKey: "false",
+			},
+			ContainerID:        containerID,
+			ContainerName:      "/container_name",
+			ContainerImageID:   "contaimageid",
+			ContainerImageName: "container_image_name",
+		}
+		infos = append(infos, info)
+
+		loggerDriver, err := newSplunkLogger(info, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loggers = append(loggers, loggerDriver)
+	}
+
+	if len(registry.senders) != 1 {
+		t.Fatalf("Expected one shared sender, got %d", len(registry.senders))
+	}
+
+	first := loggers[0].(*splunkLoggerInline)
+	second := loggers[1].(*splunkLoggerInline)
+	if first.hecTarget != second.hecTarget || first.sender != second.sender {
+		t.Fatal("Loggers should share HEC target")
+	}
+
+	for i := 0; i < 5; i++ {
+		for _, loggerDriver := range loggers {
+			if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Add one more message to the first logger, which is flushed on close
+	if err := loggers[0].Log(&logger.Message{Line: []byte("last"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loggers[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(registry.senders) != 1 {
+		t.Fatal("Sender should be used until all loggers are closed")
+	}
+
+	if err := loggers[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(registry.senders) != 0 {
+		t.Fatal("Sender should be released when all loggers are closed")
+	}
+
+	// One mixed batch of 10 messages and one flush
+	if hec.numOfRequests != 2 {
+		t.Fatalf("Unexpected number of requests %d", hec.numOfRequests)
+	}
+
+	if len(hec.messages) != 11 {
+		t.Fatalf("Expected # of messages %d, got %d", 11, len(hec.messages))
+	}
+
+	tags := make(map[string]int)
+	for _, message := range hec.messages {
+		if event, err := message.EventAsMap(); err != nil {
+			t.Fatal(err)
+		} else {
+			tags[event["tag"].(string)]++
+		}
+	}
+	if tags[infos[0].ID()] != 6 || tags[infos[1].ID()] != 5 {
+		t.Fatalf("Unexpected messages per container %v", tags)
+	}
+
+	if first.stats.sent != 6 || second.stats.sent != 5 {
+		t.Fatalf("Unexpected stats %v %v", first.stats.fields(), second.stats.fields())
+	}
+
+	err := hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that loggers with different targets do not share sender
+func TestSharedSenderDifferentTokens(t *testing.T) {
+	if err := os.Setenv(envVarSharedSender, "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarSharedSender)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	registry := newSenderRegistry()
+
+	var loggers []logger.Logger
+	for _, token := range []string{hec.token, "other-token"} {
+		info := logger.Info{
+			Config: map[string]string{
+				splunkURLKey:              hec.URL(),
+				splunkTokenKey:            token,
+				splunkVerifyConnectionKey: "false",
+			},
+			ContainerID: "containeriid",
+		}
+
+		loggerDriver, err := newSplunkLogger(info, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loggers = append(loggers, loggerDriver)
+	}
+
+	if len(registry.senders) != 2 {
+		t.Fatalf("Expected two senders, got %d", len(registry.senders))
+	}
+
+	for _, loggerDriver := range loggers {
+		if err := loggerDriver.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(registry.senders) != 0 {
+		t.Fatal("Senders should be released when all loggers are closed")
+	}
+
+	err := hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that buffer maximum is applied per logger when HEC is down, only
+// messages of the logger above its maximum are dropped
+func TestSharedSenderBufferMaximum(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	if err := os.Setenv(envVarPostMessagesBatchSize, "2"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchSize)
+
+	if err := os.Setenv(envVarBufferMaximum, "4"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarBufferMaximum)
+
+	if err := os.Setenv(envVarSharedSender, "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarSharedSender)
+
+	if err := os.Setenv(envVarSenderShards, "1"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarSenderShards)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.simulateServerError = true
+
+	go hec.Serve()
+
+	registry := newSenderRegistry()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID: "containeriid",
+	}
+
+	loggerDriver, err := newSplunkLogger(info, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	largeInfo := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+			splunkBufferMaximumKey:    "100",
+		},
+		ContainerID: "largecontaineriid",
+	}
+
+	largeLoggerDriver, err := newSplunkLogger(largeInfo, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := largeLoggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("large%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := loggerDriver.(*splunkLoggerInline)
+	large := largeLoggerDriver.(*splunkLoggerInline)
+	if l.sender != large.sender || l.shard != large.shard {
+		t.Fatal("Expected loggers to share the shard")
+	}
+
+	// Buffer maximum is applied before the next retry
+	for start := time.Now(); l.stats.snapshot().dropped != 2; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Unexpected stats %v", l.stats.fields())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Wait until worker tries to send messages
+	l.shard.flush(&splunkLogger{})
+
+	hec.lock.Lock()
+	hec.simulateServerError = false
+	hec.lock.Unlock()
+
+	if err := loggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := largeLoggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only 2 oldest messages above maximum of the first logger are dropped
+	if l.stats.dropped != 2 || large.stats.dropped != 0 {
+		t.Fatalf("Unexpected stats %v and %v", l.stats.fields(), large.stats.fields())
+	}
+
+	var lines []string
+	for _, message := range hec.messages {
+		if event, err := message.EventAsMap(); err != nil {
+			t.Fatal(err)
+		} else if line := event["line"].(string); !strings.HasPrefix(line, "large") {
+			lines = append(lines, line)
+		}
+	}
+	if len(hec.messages) != 10 || len(lines) != 4 {
+		t.Fatalf("Expected # of messages %d, got %d", 10, len(hec.messages))
+	}
+	for i, line := range lines {
+		if line != fmt.Sprintf("%d", i+2) {
+			t.Fatalf("Unexpected line %s", line)
+		}
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that aborting one logger does not cancel requests of other loggers
+// sharing the sender
+func TestSharedSenderAbort(t *testing.T) {
+	if err := os.Setenv(envVarSharedSender, "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarSharedSender)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	registry := newSenderRegistry()
+
+	var loggers []*splunkLoggerInline
+	for _, containerID := range []string{"container1iid", "container2iid"} {
+		info := logger.Info{
+			Config: map[string]string{
+				splunkURLKey:              hec.URL(),
+				splunkTokenKey:            hec.token,
+				splunkVerifyConnectionKey: "false",
+			},
+			ContainerID: containerID,
+		}
+
+		loggerDriver, err := newSplunkLogger(info, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loggers = append(loggers, loggerDriver.(*splunkLoggerInline))
+	}
+
+	loggers[0].abort()
+	if err := loggers[1].ctx.Err(); err != nil {
+		t.Fatalf("Shared target should not be cancelled, got %v", err)
+	}
+
+	if err := loggers[1].Log(&logger.Message{Line: []byte("line"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range loggers {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(hec.messages) != 1 || loggers[1].stats.sent != 1 {
+		t.Fatalf("Expected # of messages %d, got %d", 1, len(hec.messages))
+	}
+
+	err := hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
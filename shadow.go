@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	splunkShadowURLKey    = "splunk-shadow-url"
+	splunkShadowTokenKey  = "splunk-shadow-token"
+	splunkShadowSampleKey = "splunk-shadow-sample"
+)
+
+const (
+	// Percentage of messages mirrored when splunk-shadow-sample is not set
+	defaultShadowSample = 100
+	// Timeout of one shadow request, so a slow shadow HEC does not keep the
+	// sender busy and make it skip more messages than necessary
+	shadowRequestTimeout = 10 * time.Second
+)
+
+// shadowStats counts messages of the shadow sender, counters are updated
+// atomically and are not part of the delivery stats of the logger
+type shadowStats struct {
+	// Messages selected by sampling
+	sampled int64
+	sent    int64
+	// Messages of requests which failed, they are not retried
+	failed int64
+	// Messages skipped because the queue of the sender was full
+	skipped int64
+}
+
+// add adds counters of other, which can still be updated, to the stats
+func (s *shadowStats) add(other *shadowStats) {
+	s.sampled += atomic.LoadInt64(&other.sampled)
+	s.sent += atomic.LoadInt64(&other.sent)
+	s.failed += atomic.LoadInt64(&other.failed)
+	s.skipped += atomic.LoadInt64(&other.skipped)
+}
+
+func (s *shadowStats) fields() logrus.Fields {
+	return logrus.Fields{
+		"sampled": atomic.LoadInt64(&s.sampled),
+		"sent":    atomic.LoadInt64(&s.sent),
+		"failed":  atomic.LoadInt64(&s.failed),
+		"skipped": atomic.LoadInt64(&s.skipped),
+	}
+}
+
+// shadowSender mirrors a sample of messages to a second HEC. It is strictly
+// best-effort: messages are skipped when its queue is full, failed batches are
+// not retried, and nothing is sent back to the buffer of the logger.
+type shadowSender struct {
+	*hecTarget
+	encoder *messageEncoder
+	// Percentage of messages which are mirrored, from 0 to 100
+	sample float64
+	// Number of messages offered to the sender, used for sampling
+	offered uint64
+
+	batchSize int
+	frequency time.Duration
+	queue     chan *splunkMessage
+	done      chan struct{}
+
+	stats shadowStats
+}
+
+// parseShadowSample returns percentage of messages to mirror
+func parseShadowSample(cfg map[string]string) (float64, error) {
+	sampleStr, ok := cfg[splunkShadowSampleKey]
+	if !ok {
+		return defaultShadowSample, nil
+	}
+	sample, err := strconv.ParseFloat(sampleStr, 64)
+	if err != nil || sample < 0 || sample > 100 {
+		return 0, fmt.Errorf("%s: %s must be a percentage from 0 to 100, got '%s'", driverName, splunkShadowSampleKey, sampleStr)
+	}
+	return sample, nil
+}
+
+// validateShadowOptions validates splunk-shadow-* options
+func validateShadowOptions(cfg map[string]string) error {
+	_, hasURL := cfg[splunkShadowURLKey]
+	_, hasToken := cfg[splunkShadowTokenKey]
+	_, hasSample := cfg[splunkShadowSampleKey]
+	if !hasURL {
+		if hasToken || hasSample {
+			return fmt.Errorf("%s: %s is expected with %s and %s", driverName, splunkShadowURLKey, splunkShadowTokenKey, splunkShadowSampleKey)
+		}
+		return nil
+	}
+	if !hasToken {
+		return fmt.Errorf("%s: %s is expected with %s", driverName, splunkShadowTokenKey, splunkShadowURLKey)
+	}
+	if _, err := parseURL(shadowInfo(logger.Info{Config: cfg})); err != nil {
+		return err
+	}
+	_, err := parseShadowSample(cfg)
+	return err
+}
+
+// shadowInfo returns info with the shadow HEC as splunk-url and splunk-token,
+// so TLS, compression and URL path options of the logger apply to the shadow
+func shadowInfo(info logger.Info) logger.Info {
+	config := mergeOptions(info.Config, map[string]string{
+		splunkURLKey:   info.Config[splunkShadowURLKey],
+		splunkTokenKey: info.Config[splunkShadowTokenKey],
+	})
+	info.Config = config
+	return info
+}
+
+// newShadowSender returns nil if splunk-shadow-url is not set. Connection to
+// the shadow HEC is not verified, so it cannot prevent the container from
+// starting.
+func newShadowSender(info logger.Info, encoder *messageEncoder, batching batchingOptions) (*shadowSender, error) {
+	if _, ok := info.Config[splunkShadowURLKey]; !ok {
+		return nil, nil
+	}
+	if err := validateShadowOptions(info.Config); err != nil {
+		return nil, err
+	}
+	sample, err := parseShadowSample(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	target, err := newHECTarget(shadowInfo(info))
+	if err != nil {
+		return nil, err
+	}
+	target.client.Timeout = shadowRequestTimeout
+
+	s := &shadowSender{
+		hecTarget: target,
+		encoder:   encoder,
+		sample:    sample,
+		batchSize: batching.postMessagesBatchSize,
+		frequency: batching.postMessagesFrequency,
+		queue:     make(chan *splunkMessage, batching.streamChannelSize),
+		done:      make(chan struct{}),
+	}
+	go s.worker()
+	return s, nil
+}
+
+// offer queues the message if it is selected by sampling and the queue is not
+// full. Sampling is deterministic, so exactly the configured percentage of
+// messages is mirrored.
+func (s *shadowSender) offer(message *splunkMessage) {
+	n := atomic.AddUint64(&s.offered, 1)
+	if uint64(float64(n)*s.sample/100) == uint64(float64(n-1)*s.sample/100) {
+		return
+	}
+	atomic.AddInt64(&s.stats.sampled, 1)
+	select {
+	case s.queue <- message:
+	default:
+		atomic.AddInt64(&s.stats.skipped, 1)
+	}
+}
+
+func (s *shadowSender) worker() {
+	defer close(s.done)
+	timer := time.NewTicker(s.frequency)
+	defer timer.Stop()
+	var messages []*splunkMessage
+	for {
+		select {
+		case message, open := <-s.queue:
+			if !open {
+				s.send(messages)
+				s.transport.CloseIdleConnections()
+				logrus.WithFields(s.stats.fields()).WithField("url", s.url).Info("Shadow sender closed")
+				return
+			}
+			messages = append(messages, message)
+			if len(messages) >= s.batchSize {
+				s.send(messages)
+				messages = messages[:0]
+			}
+		case <-timer.C:
+			s.send(messages)
+			messages = messages[:0]
+		}
+	}
+}
+
+// send posts messages once, failed messages are counted and discarded
+func (s *shadowSender) send(messages []*splunkMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	ends, err := encodeMessages(buffer, len(messages), func(buffer *bytes.Buffer, i int) error {
+		return s.encoder.encodeMessage(buffer, messages[i])
+	})
+	if err != nil {
+		atomic.AddInt64(&s.stats.failed, int64(len(messages)))
+		return
+	}
+	tooLarge := 0
+	sent, err := s.postEncoded(buffer.Bytes(), ends, func(i int, err error) {
+		tooLarge++
+	})
+	atomic.AddInt64(&s.stats.sent, int64(sent-tooLarge))
+	atomic.AddInt64(&s.stats.failed, int64(len(messages)-sent+tooLarge))
+	if err != nil {
+		logrus.WithError(err).WithField("url", s.url).Debug("Shadow request failed")
+	}
+}
+
+// close stops the sender after it tries to send queued messages once, it does
+// not wait for that
+func (s *shadowSender) close() {
+	close(s.queue)
+}
+
+// abort cancels shadow requests in flight
+func (s *shadowSender) abort() {
+	s.cancel()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func startShadowTest(t *testing.T, primary, shadow *HTTPEventCollectorMock, sample string) *splunkLoggerInline {
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:          primary.URL(),
+			splunkTokenKey:        primary.token,
+			splunkShadowURLKey:    shadow.URL(),
+			splunkShadowTokenKey:  shadow.token,
+			splunkShadowSampleKey: sample,
+		},
+		ContainerID:   "containeriid",
+		ContainerName: "/container_name",
+	}
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loggerDriver.(*splunkLoggerInline)
+}
+
+// Verify that sampled messages are mirrored to the shadow HEC with its token
+func TestShadowTraffic(t *testing.T) {
+	primary := NewHTTPEventCollectorMock(t)
+	go primary.Serve()
+	defer primary.Close()
+	shadow := NewHTTPEventCollectorMock(t)
+	shadow.token = "shadow"
+	go shadow.Serve()
+	defer shadow.Close()
+
+	l := startShadowTest(t, primary, shadow, "50")
+	for i := 0; i < 10; i++ {
+		if err := l.Log(&logger.Message{Line: []byte("line"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-l.shadow.done
+
+	if len(primary.messages) != 10 || len(shadow.messages) != 5 {
+		t.Fatalf("Unexpected messages %d %d", len(primary.messages), len(shadow.messages))
+	}
+	if shadow.connectionVerified {
+		t.Fatal("Connection to shadow should not be verified")
+	}
+	stats := l.shadow.stats.fields()
+	if stats["sampled"] != int64(5) || stats["sent"] != int64(5) || stats["failed"] != int64(0) {
+		t.Fatalf("Unexpected shadow stats %v", stats)
+	}
+}
+
+// Verify that failing shadow HEC does not affect delivery to the primary HEC
+func TestShadowFailure(t *testing.T) {
+	primary := NewHTTPEventCollectorMock(t)
+	go primary.Serve()
+	defer primary.Close()
+	shadow := NewHTTPEventCollectorMock(t)
+	shadow.simulateServerError = true
+	go shadow.Serve()
+	defer shadow.Close()
+
+	l := startShadowTest(t, primary, shadow, "100")
+	for i := 0; i < 10; i++ {
+		if err := l.Log(&logger.Message{Line: []byte("line"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-l.shadow.done
+
+	if len(primary.messages) != 10 {
+		t.Fatalf("Expected 10 messages, got %d", len(primary.messages))
+	}
+	// Shadow batch is sent once and not retried
+	if shadow.numOfRequests != 1 {
+		t.Fatalf("Expected one shadow request, got %d", shadow.numOfRequests)
+	}
+	if stats := l.stats.snapshot(); stats.sent != 10 || stats.failed != 0 || stats.dropped != 0 {
+		t.Fatalf("Unexpected stats %v", l.stats.fields())
+	}
+	if stats := l.shadow.stats.fields(); stats["failed"] != int64(10) || stats["sent"] != int64(0) {
+		t.Fatalf("Unexpected shadow stats %v", stats)
+	}
+}
+
+// Verify that sampling selects the percentage of messages, and that messages
+// are skipped instead of blocking when the queue is full
+func TestShadowOffer(t *testing.T) {
+	for _, test := range []struct {
+		sample  float64
+		sampled int
+	}{
+		{0, 0},
+		{12.5, 25},
+		{33.3, 66},
+		{100, 200},
+	} {
+		s := &shadowSender{sample: test.sample, queue: make(chan *splunkMessage, 200)}
+		for i := 0; i < 200; i++ {
+			s.offer(&splunkMessage{})
+		}
+		if s.stats.sampled != int64(test.sampled) || len(s.queue) != test.sampled {
+			t.Fatalf("Expected %d sampled messages of %v%%, got %d", test.sampled, test.sample, s.stats.sampled)
+		}
+	}
+
+	s := &shadowSender{sample: 100, queue: make(chan *splunkMessage, 1)}
+	for i := 0; i < 3; i++ {
+		s.offer(&splunkMessage{})
+	}
+	if s.stats.sampled != 3 || s.stats.skipped != 2 {
+		t.Fatalf("Unexpected shadow stats %v", s.stats.fields())
+	}
+}
+
+func TestValidateShadowOptions(t *testing.T) {
+	if err := validateShadowOptions(map[string]string{
+		splunkShadowURLKey:    "https://shadow:8088",
+		splunkShadowTokenKey:  "token",
+		splunkShadowSampleKey: "2.5",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []map[string]string{
+		{splunkShadowTokenKey: "token"},
+		{splunkShadowURLKey: "https://shadow:8088"},
+		{splunkShadowURLKey: "shadow:8088", splunkShadowTokenKey: "token"},
+		{splunkShadowURLKey: "https://shadow:8088", splunkShadowTokenKey: "token", splunkShadowSampleKey: "101"},
+	} {
+		if err := validateShadowOptions(cfg); err == nil {
+			t.Fatalf("Expecting error for %v", cfg)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// How long plugin waits for all loggers to flush their buffers on shutdown
+	defaultShutdownTimeout = 10 * time.Second
+	// How long StopLogging waits for the logger of one container to drain
+	// the fifo and flush its buffer
+	defaultStopTimeout = 10 * time.Second
+	// How long plugin waits for loggers after requests in flight are cancelled
+	abortGracePeriod = 2 * time.Second
+)
+
+const (
+	envVarShutdownTimeout = "SPLUNK_LOGGING_DRIVER_SHUTDOWN_TIMEOUT"
+	envVarStopTimeout     = "SPLUNK_LOGGING_DRIVER_STOP_TIMEOUT"
+)
+
+// shutdownReport describes what happened with buffered messages on shutdown
+type shutdownReport struct {
+	// Number of loggers closed
+	loggers int
+	// Number of loggers which did not flush before the deadline
+	aborted int
+	// Messages sent to HEC during shutdown
+	flushed int64
+	// Messages dropped during shutdown or still buffered when plugin gave up
+	lost int64
+	// Totals of shadow senders of the loggers
+	shadow shadowStats
+}
+
+func (r shutdownReport) fields() logrus.Fields {
+	fields := logrus.Fields{
+		"loggers": r.loggers,
+		"aborted": r.aborted,
+		"flushed": r.flushed,
+		"lost":    r.lost,
+	}
+	if r.shadow.sampled > 0 {
+		for key, value := range r.shadow.fields() {
+			fields["shadow_"+key] = value
+		}
+	}
+	return fields
+}
+
+// shutdown stops accepting new logs and closes all loggers concurrently. If
+// loggers do not flush before timeout, requests in flight are cancelled and
+// messages which could not be sent are dropped like on any other failure.
+func (d *driver) shutdown(timeout time.Duration) shutdownReport {
+	d.mu.Lock()
+	d.stopping = true
+	pairs := make([]*logPair, 0, len(d.logs))
+	for file, lf := range d.logs {
+		pairs = append(pairs, lf)
+		delete(d.logs, file)
+		delete(d.idx, lf.info.ContainerID)
+	}
+	d.mu.Unlock()
+
+	report := shutdownReport{loggers: len(pairs)}
+	stats := make([]deliveryStats, len(pairs))
+	closed := make([]chan struct{}, len(pairs))
+	for i, lf := range pairs {
+		stats[i] = lf.deliveryStats()
+		// consumeLog closes loggers and returns after the stream is closed
+		closed[i] = lf.done
+		lf.stop()
+	}
+
+	// When deadline is reached, cancel requests of loggers which are still flushing
+	if remaining := waitClosed(closed, timeout); len(remaining) > 0 {
+		report.aborted = len(remaining)
+		d.senders.abort()
+		for _, i := range remaining {
+			pairs[i].abort()
+		}
+		for _, i := range waitClosed(closed, abortGracePeriod) {
+			logrus.WithField("id", pairs[i].info.ContainerID).Error("splunk logger did not close after cancelling requests")
+		}
+	}
+
+	for i, lf := range pairs {
+		after := lf.deliveryStats()
+		report.flushed += after.sent - stats[i].sent
+		report.lost += after.dropped - stats[i].dropped + after.pending()
+	}
+
+	// Loggers do not wait for their shadow senders, so they are given the
+	// grace period to send queued messages once
+	var shadows []*shadowSender
+	for _, lf := range pairs {
+		shadows = append(shadows, lf.shadowSenders()...)
+	}
+	shadowsClosed := make([]chan struct{}, len(shadows))
+	for i, s := range shadows {
+		shadowsClosed[i] = s.done
+	}
+	for _, i := range waitClosed(shadowsClosed, abortGracePeriod) {
+		shadows[i].abort()
+	}
+	for _, s := range shadows {
+		report.shadow.add(&s.stats)
+	}
+	return report
+}
+
+// shadowSenders returns shadow senders of all destinations of the container
+func (lf *logPair) shadowSenders() []*shadowSender {
+	var shadows []*shadowSender
+	for _, d := range lf.destinations {
+		if l, ok := d.logger.(splunkLoggerInterface); ok && l.shadowSender() != nil {
+			shadows = append(shadows, l.shadowSender())
+		}
+	}
+	return shadows
+}
+
+// deliveryStats returns sum of counters of all destinations of the container.
+// Splunk destinations count messages their sinks dropped. Messages which
+// other sinks dropped and messages which could not be archived are counted
+// as received and dropped.
+func (lf *logPair) deliveryStats() deliveryStats {
+	var sum deliveryStats
+	lost := func(n int64) {
+		sum.received += n
+		sum.dropped += n
+	}
+	for i, s := range lf.remotes {
+		if _, ok := lf.destinations[i].logger.(splunkLoggerInterface); !ok {
+			lost(atomic.LoadInt64(&s.stats.dropped))
+		}
+	}
+	if lf.archive != nil {
+		lost(atomic.LoadInt64(&lf.archive.stats.dropped))
+	}
+	if lf.archivel != nil {
+		lost(atomic.LoadInt64(&lf.archivel.lost))
+	}
+	for _, d := range lf.destinations {
+		l, ok := d.logger.(splunkLoggerInterface)
+		if !ok {
+			continue
+		}
+		stats := l.deliveryStats().snapshot()
+		sum.received += stats.received
+		sum.sent += stats.sent
+		sum.failed += stats.failed
+		sum.dropped += stats.dropped
+	}
+	return sum
+}
+
+// waitClosed waits until all channels are closed or timeout, and returns
+// indexes of channels which are not closed
+func waitClosed(closed []chan struct{}, timeout time.Duration) []int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var remaining []int
+	expired := false
+	for i, c := range closed {
+		if !expired {
+			select {
+			case <-c:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		select {
+		case <-c:
+		default:
+			remaining = append(remaining, i)
+		}
+	}
+	return remaining
+}
+
+// shutdownTimeout returns drain deadline from env
+func shutdownTimeout() time.Duration {
+	timeout := getAdvancedOptionDuration(envVarShutdownTimeout, defaultShutdownTimeout)
+	if timeout <= 0 {
+		logrus.Error(fmt.Sprintf("Value of %s should be positive. Using default %v.", envVarShutdownTimeout, defaultShutdownTimeout))
+		timeout = defaultShutdownTimeout
+	}
+	return timeout
+}
+
+// stopTimeout returns drain deadline of one container from env
+func stopTimeout() time.Duration {
+	timeout := getAdvancedOptionDuration(envVarStopTimeout, defaultStopTimeout)
+	if timeout <= 0 {
+		logrus.Error(fmt.Sprintf("Value of %s should be positive. Using default %v.", envVarStopTimeout, defaultStopTimeout))
+		timeout = defaultStopTimeout
+	}
+	return timeout
+}
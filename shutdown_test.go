@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+type nopLogger struct {
+	closed bool
+}
+
+func (l *nopLogger) Log(msg *logger.Message) error { return nil }
+func (l *nopLogger) Name() string                  { return "nop" }
+func (l *nopLogger) Close() error {
+	l.closed = true
+	return nil
+}
+
+// startTestLogPair starts consuming entries written to the returned writer,
+// like StartLogging does with fifo
+func startTestLogPair(t *testing.T, d *driver, hec *HTTPEventCollectorMock, id string, jsonl logger.Logger) (*logPair, io.WriteCloser) {
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID:        id,
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	splunkl, err := newSplunkLogger(info, d.senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	lf := newLogPair(jsonl, []*destination{{name: defaultDestinationName, logger: splunkl}}, nil, r, info)
+	d.mu.Lock()
+	d.logs[id] = lf
+	d.idx[id] = lf
+	d.mu.Unlock()
+	go consumeLog(lf)
+	return lf, w
+}
+
+func writeTestEntries(t *testing.T, w io.Writer, count int) {
+	enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
+	for i := 0; i < count; i++ {
+		entry := logdriver.LogEntry{Line: []byte("line"), Source: "stdout", TimeNano: time.Now().UnixNano()}
+		if err := enc.WriteMsg(&entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Verify that messages dropped by sinks and lost by the archive are counted
+// in delivery stats of the container
+func TestDeliveryStatsSinkDrops(t *testing.T) {
+	r, w := io.Pipe()
+	archivel := &archiveLogger{done: make(chan struct{}), parts: make(chan archivePart), uploaded: make(chan struct{}), lost: 3}
+	go archivel.uploader()
+	lf := newLogPair(nil, []*destination{{name: defaultDestinationName, logger: &nopLogger{}}}, archivel, r, logger.Info{ContainerID: "containeriid"})
+	go consumeLog(lf)
+
+	atomic.AddInt64(&lf.remotes[0].stats.dropped, 2)
+	atomic.AddInt64(&lf.archive.stats.dropped, 1)
+
+	stats := lf.deliveryStats()
+	if stats.received != 6 || stats.dropped != 6 || stats.pending() != 0 {
+		t.Fatalf("Unexpected stats %v", stats.fields())
+	}
+
+	w.Close()
+	<-lf.done
+}
+
+// Verify that shutdown flushes buffers of all loggers
+func TestShutdownFlushesLoggers(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	d := newDriver()
+	lf1, w1 := startTestLogPair(t, d, hec, "container1iid", &nopLogger{})
+	lf2, w2 := startTestLogPair(t, d, hec, "container2iid", &nopLogger{})
+
+	writeTestEntries(t, w1, 3)
+	writeTestEntries(t, w2, 4)
+
+	report := d.shutdown(time.Second)
+	if report.loggers != 2 || report.aborted != 0 || report.flushed != 7 || report.lost != 0 {
+		t.Fatalf("Unexpected report %v", report.fields())
+	}
+
+	if len(hec.messages) != 7 {
+		t.Fatalf("Expected # of messages %d, got %d", 7, len(hec.messages))
+	}
+
+	if !lf1.jsonl.(*nopLogger).closed || !lf2.jsonl.(*nopLogger).closed {
+		t.Fatal("Json file loggers should be closed")
+	}
+
+	if len(d.logs) != 0 {
+		t.Fatalf("Loggers are not removed %v", d.logs)
+	}
+
+	if err := d.StartLogging("/tmp/file", logger.Info{}); err == nil {
+		t.Fatal("Expecting error when starting logger after shutdown")
+	}
+
+	err := hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that counters of shadow senders are in the shutdown report
+func TestShutdownShadowStats(t *testing.T) {
+	hec := NewHTTPEventCollectorMock(t)
+	go hec.Serve()
+	defer hec.Close()
+	shadow := NewHTTPEventCollectorMock(t)
+	go shadow.Serve()
+	defer shadow.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+			splunkShadowURLKey:        shadow.URL(),
+			splunkShadowTokenKey:      shadow.token,
+		},
+		ContainerID:   "shadowcontainer",
+		ContainerName: "/container_name",
+	}
+	d := newDriver()
+	splunkl, err := newSplunkLogger(info, d.senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w := io.Pipe()
+	lf := newLogPair(&nopLogger{}, []*destination{{name: defaultDestinationName, logger: splunkl}}, nil, r, info)
+	d.mu.Lock()
+	d.logs[info.ContainerID] = lf
+	d.idx[info.ContainerID] = lf
+	d.mu.Unlock()
+	go consumeLog(lf)
+
+	writeTestEntries(t, w, 4)
+
+	report := d.shutdown(time.Second)
+	if report.flushed != 4 || report.shadow.sampled != 4 || report.shadow.sent != 4 || report.shadow.failed != 0 {
+		t.Fatalf("Unexpected report %v", report.fields())
+	}
+	if fields := report.fields(); fields["shadow_sent"] != int64(4) {
+		t.Fatalf("Expected shadow stats in report fields, got %v", fields)
+	}
+}
+
+// Verify that shutdown does not wait for HEC longer than timeout and reports
+// messages it could not send
+func TestShutdownDeadline(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.responseDelay = 10 * time.Second
+
+	go hec.Serve()
+
+	d := newDriver()
+	_, w := startTestLogPair(t, d, hec, "container1iid", &nopLogger{})
+
+	writeTestEntries(t, w, 5)
+
+	start := time.Now()
+	report := d.shutdown(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Shutdown took too long %v", elapsed)
+	}
+
+	if report.loggers != 1 || report.aborted != 1 || report.flushed != 0 || report.lost != 5 {
+		t.Fatalf("Unexpected report %v", report.fields())
+	}
+
+	err := hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
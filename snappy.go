@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// Snappy block format encoder, as used by Loki and Prometheus remote write.
+// Matches are found with a hash table of 4 byte sequences, which is simpler
+// and compresses a little less than the reference implementation.
+
+const (
+	snappyTableBits = 14
+	snappyMaxOffset = 1<<16 - 1
+)
+
+// snappyEncode returns src compressed with snappy block format
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	dst = appendProtoVarint(dst, uint64(len(src)))
+
+	var table [1 << snappyTableBits]int32
+	literal := 0
+	i := 0
+	for i+4 <= len(src) {
+		sequence := binary.LittleEndian.Uint32(src[i:])
+		h := (sequence * 0x1e35a7bd) >> (32 - snappyTableBits)
+		// Table keeps position plus one, so zero means empty
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != sequence {
+			i++
+			continue
+		}
+		dst = appendSnappyLiteral(dst, src[literal:i])
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendSnappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return appendSnappyLiteral(dst, src[literal:])
+}
+
+func appendSnappyLiteral(dst []byte, literal []byte) []byte {
+	n := len(literal)
+	if n == 0 {
+		return dst
+	}
+	switch {
+	case n <= 60:
+		dst = append(dst, byte(n-1)<<2)
+	case n <= 1<<8:
+		dst = append(dst, 60<<2, byte(n-1))
+	case n <= 1<<16:
+		dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+	case n <= 1<<24:
+		dst = append(dst, 62<<2, byte(n-1), byte((n-1)>>8), byte((n-1)>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n-1), byte((n-1)>>8), byte((n-1)>>16), byte((n-1)>>24))
+	}
+	return append(dst, literal...)
+}
+
+// appendSnappyCopy appends copies with 2 byte offset, every copy is at most
+// 64 bytes long
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
@@ -13,22 +13,75 @@ import (
 // Validate options
 func TestValidateLogOpt(t *testing.T) {
 	err := ValidateLogOpt(map[string]string{
-		splunkURLKey:                  "http://127.0.0.1",
-		splunkTokenKey:                "2160C7EF-2CE9-4307-A180-F852B99CF417",
-		splunkSourceKey:               "mysource",
-		splunkSourceTypeKey:           "mysourcetype",
-		splunkIndexKey:                "myindex",
-		splunkCAPathKey:               "/usr/cert.pem",
-		splunkCANameKey:               "ca_name",
-		splunkInsecureSkipVerifyKey:   "true",
-		splunkFormatKey:               "json",
-		splunkVerifyConnectionKey:     "true",
-		splunkGzipCompressionKey:      "true",
-		splunkGzipCompressionLevelKey: "1",
-		envKey:      "a",
-		envRegexKey: "^foo",
-		labelsKey:   "b",
-		tagKey:      "c",
+		splunkURLKey:                   "http://127.0.0.1",
+		splunkTokenKey:                 "2160C7EF-2CE9-4307-A180-F852B99CF417",
+		splunkSourceKey:                "mysource",
+		splunkSourceTypeKey:            "mysourcetype",
+		splunkIndexKey:                 "myindex",
+		splunkHostKey:                  "myhost",
+		splunkCAPathKey:                "/usr/cert.pem",
+		splunkCANameKey:                "ca_name",
+		splunkInsecureSkipVerifyKey:    "true",
+		splunkFormatKey:                "json",
+		splunkFormatTemplateKey:        "{{.Line}}",
+		splunkVerifyConnectionKey:      "true",
+		splunkGzipCompressionKey:       "true",
+		splunkGzipCompressionLevelKey:  "1",
+		splunkMetadataKey:              "all",
+		splunkOrchestratorKey:          "auto",
+		splunkPostMessagesFrequencyKey: "1s",
+		splunkPostMessagesBatchSizeKey: "100",
+		splunkBufferMaximumKey:         "1000",
+		splunkChannelSizeKey:           "400",
+		splunkStrictOrderingKey:        "true",
+		splunkLocalStoreKey:            "json-file",
+		splunkSearchURLKey:             "https://127.0.0.1:8089",
+		splunkSearchTokenKey:           "2160C7EF-2CE9-4307-A180-F852B99CF417",
+		splunkOutputKey:                "syslog",
+		syslogAddressKey:               "tcp+tls://127.0.0.1:6514",
+		syslogFacilityKey:              "local0",
+		syslogFormatKey:                "rfc5424",
+		otlpEndpointKey:                "http://127.0.0.1:4318",
+		otlpProtocolKey:                "http/json",
+		otlpHeadersKey:                 "a=b",
+		fluentdAddressKey:              "tcp://127.0.0.1:24224",
+		fluentdRequireAckKey:           "true",
+		fluentdSharedKeyKey:            "secret",
+		fluentdUsernameKey:             "user",
+		fluentdPasswordKey:             "password",
+		fluentdSelfHostnameKey:         "myhost",
+		elasticsearchURLKey:            "https://127.0.0.1:9200",
+		elasticsearchIndexKey:          "logs-{{.Name}}-2006.01.02",
+		elasticsearchUsernameKey:       "user",
+		elasticsearchPasswordKey:       "password",
+		elasticsearchAPIKeyKey:         "key",
+		lokiURLKey:                     "http://127.0.0.1:3100",
+		lokiFormatKey:                  "json",
+		lokiLabelsKey:                  "container_name,stream",
+		lokiDockerLabelsKey:            "com.example.team",
+		lokiTenantIDKey:                "tenant",
+		archiveS3BucketKey:             "bucket",
+		archiveS3EndpointKey:           "http://127.0.0.1:9000",
+		archiveS3RegionKey:             "us-east-1",
+		archiveS3PrefixKey:             "logs/{{.Name}}",
+		archiveS3PathStyleKey:          "true",
+		archiveS3AccessKeyIDKey:        "AKID",
+		archiveS3SecretAccessKeyKey:    "SECRET",
+		archiveMaxSizeKey:              "64m",
+		archiveMaxAgeKey:               "15m",
+		splunkShadowURLKey:             "https://127.0.0.1:8088",
+		splunkShadowTokenKey:           "shadow",
+		splunkShadowSampleKey:          "10",
+		splunkFilterStreamKey:          "stdout",
+		splunkFilterIncludeKey:         "^GET",
+		splunkFilterExcludeKey:         "health",
+		localMaxSizeKey:                "10m",
+		localMaxFileKey:                "3",
+		localCompressKey:               "true",
+		envKey:                         "a",
+		envRegexKey:                    "^foo",
+		labelsKey:                      "b",
+		tagKey:                         "c",
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -1054,12 +1107,15 @@ func TestSkipVerify(t *testing.T) {
 		}
 	}
 
-	if len(hec.messages) != 0 {
+	hec.lock.Lock()
+	accepted := len(hec.messages)
+	hec.simulateServerError = false
+	hec.lock.Unlock()
+
+	if accepted != 0 {
 		t.Fatal("No messages should be accepted at this point")
 	}
 
-	hec.simulateServerError = false
-
 	for i := defaultStreamChannelSize * 2; i < defaultStreamChannelSize*4; i++ {
 		if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
 			t.Fatal(err)
@@ -1136,12 +1192,15 @@ func TestBufferMaximum(t *testing.T) {
 		}
 	}
 
-	if len(hec.messages) != 0 {
+	hec.lock.Lock()
+	accepted := len(hec.messages)
+	hec.simulateServerError = false
+	hec.lock.Unlock()
+
+	if accepted != 0 {
 		t.Fatal("No messages should be accepted at this point")
 	}
 
-	hec.simulateServerError = false
-
 	err = loggerDriver.Close()
 	if err != nil {
 		t.Fatal(err)
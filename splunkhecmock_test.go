@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
+	"time"
 )
 
 func (message *splunkMessage) EventAsString() (string, error) {
@@ -31,6 +33,8 @@ type HTTPEventCollectorMock struct {
 
 	token               string
 	simulateServerError bool
+	// Bodies larger than that are rejected with 413, like HEC max_content_length
+	maxContentLength int
 
 	test *testing.T
 
@@ -38,6 +42,13 @@ type HTTPEventCollectorMock struct {
 	gzipEnabled        *bool
 	messages           []*splunkMessage
 	numOfRequests      int
+
+	// Requests are handled concurrently, delay lets tests observe how many
+	// requests driver keeps in flight
+	lock          sync.Mutex
+	responseDelay time.Duration
+	inFlight      int
+	maxInFlight   int
 }
 
 func NewHTTPEventCollectorMock(t *testing.T) *HTTPEventCollectorMock {
@@ -70,6 +81,19 @@ func (hec *HTTPEventCollectorMock) Close() error {
 func (hec *HTTPEventCollectorMock) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	var err error
 
+	hec.lock.Lock()
+	hec.inFlight++
+	if hec.inFlight > hec.maxInFlight {
+		hec.maxInFlight = hec.inFlight
+	}
+	hec.lock.Unlock()
+
+	time.Sleep(hec.responseDelay)
+
+	hec.lock.Lock()
+	defer hec.lock.Unlock()
+	hec.inFlight--
+
 	hec.numOfRequests++
 
 	if hec.simulateServerError {
@@ -130,6 +154,11 @@ func (hec *HTTPEventCollectorMock) ServeHTTP(writer http.ResponseWriter, request
 			hec.test.Fatal(err)
 		}
 
+		if hec.maxContentLength > 0 && len(body) > hec.maxContentLength {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		// Parse message
 		messageStart := 0
 		for i := 0; i < len(body); i++ {
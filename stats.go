@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// deliveryStats counts messages of one logger, counters are updated atomically
+// because with the shared sender messages are sent from sender goroutines
+type deliveryStats struct {
+	received int64
+	sent     int64
+	failed   int64
+	dropped  int64
+}
+
+func (s *deliveryStats) addReceived(n int) {
+	atomic.AddInt64(&s.received, int64(n))
+}
+
+func (s *deliveryStats) addSent(n int) {
+	atomic.AddInt64(&s.sent, int64(n))
+}
+
+func (s *deliveryStats) addFailed(n int) {
+	atomic.AddInt64(&s.failed, int64(n))
+}
+
+func (s *deliveryStats) addDropped(n int) {
+	atomic.AddInt64(&s.dropped, int64(n))
+}
+
+// snapshot returns a copy of counters
+func (s *deliveryStats) snapshot() deliveryStats {
+	return deliveryStats{
+		received: atomic.LoadInt64(&s.received),
+		sent:     atomic.LoadInt64(&s.sent),
+		failed:   atomic.LoadInt64(&s.failed),
+		dropped:  atomic.LoadInt64(&s.dropped),
+	}
+}
+
+// pending returns number of messages which are neither sent nor dropped yet
+func (s *deliveryStats) pending() int64 {
+	return atomic.LoadInt64(&s.received) - atomic.LoadInt64(&s.sent) - atomic.LoadInt64(&s.dropped)
+}
+
+// fields returns current values of counters for logging
+func (s *deliveryStats) fields() logrus.Fields {
+	return logrus.Fields{
+		"received": atomic.LoadInt64(&s.received),
+		"sent":     atomic.LoadInt64(&s.sent),
+		"failed":   atomic.LoadInt64(&s.failed),
+		"dropped":  atomic.LoadInt64(&s.dropped),
+	}
+}
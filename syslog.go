@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	syslogAddressKey  = "syslog-address"
+	syslogFacilityKey = "syslog-facility"
+	syslogFormatKey   = "syslog-format"
+)
+
+const (
+	syslogFormatRFC5424 = "rfc5424"
+	syslogFormatRFC3164 = "rfc3164"
+)
+
+const (
+	// Default ports of plain and TLS syslog
+	defaultSyslogPort    = "514"
+	defaultSyslogTLSPort = "6514"
+	// Private enterprise number used in structured data id, the same as
+	// docker syslog driver uses
+	syslogEnterpriseID = "32473"
+)
+
+// Severity of stdout and stderr messages
+const (
+	syslogSeverityErr  = 3
+	syslogSeverityInfo = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// syslogOptions are parsed syslog-* options
+type syslogOptions struct {
+	network  string
+	address  string
+	useTLS   bool
+	facility int
+	format   string
+}
+
+// parseSyslogOptions validates syslog-address, syslog-facility and syslog-format
+func parseSyslogOptions(cfg map[string]string) (*syslogOptions, error) {
+	addressStr, ok := cfg[syslogAddressKey]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is expected with %s=%s", driverName, syslogAddressKey, splunkOutputKey, outputSyslog)
+	}
+	address, err := url.Parse(addressStr)
+	if err != nil || address.Host == "" {
+		return nil, fmt.Errorf("%s: expected format udp|tcp|tcp+tls://host:port for %s", driverName, syslogAddressKey)
+	}
+	options := &syslogOptions{
+		facility: syslogFacilities["daemon"],
+		format:   syslogFormatRFC5424,
+	}
+	port := defaultSyslogPort
+	switch address.Scheme {
+	case "udp", "tcp":
+		options.network = address.Scheme
+	case "tcp+tls":
+		options.network = "tcp"
+		options.useTLS = true
+		port = defaultSyslogTLSPort
+	default:
+		return nil, fmt.Errorf("%s: unsupported scheme '%s' in %s, supported schemes are udp, tcp and tcp+tls", driverName, address.Scheme, syslogAddressKey)
+	}
+	if address.Port() != "" {
+		port = address.Port()
+	}
+	options.address = net.JoinHostPort(address.Hostname(), port)
+
+	if facilityStr, ok := cfg[syslogFacilityKey]; ok {
+		facility, ok := syslogFacilities[facilityStr]
+		if !ok {
+			facility, err = strconv.Atoi(facilityStr)
+			if err != nil || facility < 0 || facility > 23 {
+				return nil, fmt.Errorf("%s: unknown %s '%s'", driverName, syslogFacilityKey, facilityStr)
+			}
+		}
+		options.facility = facility
+	}
+
+	if format, ok := cfg[syslogFormatKey]; ok {
+		switch format {
+		case syslogFormatRFC5424:
+		case syslogFormatRFC3164:
+		default:
+			return nil, fmt.Errorf("%s: unknown %s '%s', supported values are rfc5424 and rfc3164", driverName, syslogFormatKey, format)
+		}
+		options.format = format
+	}
+	return options, nil
+}
+
+// syslogOutput sends messages to syslog server
+type syslogOutput struct {
+	options *syslogOptions
+
+	hostname string
+	appName  string
+	// Pre-encoded RFC 5424 structured data with tag and attrs
+	structuredData string
+
+	mu     sync.Mutex
+	conn   outputConn
+	buffer bytes.Buffer
+}
+
+func newSyslogOutput(ctx context.Context, info logger.Info, metadata outputMetadata) (*syslogOutput, error) {
+	options, err := parseSyslogOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+	s := &syslogOutput{
+		options:        options,
+		hostname:       syslogHeaderField(metadata.host, 255),
+		structuredData: syslogStructuredData(metadata.tag, metadata.attrs),
+	}
+	if options.format == syslogFormatRFC3164 {
+		s.appName = syslogHeaderField(metadata.tag, 32)
+	} else {
+		s.appName = syslogHeaderField(metadata.tag, 48)
+	}
+	s.conn = outputConn{
+		ctx:     ctx,
+		network: options.network,
+		address: options.address,
+	}
+	if options.useTLS {
+		s.conn.tlsConfig, err = outputTLSConfig(info, options.address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *syslogOutput) send(messages []*splunkMessage, reject func(messages []*splunkMessage, reason string, status int)) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, message := range messages {
+		s.buffer.Reset()
+		s.encodeMessage(&s.buffer, message)
+		err := s.conn.do(func(conn net.Conn) error {
+			_, err := conn.Write(s.buffer.Bytes())
+			return err
+		})
+		if err != nil {
+			return i, fmt.Errorf("%s: failed to send message to syslog %s - %v", driverName, s.options.address, err)
+		}
+	}
+	return len(messages), nil
+}
+
+func (s *syslogOutput) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.disconnect()
+	return nil
+}
+
+// encodeMessage writes syslog frame of the message. Stream transports use
+// octet counting, every datagram carries one message.
+func (s *syslogOutput) encodeMessage(buffer *bytes.Buffer, message *splunkMessage) {
+	var msg string
+	if s.options.format == syslogFormatRFC3164 {
+		msg = s.formatRFC3164(message)
+	} else {
+		msg = s.formatRFC5424(message)
+	}
+	if s.options.network == "tcp" {
+		buffer.WriteString(strconv.Itoa(len(msg)))
+		buffer.WriteByte(' ')
+	}
+	buffer.WriteString(msg)
+}
+
+func (s *syslogOutput) priority(message *splunkMessage) int {
+	severity := syslogSeverityInfo
+	if message.stream == "stderr" {
+		severity = syslogSeverityErr
+	}
+	return s.options.facility*8 + severity
+}
+
+// formatRFC5424 returns <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+func (s *syslogOutput) formatRFC5424(message *splunkMessage) string {
+	return fmt.Sprintf("<%d>1 %s %s %s - - %s %s",
+		s.priority(message),
+		message.timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.appName,
+		s.structuredData,
+		messageLine(message))
+}
+
+// formatRFC3164 returns <PRI>TIMESTAMP HOSTNAME TAG: MSG
+func (s *syslogOutput) formatRFC3164(message *splunkMessage) string {
+	return fmt.Sprintf("<%d>%s %s %s: %s",
+		s.priority(message),
+		message.timestamp.Local().Format(time.Stamp),
+		s.hostname,
+		s.appName,
+		messageLine(message))
+}
+
+// syslogHeaderField returns value which can be used as header field, printable
+// ASCII without spaces, or nil value "-"
+func syslogHeaderField(value string, maxLength int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+// syslogStructuredData encodes tag and attrs as one SD-ELEMENT, attrs are
+// sorted so every message has the same structured data
+func syslogStructuredData(tag string, attrs map[string]string) string {
+	if tag == "" && len(attrs) == 0 {
+		return "-"
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("[docker@" + syslogEnterpriseID)
+	if tag != "" {
+		writeSyslogParam(&buffer, "tag", tag)
+	}
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeSyslogParam(&buffer, key, attrs[key])
+	}
+	buffer.WriteString("]")
+	return buffer.String()
+}
+
+func writeSyslogParam(buffer *bytes.Buffer, name, value string) {
+	// PARAM-NAME cannot contain '=', ']', '"' and spaces, and is at most 32 characters
+	name = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	buffer.WriteString(" " + name + "=\"")
+	// PARAM-VALUE escapes '"', '\' and ']'
+	for _, r := range value {
+		if r == '"' || r == '\\' || r == ']' {
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteRune(r)
+	}
+	buffer.WriteString("\"")
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// readSyslogFrames reads octet counted frames from connection until it is closed
+func readSyslogFrames(conn net.Conn, frames chan<- string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			return
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return
+		}
+		frames <- string(frame)
+	}
+}
+
+// acceptSyslogFrames serves every connection of the listener with readSyslogFrames
+func acceptSyslogFrames(listener net.Listener, frames chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go readSyslogFrames(conn, frames)
+	}
+}
+
+func receiveFrame(t *testing.T, frames <-chan string) string {
+	select {
+	case frame := <-frames:
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for syslog message")
+	}
+	return ""
+}
+
+func logSyslogMessages(t *testing.T, info logger.Info, lines ...string) {
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range lines {
+		source := "stdout"
+		if i%2 == 1 {
+			source = "stderr"
+		}
+		if err := loggerDriver.Log(&logger.Message{Line: []byte(line), Source: source, Timestamp: time.Unix(1519905600, 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loggerDriver.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that messages are sent as RFC 5424 datagrams with tag and attrs in
+// structured data
+func TestSyslogOutputUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkOutputKey:   outputSyslog,
+			syslogAddressKey:  "udp://" + conn.LocalAddr().String(),
+			syslogFacilityKey: "local0",
+			splunkHostKey:     "myhost",
+			tagKey:            "{{.ID}}",
+			labelsKey:         "a",
+		},
+		ContainerID:     "containeriid",
+		ContainerLabels: map[string]string{"a": `b"]`},
+	}
+	logSyslogMessages(t, info, "first", "second")
+
+	expected := []string{
+		`<134>1 2018-03-01T12:00:00.000000Z myhost containeriid - - [docker@32473 tag="containeriid" a="b\"\]"] first`,
+		`<131>1 2018-03-01T12:00:00.000000Z myhost containeriid - - [docker@32473 tag="containeriid" a="b\"\]"] second`,
+	}
+	buf := make([]byte, 1024)
+	for _, message := range expected {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != message {
+			t.Fatalf("Unexpected message %s, expected %s", buf[:n], message)
+		}
+	}
+}
+
+// Verify that TCP messages use octet counting and RFC 3164 format
+func TestSyslogOutputTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	frames := make(chan string, 10)
+	go acceptSyslogFrames(listener, frames)
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkOutputKey:  outputSyslog,
+			syslogAddressKey: "tcp://" + listener.Addr().String(),
+			syslogFormatKey:  syslogFormatRFC3164,
+			splunkHostKey:    "myhost",
+			tagKey:           "mytag",
+		},
+		ContainerID: "containeriid",
+	}
+	logSyslogMessages(t, info, "first line", "second\nline")
+
+	timestamp := time.Unix(1519905600, 0).Format(time.Stamp)
+	for _, message := range []string{
+		"<30>" + timestamp + " myhost mytag: first line",
+		"<27>" + timestamp + " myhost mytag: second\nline",
+	} {
+		if frame := receiveFrame(t, frames); frame != message {
+			t.Fatalf("Unexpected message %q, expected %q", frame, message)
+		}
+	}
+}
+
+// Verify that TLS connection trusts CA from splunk-capath
+func TestSyslogOutputTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	caFile, err := ioutil.TempFile("", "splunk-logging-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	frames := make(chan string, 10)
+	go acceptSyslogFrames(listener, frames)
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkOutputKey:  outputSyslog,
+			syslogAddressKey: "tcp+tls://" + listener.Addr().String(),
+			splunkCAPathKey:  caFile.Name(),
+			splunkCANameKey:  "example.com",
+			splunkHostKey:    "myhost",
+			tagKey:           "",
+		},
+		ContainerID: "containeriid",
+	}
+	logSyslogMessages(t, info, "secure")
+
+	message := "<30>1 2018-03-01T12:00:00.000000Z myhost - - - - secure"
+	if frame := receiveFrame(t, frames); frame != message {
+		t.Fatalf("Unexpected message %q, expected %q", frame, message)
+	}
+}
+
+// Verify that output dials again when server closes connection
+func TestSyslogOutputReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	frames := make(chan string, 10)
+	go acceptSyslogFrames(listener, frames)
+
+	info := logger.Info{
+		Config: map[string]string{
+			syslogAddressKey: "tcp://" + listener.Addr().String(),
+			splunkHostKey:    "myhost",
+			tagKey:           "mytag",
+		},
+		ContainerID: "containeriid",
+	}
+	output, err := newSyslogOutput(context.Background(), info, outputMetadata{host: "myhost", tag: "mytag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+
+	message := &splunkMessage{Event: "first", timestamp: time.Unix(1519905600, 0)}
+	if sent, err := output.send([]*splunkMessage{message}, nil); err != nil || sent != 1 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+	receiveFrame(t, frames)
+
+	// Write to the broken connection fails and is retried on a new connection
+	output.conn.conn.Close()
+	message.Event = "second"
+	if sent, err := output.send([]*splunkMessage{message}, nil); err != nil || sent != 1 {
+		t.Fatalf("Unexpected result %d, %v", sent, err)
+	}
+	if frame := receiveFrame(t, frames); !strings.HasSuffix(frame, " second") {
+		t.Fatalf("Unexpected message %q", frame)
+	}
+}
+
+func TestParseSyslogOptions(t *testing.T) {
+	options, err := parseSyslogOptions(map[string]string{syslogAddressKey: "tcp+tls://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.network != "tcp" || !options.useTLS || options.address != "example.com:6514" ||
+		options.facility != 3 || options.format != syslogFormatRFC5424 {
+		t.Fatalf("Unexpected options %+v", options)
+	}
+
+	for _, cfg := range []map[string]string{
+		{},
+		{syslogAddressKey: "http://example.com"},
+		{syslogAddressKey: "udp://example.com", syslogFacilityKey: "unknown"},
+		{syslogAddressKey: "udp://example.com", syslogFormatKey: "rfc1"},
+	} {
+		if _, err := parseSyslogOptions(cfg); err == nil {
+			t.Fatalf("Expecting error for %v", cfg)
+		}
+	}
+
+	if err := ValidateLogOpt(map[string]string{splunkOutputKey: "unknown"}); err == nil {
+		t.Fatal("Expecting error for unknown output")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	// How big can be body of one request, before compression
+	defaultPostMessagesBatchBytes = 1000000
+	// Learned limit of an endpoint is never lower than that
+	minPostMessagesBatchBytes = 1024
+	// Learned limit is forgotten after that, so endpoint which was
+	// reconfigured to accept bigger requests gets them again
+	learnedBatchBytesExpiry = 10 * time.Minute
+)
+
+const (
+	envVarPostMessagesBatchBytes = "SPLUNK_LOGGING_DRIVER_POST_MESSAGES_BATCH_BYTES"
+)
+
+// hecTarget is HEC endpoint with http client and compression settings
+type hecTarget struct {
+	client    *http.Client
+	transport *http.Transport
+
+	url         string
+	auth        string
+	contentType string
+	// Additional headers of every request
+	headers map[string]string
+
+	// http compression
+	gzipCompression      bool
+	gzipCompressionLevel int
+
+	postMessagesBatchBytes int
+
+	// Cancelled when plugin is shutting down and drain deadline is reached, so
+	// requests in flight do not block shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newHECTarget creates HEC target from splunk-url, splunk-token, TLS and
+// compression options
+func newHECTarget(info logger.Info) (*hecTarget, error) {
+	// Parse and validate Splunk URL
+	splunkURL, err := parseURL(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Splunk Token is required parameter
+	splunkToken, ok := info.Config[splunkTokenKey]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is expected", driverName, splunkTokenKey)
+	}
+
+	tlsConfig, err := parseTLSConfig(info)
+	if err != nil {
+		return nil, err
+	}
+
+	gzipCompression, gzipCompressionLevel, err := parseGzipOptions(info.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := newHTTPTransport(tlsConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	target := &hecTarget{
+		ctx:                    ctx,
+		cancel:                 cancel,
+		postMessagesBatchBytes: getAdvancedOptionInt(envVarPostMessagesBatchBytes, defaultPostMessagesBatchBytes),
+		client: &http.Client{
+			Transport: transport,
+		},
+		transport:            transport,
+		url:                  splunkURL.String(),
+		auth:                 "Splunk " + splunkToken,
+		contentType:          "application/json",
+		gzipCompression:      gzipCompression,
+		gzipCompressionLevel: gzipCompressionLevel,
+	}
+
+	return target, nil
+}
+
+// parseGzipOptions returns whether requests are compressed and the level of
+// compression
+func parseGzipOptions(cfg map[string]string) (bool, int, error) {
+	var err error
+	gzipCompression := false
+	if gzipCompressionStr, ok := cfg[splunkGzipCompressionKey]; ok {
+		gzipCompression, err = strconv.ParseBool(gzipCompressionStr)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+
+	gzipCompressionLevel := gzip.DefaultCompression
+	if gzipCompressionLevelStr, ok := cfg[splunkGzipCompressionLevelKey]; ok {
+		gzipCompressionLevel64, err := strconv.ParseInt(gzipCompressionLevelStr, 10, 32)
+		if err != nil {
+			return false, 0, err
+		}
+		gzipCompressionLevel = int(gzipCompressionLevel64)
+		if gzipCompressionLevel < gzip.DefaultCompression || gzipCompressionLevel > gzip.BestCompression {
+			err := fmt.Errorf("Not supported level '%s' for %s (supported values between %d and %d).",
+				gzipCompressionLevelStr, splunkGzipCompressionLevelKey, gzip.DefaultCompression, gzip.BestCompression)
+			return false, 0, err
+		}
+	}
+	return gzipCompression, gzipCompressionLevel, nil
+}
+
+// sendError is returned when HEC responds with status other than 200
+type sendError struct {
+	statusCode int
+	status     string
+	body       []byte
+}
+
+func (e *sendError) Error() string {
+	return fmt.Sprintf("%s: failed to send event - %s - %s", driverName, e.status, e.body)
+}
+
+func isRequestTooLarge(err error) bool {
+	sendErr, ok := err.(*sendError)
+	return ok && sendErr.statusCode == http.StatusRequestEntityTooLarge
+}
+
+// endpointLimit is request size limit learned from 413 responses
+type endpointLimit struct {
+	limit int
+	// When the limit was last lowered
+	learned time.Time
+}
+
+// endpointLimits keeps request size limits learned from 413 responses by URL
+// and token, so all loggers sending to the same endpoint with the same token
+// use them. Limits expire after learnedBatchBytesExpiry.
+var endpointLimits = struct {
+	sync.Mutex
+	limits map[string]endpointLimit
+}{limits: make(map[string]endpointLimit)}
+
+// limitKey identifies endpoint of the target, HEC can have different limits
+// for different tokens
+func (t *hecTarget) limitKey() string {
+	return t.url + "\x00" + t.auth
+}
+
+// maxBatchBytes returns how big can be body of one request to the endpoint
+func (t *hecTarget) maxBatchBytes() int {
+	endpointLimits.Lock()
+	defer endpointLimits.Unlock()
+	key := t.limitKey()
+	current, ok := endpointLimits.limits[key]
+	if !ok {
+		return t.postMessagesBatchBytes
+	}
+	if time.Since(current.learned) > learnedBatchBytesExpiry {
+		delete(endpointLimits.limits, key)
+		return t.postMessagesBatchBytes
+	}
+	if current.limit < t.postMessagesBatchBytes {
+		return current.limit
+	}
+	return t.postMessagesBatchBytes
+}
+
+// learnMaxBatchBytes lowers limit of the endpoint after it rejected request of size
+func (t *hecTarget) learnMaxBatchBytes(size int) {
+	limit := size / 2
+	if limit < minPostMessagesBatchBytes {
+		limit = minPostMessagesBatchBytes
+	}
+	endpointLimits.Lock()
+	defer endpointLimits.Unlock()
+	key := t.limitKey()
+	current, ok := endpointLimits.limits[key]
+	if !ok || limit < current.limit || time.Since(current.learned) > learnedBatchBytesExpiry {
+		endpointLimits.limits[key] = endpointLimit{limit: limit, learned: time.Now()}
+	}
+}
+
+// postEncoded sends encoded messages, where message i ends at ends[i] in data,
+// in requests not bigger than limit of the endpoint. When HEC rejects request
+// as too large, it is split in halves. Message which is rejected on its own is
+// passed to tooLarge with the error. Returns number of messages sent or passed to tooLarge
+// before the first error.
+func (t *hecTarget) postEncoded(data []byte, ends []int, tooLarge func(i int, err error)) (int, error) {
+	sent := 0
+	for start := 0; start < len(ends); {
+		limit := t.maxBatchBytes()
+		end := start + 1
+		for end < len(ends) && ends[end]-messageStart(ends, start) <= limit {
+			end++
+		}
+		n, err := t.postSplitting(data, ends, start, end, tooLarge)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		start = end
+	}
+	return sent, nil
+}
+
+func (t *hecTarget) postSplitting(data []byte, ends []int, start, end int, tooLarge func(i int, err error)) (int, error) {
+	body := data[messageStart(ends, start):ends[end-1]]
+	err := t.postBody(body, nil)
+	if err == nil {
+		return end - start, nil
+	}
+	if !isRequestTooLarge(err) {
+		return 0, err
+	}
+	if end-start == 1 {
+		tooLarge(start, err)
+		return 1, nil
+	}
+	t.learnMaxBatchBytes(len(body))
+	middle := (start + end) / 2
+	sent, err := t.postSplitting(data, ends, start, middle, tooLarge)
+	if err != nil {
+		return sent, err
+	}
+	n, err := t.postSplitting(data, ends, middle, end, tooLarge)
+	return sent + n, err
+}
+
+func messageStart(ends []int, i int) int {
+	if i == 0 {
+		return 0
+	}
+	return ends[i-1]
+}
+
+// postBody sends encoded messages to the endpoint in one request. Body of
+// successful response is copied to response, unless it is nil.
+func (t *hecTarget) postBody(data []byte, response io.Writer) error {
+	// If gzip compression is enabled - compress encoded messages with specified
+	// compression level into pooled buffer
+	if t.gzipCompression {
+		compressed := getBuffer()
+		defer putBuffer(compressed)
+		gzipWriter, err := getGzipWriter(compressed, t.gzipCompressionLevel)
+		if err != nil {
+			return err
+		}
+		defer putGzipWriter(gzipWriter, t.gzipCompressionLevel)
+		if _, err := gzipWriter.Write(data); err != nil {
+			return err
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	}
+	body := newPooledBody(data)
+	// Buffers can be returned to the pool only after transport is done with the body
+	defer func() {
+		<-body.closed
+	}()
+	req, err := http.NewRequest("POST", t.url, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req = req.WithContext(t.ctx)
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Type", t.contentType)
+	if t.auth != "" {
+		req.Header.Set("Authorization", t.auth)
+	}
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	// Tell if we are sending gzip compressed body
+	if t.gzipCompression {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// HEC responds with 200, other endpoints may respond with 204
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var body []byte
+		body, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		return &sendError{res.StatusCode, res.Status, body}
+	}
+	if response == nil {
+		response = ioutil.Discard
+	}
+	_, err = io.Copy(response, res.Body)
+	return err
+}
+
+// encodeMessages encodes messages into buffer and returns where every message ends
+func encodeMessages(buffer *bytes.Buffer, count int, encode func(buffer *bytes.Buffer, i int) error) ([]int, error) {
+	ends := make([]int, count)
+	for i := 0; i < count; i++ {
+		if err := encode(buffer, i); err != nil {
+			return nil, err
+		}
+		ends[i] = buffer.Len()
+	}
+	return ends, nil
+}
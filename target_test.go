@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify that batches are limited by size in bytes
+func TestBatchBytes(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	if err := os.Setenv(envVarPostMessagesBatchBytes, "2048"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesBatchBytes)
+
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every message is a bit more than 1000 bytes, so only one fits in a request
+	line := strings.Repeat("a", 1000)
+	for i := 0; i < 10; i++ {
+		if err := loggerDriver.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 10 {
+		t.Fatalf("Expected # of messages %d, got %d", 10, len(hec.messages))
+	}
+
+	if hec.numOfRequests != 10 {
+		t.Fatalf("Unexpected number of requests %d", hec.numOfRequests)
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that batches rejected with 413 are split and endpoint limit is learned
+func TestSplitOnRequestTooLarge(t *testing.T) {
+	if err := os.Setenv(envVarPostMessagesFrequency, "10h"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(envVarPostMessagesFrequency)
+
+	hec := NewHTTPEventCollectorMock(t)
+	hec.maxContentLength = 4096
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:              hec.URL(),
+			splunkTokenKey:            hec.token,
+			splunkVerifyConnectionKey: "false",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.Repeat("a", 1000)
+	for i := 0; i < 16; i++ {
+		if err := loggerDriver.Log(&logger.Message{Line: []byte(fmt.Sprintf("%d %s", i, line)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Message which can never be accepted is dropped, following messages are sent
+	if err := loggerDriver.Log(&logger.Message{Line: []byte(strings.Repeat("b", 5000)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("last"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 17 {
+		t.Fatalf("Expected # of messages %d, got %d", 17, len(hec.messages))
+	}
+
+	for i, message := range hec.messages[:16] {
+		if event, err := message.EventAsMap(); err != nil {
+			t.Fatal(err)
+		} else {
+			if !strings.HasPrefix(event["line"].(string), fmt.Sprintf("%d ", i)) {
+				t.Fatalf("Unexpected event in message %v", event)
+			}
+		}
+	}
+
+	l := loggerDriver.(*splunkLoggerInline)
+	if limit := l.maxBatchBytes(); limit >= 4096 {
+		t.Fatalf("Limit of the endpoint should be learned, got %d", limit)
+	}
+
+	if l.stats.sent != 17 || l.stats.dropped != 1 {
+		t.Fatalf("Unexpected stats %v", l.stats.fields())
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify that learned limit is kept per URL and token and expires
+func TestLearnedBatchBytes(t *testing.T) {
+	target := &hecTarget{url: "https://hec.example.com:8088/services/collector/event/1.0", auth: "Splunk first", postMessagesBatchBytes: defaultPostMessagesBatchBytes}
+	other := &hecTarget{url: target.url, auth: "Splunk second", postMessagesBatchBytes: defaultPostMessagesBatchBytes}
+
+	target.learnMaxBatchBytes(8192)
+	if limit := target.maxBatchBytes(); limit != 4096 {
+		t.Fatalf("Unexpected limit %d", limit)
+	}
+	if limit := other.maxBatchBytes(); limit != defaultPostMessagesBatchBytes {
+		t.Fatalf("Limit of another token should not change, got %d", limit)
+	}
+
+	endpointLimits.Lock()
+	endpointLimits.limits[target.limitKey()] = endpointLimit{limit: 4096, learned: time.Now().Add(-learnedBatchBytesExpiry - time.Second)}
+	endpointLimits.Unlock()
+	if limit := target.maxBatchBytes(); limit != defaultPostMessagesBatchBytes {
+		t.Fatalf("Expected limit to expire, got %d", limit)
+	}
+}
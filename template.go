@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/templates"
+)
+
+// templateData is passed to templates of splunk-index, splunk-source,
+// splunk-sourcetype and splunk-host. It exposes the same fields and methods as
+// tag templates ({{.Name}}, {{.ImageName}}, {{.ID}}, ...) and orchestrator
+// fields ({{.Service}}, {{.Namespace}}, ...).
+type templateData struct {
+	*logger.Info
+	*orchestratorInfo
+}
+
+// Label returns the value of the container label name, or empty string
+func (d *templateData) Label(name string) string {
+	return d.ContainerLabels[name]
+}
+
+// renderOptionTemplate returns the value of the option key. Values containing
+// template actions are rendered with the same template language as tag, so
+// errors in templates are reported when the logger is created.
+func renderOptionTemplate(info logger.Info, key string, data *templateData) (string, error) {
+	return renderTemplate(key, info.Config[key], data)
+}
+
+// renderTemplate renders value of the option key
+func renderTemplate(key, value string, data *templateData) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := templates.NewParse(key, value)
+	if err != nil {
+		return "", fmt.Errorf("%s: failed to parse template of %s: %v", driverName, key, err)
+	}
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("%s: failed to execute template of %s: %v", driverName, key, err)
+	}
+	return buffer.String(), nil
+}
+
+// eventTemplateData is passed to the template of splunk-format-template for
+// every message
+type eventTemplateData struct {
+	// Line is the log line as a string
+	Line string
+	// JSON is the log line parsed as JSON, or nil if line is not a valid JSON
+	JSON      interface{}
+	Source    string
+	Timestamp time.Time
+	Partial   bool
+	Tag       string
+	Attrs     map[string]string
+}
+
+// eventTemplate renders event bodies for splunk-format=template
+type eventTemplate struct {
+	tmpl  *template.Template
+	tag   string
+	attrs map[string]string
+}
+
+// parseEventTemplate parses splunk-format-template and verifies that it can be
+// executed, so invalid templates are reported when the logger is created
+func parseEventTemplate(info logger.Info, tag string, attrs map[string]string) (*eventTemplate, error) {
+	value, ok := info.Config[splunkFormatTemplateKey]
+	if !ok || value == "" {
+		return nil, fmt.Errorf("%s: %s is expected with %s=%s", driverName, splunkFormatTemplateKey, splunkFormatKey, splunkFormatTemplate)
+	}
+	tmpl, err := templates.NewParse(splunkFormatTemplateKey, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to parse template of %s: %v", driverName, splunkFormatTemplateKey, err)
+	}
+	t := &eventTemplate{
+		tmpl:  tmpl,
+		tag:   tag,
+		attrs: attrs,
+	}
+	if _, err := t.render(&logger.Message{Line: []byte("{}"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// render executes template with the message. If the result is a valid JSON it
+// is sent as a JSON event, otherwise as a string.
+func (t *eventTemplate) render(msg *logger.Message) (interface{}, error) {
+	data := eventTemplateData{
+		Line:      string(msg.Line),
+		Source:    msg.Source,
+		Timestamp: msg.Timestamp,
+		Partial:   isPartial(msg),
+		Tag:       t.tag,
+		Attrs:     t.attrs,
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(msg.Line, &parsed); err == nil {
+		data.JSON = parsed
+	}
+
+	var buffer bytes.Buffer
+	if err := t.tmpl.Execute(&buffer, &data); err != nil {
+		return nil, fmt.Errorf("%s: failed to execute template of %s: %v", driverName, splunkFormatTemplateKey, err)
+	}
+	if json.Valid(buffer.Bytes()) {
+		rawJSONMessage := json.RawMessage(buffer.Bytes())
+		return &rawJSONMessage, nil
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// Verify index, source, sourcetype and host can be templates
+func TestTemplatedFields(t *testing.T) {
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:        hec.URL(),
+			splunkTokenKey:      hec.token,
+			splunkIndexKey:      "{{.Label \"team\"}}",
+			splunkSourceKey:     "docker://{{.Name}}",
+			splunkSourceTypeKey: "{{.ImageName | lower}}",
+			splunkHostKey:       "{{.DaemonName}}-{{.ID}}",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "Container_Image_Name",
+		DaemonName:         "docker",
+		ContainerLabels: map[string]string{
+			"team": "payments",
+		},
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("1"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 1 {
+		t.Fatal("Expected one message")
+	}
+
+	message := hec.messages[0]
+	if message.Index != "payments" ||
+		message.Source != "docker://container_name" ||
+		message.SourceType != "container_image_name" ||
+		message.Host != "docker-containeriid" {
+		t.Fatalf("Unexpected values of message %v", message)
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify static values are not rendered
+func TestStaticHost(t *testing.T) {
+	info := logger.Info{
+		Config: map[string]string{
+			splunkHostKey: "myhost",
+		},
+	}
+
+	host, err := renderOptionTemplate(info, splunkHostKey, &templateData{&info, &orchestratorInfo{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "myhost" {
+		t.Fatalf("Unexpected host %s", host)
+	}
+}
+
+// Verify invalid templates are rejected when logger is created
+func TestInvalidIndexTemplate(t *testing.T) {
+	info := logger.Info{
+		Config: map[string]string{
+			splunkIndexKey: "{{.Unknown}}",
+		},
+	}
+
+	if _, err := renderOptionTemplate(info, splunkIndexKey, &templateData{&info, &orchestratorInfo{}}); err == nil {
+		t.Fatal("Expecting error on unknown template field")
+	}
+
+	info.Config[splunkIndexKey] = "{{.Name"
+	if _, err := renderOptionTemplate(info, splunkIndexKey, &templateData{&info, &orchestratorInfo{}}); err == nil {
+		t.Fatal("Expecting error on invalid template")
+	}
+}
+
+// Verify template format defines event body
+func TestTemplateFormat(t *testing.T) {
+	hec := NewHTTPEventCollectorMock(t)
+
+	go hec.Serve()
+
+	info := logger.Info{
+		Config: map[string]string{
+			splunkURLKey:            hec.URL(),
+			splunkTokenKey:          hec.token,
+			splunkFormatKey:         splunkFormatTemplate,
+			splunkFormatTemplateKey: `{"msg":{{json .Line}},"level":{{json (index .JSON "level")}},"stream":"{{.Source}}","tag":"{{.Tag}}","a":"{{.Attrs.a}}"}`,
+			labelsKey:               "a",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+		ContainerLabels: map[string]string{
+			"a": "b",
+		},
+	}
+
+	loggerDriver, err := New(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := loggerDriver.(*splunkLoggerTemplate); !ok {
+		t.Fatal("Unexpected Splunk Logging Driver type")
+	}
+
+	if err := loggerDriver.Log(&logger.Message{Line: []byte("{\"level\":\"info\"}"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = loggerDriver.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.messages) != 1 {
+		t.Fatal("Expected one message")
+	}
+
+	if event, err := hec.messages[0].EventAsMap(); err != nil {
+		t.Fatal(err)
+	} else {
+		if event["msg"] != "{\"level\":\"info\"}" ||
+			event["level"] != "info" ||
+			event["stream"] != "stdout" ||
+			event["tag"] != "containeriid" ||
+			event["a"] != "b" ||
+			len(event) != 5 {
+			t.Fatalf("Unexpected event in message %v", event)
+		}
+	}
+
+	err = hec.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Verify template format produces string events when result is not a JSON
+func TestTemplateFormatString(t *testing.T) {
+	info := logger.Info{
+		Config: map[string]string{
+			splunkFormatTemplateKey: "{{.Tag}} [{{.Source}}] {{.Line}}",
+		},
+	}
+
+	eventTemplate, err := parseEventTemplate(info, "mytag", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := eventTemplate.render(&logger.Message{Line: []byte("hello"), Source: "stderr", Timestamp: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event != "mytag [stderr] hello" {
+		t.Fatalf("Unexpected event %v", event)
+	}
+}
+
+// Verify template format requires a valid template
+func TestTemplateFormatInvalid(t *testing.T) {
+	info := logger.Info{
+		Config: map[string]string{},
+	}
+
+	if _, err := parseEventTemplate(info, "", nil); err == nil {
+		t.Fatal("Expecting error when template is not specified")
+	}
+
+	info.Config[splunkFormatTemplateKey] = "{{.Line"
+	if _, err := parseEventTemplate(info, "", nil); err == nil {
+		t.Fatal("Expecting error on invalid template")
+	}
+
+	info.Config[splunkFormatTemplateKey] = "{{.Unknown}}"
+	if _, err := parseEventTemplate(info, "", nil); err == nil {
+		t.Fatal("Expecting error on unknown template field")
+	}
+}